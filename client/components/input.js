@@ -28,7 +28,7 @@ export const Select = (props) => {
     const choices = props.choices || [];
     const id = props.id ? {id: props.id} : {};
     return (
-        <select className="component_select" {...id} name={props.name} onChange={props.onChange} defaultValue={props.value}>
+        <select className="component_select" {...id} name={props.name} onChange={props.onChange} defaultValue={props.value} disabled={props.disabled}>
           <option hidden>{props.placeholder}</option>
           {
               choices.map((choice, index) => {
@@ -82,7 +82,7 @@ export class Enabler extends React.Component {
 
     render(){
         return (
-            <Input type="checkbox" onChange={this.onChange.bind(this)} defaultChecked={this.props.defaultValue} />
+            <Input type="checkbox" onChange={this.onChange.bind(this)} defaultChecked={this.props.defaultValue} disabled={this.props.disabled} />
         );
     }
 };
@@ -4,6 +4,7 @@ export function http_get(url, type = 'json'){
         xhr.open('GET', url, true);
         xhr.withCredentials = true;
         xhr.setRequestHeader('X-Requested-With', 'XmlHttpRequest');
+        xhr.setRequestHeader('X-Csrf-Token', csrf_token(url));
         xhr.onreadystatechange = function() {
             if (xhr.readyState === XMLHttpRequest.DONE) {
                 if(xhr.status === 200){
@@ -39,6 +40,7 @@ export function http_post(url, data, type = 'json', params){
         xhr.open("POST", url, true);
         xhr.withCredentials = true;
         xhr.setRequestHeader('X-Requested-With', 'XmlHttpRequest');
+        xhr.setRequestHeader('X-Csrf-Token', csrf_token(url));
         if(type === 'json'){
             data = JSON.stringify(data);
             xhr.setRequestHeader('Content-Type', 'application/json');
@@ -83,6 +85,7 @@ export function http_delete(url){
         xhr.open("DELETE", url, true);
         xhr.withCredentials = true;
         xhr.setRequestHeader('X-Requested-With', 'XmlHttpRequest');
+        xhr.setRequestHeader('X-Csrf-Token', csrf_token(url));
         xhr.onload = function () {
             if (xhr.readyState === XMLHttpRequest.DONE) {
                 if(xhr.status === 200){
@@ -114,6 +117,7 @@ export function http_options(url){
         xhr.open("OPTIONS", url, true);
         xhr.withCredentials = true;
         xhr.setRequestHeader('X-Requested-With', 'XmlHttpRequest');
+        xhr.setRequestHeader('X-Csrf-Token', csrf_token(url));
         xhr.onload = function(){
             if(xhr.readyState === XMLHttpRequest.DONE){
                 if(xhr.status !== 200){
@@ -134,6 +138,12 @@ export function http_options(url){
 }
 
 
+function csrf_token(url){
+    const name = url.indexOf("/admin/api/") === 0 ? "csrf_admin" : "csrf";
+    const cookie = document.cookie.split("; ").find((c) => c.indexOf(name + "=") === 0);
+    return cookie ? decodeURIComponent(cookie.substring(name.length + 1)) : "";
+}
+
 function handle_error_response(xhr, err){
     const response = (function(content){
         let message = content;
@@ -1,6 +1,6 @@
 "use strict";
 
-import { http_get, http_post, http_options, prepare, basename, dirname, pathBuilder } from '../helpers/';
+import { http_get, http_post, http_delete, http_options, prepare, basename, dirname, pathBuilder } from '../helpers/';
 import { filetype, currentShare, appendShareToUrl } from '../helpers/';
 
 import { Observable } from 'rxjs/Observable';
@@ -132,7 +132,7 @@ class FileSystem{
         const url = appendShareToUrl('/api/files/rm?path='+prepare(path));
         return this._replace(path, 'loading')
             .then((res) => this.current_path === dirname(path) ? this._ls_from_cache(dirname(path)) : Promise.resolve(res))
-            .then(() => http_get(url))
+            .then(() => http_delete(url))
             .then((res) => {
                 return cache.remove(cache.FILE_CONTENT, [currentShare(), path])
                     .then(cache.remove(cache.FILE_CONTENT, [currentShare(), path], false))
@@ -217,7 +217,7 @@ class FileSystem{
 
         const action_execute = (part_of_a_batch_operation = false) => {
             if(part_of_a_batch_operation === true){
-                return http_get(url)
+                return http_post(url, {})
                     .then(() => {
                         return this._replace(destination_path, null, 'loading')
                             .then(() => this._refresh(destination_path));
@@ -229,7 +229,7 @@ class FileSystem{
                     });
             }
 
-            return http_get(url)
+            return http_post(url, {})
                 .then(() => {
                     return this._replace(destination_path, null, 'loading')
                         .then(() => origin_path !== destination_path ? this._remove(origin_path, 'loading') : Promise.resolve())
@@ -311,7 +311,7 @@ class FileSystem{
                     return http_post(url, formData, 'multipart', params);
                 }else{
                     const url = appendShareToUrl('/api/files/touch?path='+prepare(path));
-                    return http_get(url);
+                    return http_post(url, {});
                 }
             }
         };
@@ -333,7 +333,7 @@ class FileSystem{
         return this._replace(origin_path, 'loading')
             .then(this._add(destination_path, 'loading'))
             .then(() => this._refresh(origin_path, destination_path))
-            .then(() => http_get(url))
+            .then(() => http_post(url, {}))
             .then((res) => {
                 return this._remove(origin_path, 'loading')
                     .then(() => this._replace(destination_path, null, 'loading'))
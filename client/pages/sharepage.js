@@ -103,6 +103,17 @@ export class SharePage extends React.Component {
                   </form>
                 </Container>
             );
+        } else if(this.state.key === "totp"){
+            return (
+                <Container maxWidth="300px" className="sharepage_component">
+                  <form className={className} onSubmit={(e) => this.submitProof(e, "totp", this.refs.$input.ref.value)} style={marginTop()}>
+                    <Input ref="$input" type="text" inputMode="numeric" autoComplete="one-time-code" placeholder={ t("Authenticator code") } />
+                    <Button theme="transparent">
+                      <Icon name={this.state.loading ? "loading" : "arrow_right"}/>
+                    </Button>
+                  </form>
+                </Container>
+            );
         } else if(this.state.key === "password"){
             return (
                 <Container maxWidth="300px" className="sharepage_component">
@@ -5,4 +5,5 @@ type App struct {
 	Body    map[string]interface{}
 	Session map[string]string
 	Share   Share
+	Token   ApiToken
 }
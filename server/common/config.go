@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"strings"
 )
@@ -49,6 +50,7 @@ type FormElement struct {
 	Datalist    []string    `json:"datalist,omitempty"`
 	Order       int         `json:"-"`
 	Required    bool        `json:"required"`
+	Env         string      `json:"env,omitempty"`
 }
 
 func init() {
@@ -71,7 +73,9 @@ func NewConfiguration() Configuration {
 					FormElement{Name: "port", Type: "number", Default: 8334, Description: "Port on which the application is available.", Placeholder: "Default: 8334"},
 					FormElement{Name: "host", Type: "text", Description: "The host people need to use to access this server", Placeholder: "Eg: \"demo.filestash.app\""},
 					FormElement{Name: "secret_key", Type: "password", Description: "The key that's used to encrypt and decrypt content. Update this settings will invalidate existing user sessions and shared links, use with caution!"},
+					FormElement{Name: "secret_key_previous", Type: "password", Description: "Comma separated list of the secret keys used before a key rotation. They are only used to decrypt existing content until it gets re-encrypted with the current key"},
 					FormElement{Name: "force_ssl", Type: "boolean", Description: "Enable the web security mechanism called 'Strict Transport Security'"},
+					FormElement{Name: "trusted_proxies", Type: "text", Description: "Comma separated list of IP or CIDR of the reverse proxies sitting in front of Filestash. The X-Forwarded-For header is only used to find the client address when the request is coming from one of those", Placeholder: "Eg: 127.0.0.1, 10.0.0.0/8"},
 					FormElement{Name: "editor", Type: "select", Default: "emacs", Opts: []string{"base", "emacs", "vim"}, Description: "Keybinding to be use in the editor. Default: \"emacs\""},
 					FormElement{Name: "fork_button", Type: "boolean", Default: true, Description: "Display the fork button in the login screen"},
 					FormElement{Name: "display_hidden", Type: "boolean", Default: false, Description: "Should files starting with a dot be visible by default?"},
@@ -96,6 +100,11 @@ func NewConfiguration() Configuration {
 				Elmnts: []FormElement{
 					FormElement{Name: "enable", Type: "enable", Target: []string{"log_level"}, Default: true},
 					FormElement{Name: "level", Type: "select", Default: "INFO", Opts: []string{"DEBUG", "INFO", "WARNING", "ERROR"}, Id: "log_level",  Description: "Default: \"INFO\". This setting determines the level of detail at which log events are written to the log file"},
+					FormElement{Name: "levels", Type: "text", Default: "", Description: "Level of some subsystems when it differs from the default one, eg: \"search=DEBUG,http=WARNING\"", Placeholder: "Eg: search=DEBUG,http=WARNING"},
+					FormElement{Name: "format", Type: "select", Default: "text", Opts: []string{"text", "json", "logfmt"}, Description: "Default: \"text\". Format in which log events are written"},
+					FormElement{Name: "rotate_size", Type: "number", Default: 100, Description: "Size in MB after which the log file gets rotated. 0 to disable", Placeholder: "Default: 100"},
+					FormElement{Name: "rotate_interval", Type: "select", Default: "daily", Opts: []string{"never", "hourly", "daily", "weekly"}, Description: "Default: \"daily\". How often the log file gets rotated"},
+					FormElement{Name: "retention", Type: "number", Default: 14, Description: "Number of rotated log files to keep around. 0 to keep everything", Placeholder: "Default: 14"},
 					FormElement{Name: "telemetry", Type: "boolean", Default: false, Description: "We won't share anything with any third party. This will only to be used to improve Filestash"},
 				},
 			},
@@ -122,6 +131,9 @@ func NewConfiguration() Configuration {
 
 func (this Form) MarshalJSON() ([]byte, error) {
 	return []byte(this.toJSON(func(el FormElement) string {
+		if el.Env != "" {
+			el.Value = el.envValue()
+		}
 		a, e := json.Marshal(el)
 		if e != nil {
 			return ""
@@ -230,6 +242,13 @@ func (this *Configuration) Load() {
 	this.cache.Clear()
 
 	Log.SetVisibility(this.Get("log.level").String())
+	Log.Configure(LogSettings{
+		Format:         this.Get("log.format").String(),
+		Levels:         this.Get("log.levels").String(),
+		RotateSize:     this.Get("log.rotate_size").Int(),
+		RotateInterval: this.Get("log.rotate_interval").String(),
+		Retention:      this.Get("log.retention").Int(),
+	})
 
 	go func() { // Trigger all the event listeners
 		for i:=0; i<len(this.onChange); i++ {
@@ -280,6 +299,10 @@ func (this *Configuration) Initialise() {
 	if env := os.Getenv("APPLICATION_URL"); env != "" {
 		this.Get("general.host").Set(env).String()
 	}
+	// any other key can be given from the environment, eg: FILESTASH_FEATURES_SEARCH_ENABLE
+	for _, el := range (&Form{Form: this.form}).Iterator() {
+		el.envOverride(el.Path + "." + el.Name)
+	}
 	if this.Get("general.secret_key").String() == "" {
 		key := RandomString(16)
 		this.Get("general.secret_key").Set(key)
@@ -318,7 +341,10 @@ func (this *Configuration) Initialise() {
 		}
 		this.Save()
 	}
-	InitSecretDerivate(this.Get("general.secret_key").String())
+	InitSecretDerivate(
+		this.Get("general.secret_key").String(),
+		strings.Split(this.Get("general.secret_key_previous").String(), ",")...,
+	)
 }
 
 func (this Configuration) Save() Configuration {
@@ -364,7 +390,20 @@ func (this Configuration) Export() interface{} {
 		Name:          this.Get("general.name").String(),
 		RememberMe:    this.Get("general.remember_me").Bool(),
 		UploadButton:  this.Get("general.upload_button").Bool(),
-		Connections:   this.Conn,
+		Connections:   func() []map[string]interface{} {
+			// access control policies stay on the server
+			conns := make([]map[string]interface{}, len(this.Conn))
+			for i := range this.Conn {
+				conns[i] = make(map[string]interface{}, len(this.Conn[i]))
+				for key, value := range this.Conn[i] {
+					if key == "acl" {
+						continue
+					}
+					conns[i][key] = value
+				}
+			}
+			return conns
+		}(),
 		EnableShare:   this.Get("features.share.enable").Bool(),
 		MimeTypes:     AllMimeTypes(),
 	}
@@ -406,6 +445,7 @@ func (this *Configuration) Get(key string) *Configuration {
 	tmp := this.cache.Get(key)
 	if tmp == nil {
 		this.currentElement = traverse(&this.form, strings.Split(key, "."))
+		this.currentElement.envOverride(key)
 		this.cache.Set(key, this.currentElement)
 	} else {
 		this.currentElement = tmp.(*FormElement)
@@ -484,6 +524,9 @@ func (this Configuration) Interface() interface{} {
 	if this.currentElement == nil {
 		return nil
 	}
+	if this.currentElement.Env != "" {
+		return this.currentElement.envValue()
+	}
 	val := this.currentElement.Value
 	if val == nil {
 		val = this.currentElement.Default
@@ -491,6 +534,192 @@ func (this Configuration) Interface() interface{} {
 	return val
 }
 
+// WithoutEnv gives back a config where the values coming from the environment are replaced by the
+// ones from the config file, that's to avoid persisting them when the admin console send its data back
+func (this *Configuration) WithoutEnv(config []byte) []byte {
+	for _, el := range (&Form{Form: this.form}).Iterator() {
+		if el.Env == "" {
+			continue
+		}
+		key := strings.Replace(el.Path + "." + el.Name, " ", "_", -1)
+		if el.Value == nil {
+			config, _ = sjson.DeleteBytes(config, key)
+		} else {
+			config, _ = sjson.SetBytes(config, key, el.Value)
+		}
+	}
+	return config
+}
+
+// Validate checks a config against the schema of the form elements: unknown keys, types, options of
+// the select and required fields. Problems are given by key through a ValidationError
+func (this *Configuration) Validate(config []byte) error {
+	root := gjson.ParseBytes(config)
+	if gjson.ValidBytes(config) == false || root.IsObject() == false {
+		return NewError("Malformed JSON", 400)
+	}
+	errs := make(map[string]string)
+
+	var recur func(res gjson.Result, form *Form, pkey string)
+	recur = func(res gjson.Result, form *Form, pkey string) {
+		res.ForEach(func(key, value gjson.Result) bool {
+			k := pkey + key.String()
+			if pkey == "" && (k == "connections" || k == "constant") {
+				return true
+			}
+			sub, el := configLookup(form, key.String())
+			if sub != nil && value.IsObject() {
+				recur(value, sub, k + ".")
+				return true
+			} else if sub != nil {
+				errs[k] = "expected an object"
+				return true
+			} else if el == nil {
+				errs[k] = "unknown key"
+				return true
+			} else if value.IsObject() || value.IsArray() {
+				errs[k] = "expected a value"
+				return true
+			}
+			if msg := el.validate(value); msg != "" {
+				errs[k] = msg
+			}
+			return true
+		})
+	}
+	recur(root, &Form{Form: this.form}, "")
+
+	for _, el := range (&Form{Form: this.form}).Iterator() {
+		key := strings.Replace(el.Path + "." + el.Name, " ", "_", -1)
+		if el.Required == false || el.Default != nil || errs[key] != "" {
+			continue
+		}
+		if value := root.Get(key); value.Exists() == false || value.Type == gjson.Null || value.String() == "" {
+			errs[key] = "required"
+		}
+	}
+
+	conns := root.Get("connections")
+	if conns.Exists() && conns.IsArray() == false {
+		errs["connections"] = "expected a list"
+	}
+	for i, conn := range conns.Array() {
+		k := fmt.Sprintf("connections.%d", i)
+		if conn.IsObject() == false {
+			errs[k] = "expected an object"
+		} else if conn.Get("type").Type != gjson.String || conn.Get("type").String() == "" {
+			errs[k + ".type"] = "required"
+		} else if acl := conn.Get("acl"); acl.Exists() && acl.IsArray() == false {
+			errs[k + ".acl"] = "expected a list"
+		}
+	}
+
+	if len(errs) > 0 {
+		return ValidationError{errs}
+	}
+	return nil
+}
+
+// configLookup finds the form or the element a key of the config refers to, without creating anything
+func configLookup(form *Form, key string) (*Form, *FormElement) {
+	formatKey := func(str string) string {
+		return strings.Replace(str, " ", "_", -1)
+	}
+	for i := range form.Form {
+		if formatKey(form.Form[i].Title) == key {
+			return &form.Form[i], nil
+		}
+	}
+	for i := range form.Elmnts {
+		if formatKey(form.Elmnts[i].Name) == key {
+			return nil, &form.Elmnts[i]
+		}
+	}
+	return nil, nil
+}
+
+func (this FormElement) validate(value gjson.Result) string {
+	if value.Type == gjson.Null {
+		return ""
+	}
+	switch this.Type {
+	case "boolean", "enable":
+		if value.Type != gjson.True && value.Type != gjson.False {
+			return "expected a boolean"
+		}
+	case "number":
+		if value.Type != gjson.Number {
+			return "expected a number"
+		}
+	case "select":
+		if value.Type != gjson.String {
+			return "expected a string"
+		} else if len(this.Opts) == 0 {
+			return ""
+		}
+		for _, opt := range this.Opts {
+			if opt == value.String() {
+				return ""
+			}
+		}
+		return "expected one of: " + strings.Join(this.Opts, ", ")
+	default:
+		if value.Type == gjson.String {
+			return ""
+		}
+		// keys coming from the config file without a schema are created as text
+		if this.Value != nil && fmt.Sprintf("%T", this.Value) == fmt.Sprintf("%T", value.Value()) {
+			return ""
+		}
+		return "expected a string"
+	}
+	return ""
+}
+
+// Secrets gives the keys of the config holding a password or any other kind of secret
+func (this *Configuration) Secrets() []string {
+	keys := []string{}
+	for _, el := range (&Form{Form: this.form}).Iterator() {
+		if el.Type == "password" || el.Type == "long_password" {
+			keys = append(keys, strings.Replace(el.Path + "." + el.Name, " ", "_", -1))
+		}
+	}
+	return keys
+}
+
+// envOverride flags the elements which have their value given by an environment variable. The
+// environment takes precedence over the config file and can't be changed from the admin console
+func (this *FormElement) envOverride(key string) {
+	if this == nil {
+		return
+	}
+	env := "FILESTASH_" + strings.ToUpper(strings.NewReplacer(".", "_", " ", "_", "-", "_").Replace(key))
+	if _, ok := os.LookupEnv(env); ok == false {
+		return
+	}
+	this.Env = env
+	this.ReadOnly = true
+}
+
+func (this FormElement) envValue() interface{} {
+	env := os.Getenv(this.Env)
+	switch this.Type {
+	case "boolean", "enable":
+		if b, err := strconv.ParseBool(env); err == nil {
+			return b
+		}
+		Log.Warning("config::env %s isn't a valid boolean", this.Env)
+		return this.Default
+	case "number":
+		if n, err := strconv.ParseFloat(env, 64); err == nil {
+			return n
+		}
+		Log.Warning("config::env %s isn't a valid number", this.Env)
+		return this.Default
+	}
+	return env
+}
+
 func (this Configuration) MarshalJSON() ([]byte, error) {
 	form := this.form
 	form = append(form, Form{
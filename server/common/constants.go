@@ -3,6 +3,8 @@ package common
 import (
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 )
 
 const (
@@ -16,8 +18,13 @@ const (
 	COOKIE_NAME_AUTH = "auth"
 	COOKIE_NAME_PROOF = "proof"
 	COOKIE_NAME_ADMIN = "admin"
+	COOKIE_NAME_DROP = "drop"
+	COOKIE_NAME_OIDC = "oidc"
+	COOKIE_NAME_CSRF = "csrf"
+	COOKIE_NAME_CSRF_ADMIN = "csrf_admin"
 	COOKIE_PATH_ADMIN = "/admin/api/"
 	COOKIE_PATH = "/api/"
+	COOKIE_PATH_OIDC = "/api/session/oidc"
 	FILE_INDEX = "./data/public/index.html"
 	FILE_ASSETS = "./data/public/"
 	URL_SETUP = "/admin/setup"
@@ -40,16 +47,52 @@ var (
 	SECRET_KEY_DERIVATE_FOR_ADMIN string
 	SECRET_KEY_DERIVATE_FOR_USER  string
 	SECRET_KEY_DERIVATE_FOR_HASH  string
+	SECRET_KEY_DERIVATE_FOR_SIGNATURE string
+	SECRET_KEY_DERIVATE_FOR_VAULT string
 )
 
 /*
  * Improve security by calculating derivative of the secret key to restrict the attack surface
  * in the worst case scenario with one compromise secret key
+ *
+ * Previous secret keys are kept in a keyring so that what was encrypted before a key rotation
+ * can still be decrypted, new content is always encrypted with the current key
  */
-func InitSecretDerivate(secret string) {
+func InitSecretDerivate(secret string, previous ...string) {
 	SECRET_KEY = secret
 	SECRET_KEY_DERIVATE_FOR_PROOF = Hash("PROOF_" + SECRET_KEY, len(SECRET_KEY))
 	SECRET_KEY_DERIVATE_FOR_ADMIN = Hash("ADMIN_" + SECRET_KEY, len(SECRET_KEY))
 	SECRET_KEY_DERIVATE_FOR_USER = Hash("USER_" + SECRET_KEY, len(SECRET_KEY))
 	SECRET_KEY_DERIVATE_FOR_HASH = Hash("HASH_" + SECRET_KEY, len(SECRET_KEY))
+	SECRET_KEY_DERIVATE_FOR_SIGNATURE = Hash("SIGNATURE_" + SECRET_KEY, len(SECRET_KEY))
+	SECRET_KEY_DERIVATE_FOR_VAULT = Hash("VAULT_" + SECRET_KEY, len(SECRET_KEY))
+
+	keyring := make(map[string][]string)
+	for _, key := range previous {
+		if key = strings.TrimSpace(key); key == "" || key == secret {
+			continue
+		}
+		keyring[SECRET_KEY_DERIVATE_FOR_PROOF] = append(keyring[SECRET_KEY_DERIVATE_FOR_PROOF], Hash("PROOF_" + key, len(key)))
+		keyring[SECRET_KEY_DERIVATE_FOR_ADMIN] = append(keyring[SECRET_KEY_DERIVATE_FOR_ADMIN], Hash("ADMIN_" + key, len(key)))
+		keyring[SECRET_KEY_DERIVATE_FOR_USER] = append(keyring[SECRET_KEY_DERIVATE_FOR_USER], Hash("USER_" + key, len(key)))
+		keyring[SECRET_KEY_DERIVATE_FOR_HASH] = append(keyring[SECRET_KEY_DERIVATE_FOR_HASH], Hash("HASH_" + key, len(key)))
+		keyring[SECRET_KEY_DERIVATE_FOR_SIGNATURE] = append(keyring[SECRET_KEY_DERIVATE_FOR_SIGNATURE], Hash("SIGNATURE_" + key, len(key)))
+		keyring[SECRET_KEY_DERIVATE_FOR_VAULT] = append(keyring[SECRET_KEY_DERIVATE_FOR_VAULT], Hash("VAULT_" + key, len(key)))
+	}
+	secretKeyringMu.Lock()
+	secretKeyring = keyring
+	secretKeyringMu.Unlock()
+}
+
+var (
+	secretKeyring   map[string][]string = make(map[string][]string)
+	secretKeyringMu sync.RWMutex
+)
+
+// SecretKeyring gives the derivate of the current secret key followed by its previous versions
+func SecretKeyring(derivate string) []string {
+	secretKeyringMu.RLock()
+	keys := append([]string{derivate}, secretKeyring[derivate]...)
+	secretKeyringMu.RUnlock()
+	return keys
 }
@@ -5,10 +5,15 @@ import (
 	"compress/zlib"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"encoding/base32"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"hash/fnv"
 	"io"
 	"io/ioutil"
@@ -16,6 +21,8 @@ import (
 	"math/big"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 )
 
 var Letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -37,10 +44,16 @@ func DecryptString(secret string, data string) (string, error){
 	if err != nil {
 		return "", err
 	}
-	d, err = decrypt([]byte(secret), d)
+	var plaintext []byte
+	for _, key := range SecretKeyring(secret) {
+		if plaintext, err = decrypt([]byte(key), d); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return "", err
 	}
+	d = plaintext
 	d, err = decompress(d)
 	if err != nil {
 		return "", err
@@ -48,6 +61,21 @@ func DecryptString(secret string, data string) (string, error){
 	return string(d), nil
 }
 
+func Sign(secret string, data string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func VerifySignature(secret string, data string, signature string) bool {
+	for _, key := range SecretKeyring(secret) {
+		if hmac.Equal([]byte(Sign(key, data)), []byte(signature)) {
+			return true
+		}
+	}
+	return false
+}
+
 func Hash(str string, n int) string {
 	hasher := sha256.New()
 	hasher.Write([]byte(str))
@@ -121,6 +149,57 @@ func QuickString(n int) string {
 	return string(b)
 }
 
+/*
+ * Time based one time password as described in RFC 6238 which is what authenticator apps
+ * like Google Authenticator, FreeOTP, ... are using. The secret is base32 encoded
+ */
+func NewTotpSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+func TotpCode(secret string, t time.Time) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(
+		strings.ToUpper(strings.TrimRight(strings.Replace(secret, " ", "", -1), "=")),
+	)
+	if err != nil {
+		return "", NewError("Invalid TOTP secret", 400)
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix() / 30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum) - 1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code % 1000000), nil
+}
+
+func TotpVerify(secret string, code string) bool {
+	return TotpCounter(secret, code) != -1
+}
+
+// TotpCounter gives the time step a valid code was generated for, -1 when the code isn't valid.
+// Remembering the last step used is what prevents a code from being replayed
+func TotpCounter(secret string, code string) int64 {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != 6 {
+		return -1
+	}
+	now := time.Now()
+	for _, skew := range []time.Duration{0, -30 * time.Second, 30 * time.Second} {
+		c, err := TotpCode(secret, now.Add(skew))
+		if err != nil {
+			return -1
+		}
+		if hmac.Equal([]byte(c), []byte(code)) {
+			return now.Add(skew).Unix() / 30
+		}
+	}
+	return -1
+}
+
 func encrypt(key []byte, plaintext []byte) ([]byte, error) {
     c, err := aes.NewCipher(key)
     if err != nil {
@@ -188,8 +267,26 @@ func verify(something []byte) ([]byte, error) {
 
 // Create a unique ID that can be use to identify different session
 func GenerateID(ctx *App) string {
+	p := generateIDSource(ctx.Session)
+	if p == "" {
+		return Hash("N/A", 20)
+	}
+	p += "salt => " + SECRET_KEY
+	return Hash(p, 20)
+}
+
+// GenerateStableID identifies a session like GenerateID does but without the secret key, for what
+// needs to be recognised after a rotation of the key
+func GenerateStableID(ctx *App) string {
+	p := generateIDSource(ctx.Session)
+	if p == "" {
+		return Hash("N/A", 20)
+	}
+	return Hash("STABLE_" + p, 20)
+}
+
+func generateIDSource(params map[string]string) string {
 	p := ""
-	params := ctx.Session
 	if params["type"] != "" {
 		p += "type =>" + params["type"]
 	}
@@ -220,12 +317,7 @@ func GenerateID(ctx *App) string {
 	if params["token"] != "" {
 		p += "token =>" + params["token"]
 	}
-
-	if p == "" {
-		return Hash("N/A", 20)
-	}
-	p += "salt => " + SECRET_KEY
-	return Hash(p, 20)
+	return p
 }
 
 // Create an ID that identify a machine
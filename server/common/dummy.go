@@ -3,6 +3,7 @@ package common
 import (
 	"io"
 	slog "log"
+	"os"
 )
 
 func NewNilLogger() *slog.Logger {
@@ -14,3 +15,24 @@ type dummyWriter struct {
 func(this dummyWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
+
+// DummyBackend is a backend for tests, what it does is up to the functions it's given
+type DummyBackend struct {
+	Nothing
+	OnInit func(params map[string]string) error
+	OnLs   func(path string) ([]os.FileInfo, error)
+}
+func (this DummyBackend) Init(params map[string]string, app *App) (IBackend, error) {
+	if this.OnInit != nil {
+		if err := this.OnInit(params); err != nil {
+			return nil, err
+		}
+	}
+	return this, nil
+}
+func (this DummyBackend) Ls(path string) ([]os.FileInfo, error) {
+	if this.OnLs != nil {
+		return this.OnLs(path)
+	}
+	return []os.FileInfo{}, nil
+}
@@ -41,6 +41,21 @@ func (e AppError) Status() int {
 	return e.status
 }
 
+// ValidationError gives the problem found on each of the fields of a form, by key
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e ValidationError) Error() string {
+	return "Invalid data"
+}
+func (e ValidationError) Status() int {
+	return 400
+}
+func (e ValidationError) FieldErrors() map[string]string {
+	return e.Fields
+}
+
 func HTTPFriendlyStatus(n int) string {
 	if n < 400 && n > 600 {
 		return "Humm"
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+ * Find the address of the client that originated the request. When Filestash is running behind
+ * a reverse proxy (nginx, traefik, ...), the address we see is the one of the proxy, the real client
+ * being sent through the X-Forwarded-For header. As this header can be forged by anyone, we only trust
+ * it when the request is coming from a proxy that's been declared in the config
+ */
+func GetClientIp(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	trusted := Config.Get("general.trusted_proxies").String()
+	if trusted == "" || IsIpInRanges(ip, trusted) == false {
+		return ip
+	}
+	hops := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if IsIpInRanges(hop, trusted) == false {
+			break
+		}
+	}
+	return ip
+}
+
+func ParseIpRanges(ranges string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, r := range strings.Split(ranges, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		cidr := r
+		if strings.Contains(r, "/") == false {
+			if ip := net.ParseIP(r); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nets, NewError("Invalid IP range: '" + r + "'", 400)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func IsIpInRanges(ip string, ranges string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	nets, _ := ParseIpRanges(ranges)
+	for i := range nets {
+		if nets[i].Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
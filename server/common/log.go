@@ -1,79 +1,102 @@
 package common
 
 import (
-	slog "log"
+	"encoding/json"
 	"fmt"
-	"time"
+	slog "log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-var logfile *os.File
+/*
+ * Every log line is made of a level, a subsystem and a message with optional fields attached to it
+ * (request id, backend type, share id, duration, ...). Lines are written as plain text, json or
+ * logfmt in data/state/log/access.log which gets rotated once it's either too big or too old, the
+ * rotated files are named access.log.<date> and only the most recent ones are kept around
+ */
+const (
+	LOG_DEBUG = iota
+	LOG_INFO
+	LOG_WARNING
+	LOG_ERROR
+)
 
-func init(){
-	var err error
-	logPath := filepath.Join(GetCurrentDir(), LOG_PATH)
-	logfile, err = os.OpenFile(filepath.Join(logPath, "access.log"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, os.ModePerm)
-	if err != nil {
-		slog.Printf("ERROR log file: %+v", err)
-		return
-	}
-	logfile.WriteString("")
-}
+const (
+	LOG_FORMAT_TEXT   = "text"
+	LOG_FORMAT_JSON   = "json"
+	LOG_FORMAT_LOGFMT = "logfmt"
+
+	logFilename       = "access.log"
+	logRotationFormat = "20060102-150405"
+)
+
+var (
+	logSubsystemRe = regexp.MustCompile(`^([A-Za-z_]+)::`)
+	logTextRe      = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}) (DEBUG|INFO|WARN|ERROR) (.*)$`)
+	logHttpRe      = regexp.MustCompile(`^HTTP\s+(\d+)\s+(\S+)\s+([0-9.]+)ms (.*)$`)
+)
+
+type LogFields map[string]interface{}
 
-type log struct{
-	enable bool
-	debug  bool
-	info   bool
-	warn   bool
-	error  bool
+type LogSettings struct {
+	Format         string
+	Levels         string
+	RotateSize     int
+	RotateInterval string
+	Retention      int
 }
 
-func (l *log) Info(format string, v ...interface{}) {
-	if l.info && l.enable {
-		message := fmt.Sprintf("%s INFO ", l.now())
-		message = fmt.Sprintf(message + format + "\n", v...)
+type log struct {
+	enable   bool
+	level    int
+	levels   map[string]int
+	format   string
+	maxSize  int64
+	interval string
+	keep     int
+
+	file   *os.File
+	size   int64
+	period string
+	mu     sync.Mutex
+}
 
-		logfile.WriteString(message)
-		fmt.Printf(strings.Replace(message, "%", "%%", -1))
+func init() {
+	if err := Log.open(); err != nil {
+		slog.Printf("ERROR log file: %+v", err)
 	}
 }
 
-func (l *log) Warning(format string, v ...interface{}) {
-	if l.warn && l.enable {
-		message := fmt.Sprintf("%s WARN ", l.now())
-		message = fmt.Sprintf(message + format + "\n", v...)
+func (l *log) Info(format string, v ...interface{}) {
+	l.write(LOG_INFO, nil, format, v...)
+}
 
-		logfile.WriteString(message)
-		fmt.Printf(strings.Replace(message, "%", "%%", -1))
-	}
+func (l *log) Warning(format string, v ...interface{}) {
+	l.write(LOG_WARNING, nil, format, v...)
 }
 
 func (l *log) Error(format string, v ...interface{}) {
-	if l.error && l.enable {
-		message := fmt.Sprintf("%s ERROR ", l.now())
-		message = fmt.Sprintf(message + format + "\n", v...)
-
-		logfile.WriteString(message)
-		fmt.Printf(strings.Replace(message, "%", "%%", -1))
-	}
+	l.write(LOG_ERROR, nil, format, v...)
 }
 
 func (l *log) Debug(format string, v ...interface{}) {
-	if l.debug && l.enable {
-		message := fmt.Sprintf("%s DEBUG ", l.now())
-		message = fmt.Sprintf(message + format + "\n", v...)
+	l.write(LOG_DEBUG, nil, format, v...)
+}
 
-		logfile.WriteString(message)
-		fmt.Printf(strings.Replace(message, "%", "%%", -1))
-	}
+// WithFields gives a logger that attaches the fields to the line. A "subsystem" field takes
+// precedence over the one guessed from the message
+func (l *log) WithFields(fields LogFields) logEntry {
+	return logEntry{l, fields}
 }
 
 func (l *log) Stdout(format string, v ...interface{}) {
-	message := fmt.Sprintf("%s ", l.now())
-	message = fmt.Sprintf(message + format + "\n", v...)
-	fmt.Printf(strings.Replace(message, "%", "%%", -1))
+	os.Stdout.WriteString(l.now() + " " + fmt.Sprintf(format, v...) + "\n")
 }
 
 func (l *log) now() string {
@@ -81,45 +104,449 @@ func (l *log) now() string {
 }
 
 func (l *log) Close() {
-	logfile.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
 }
 
 func (l *log) SetVisibility(str string) {
-	switch str {
-	case "WARNING":
-		l.debug = false
-		l.info = false
-		l.warn = true
-		l.error = true
-	case "ERROR":
-		l.debug = false
-		l.info = false
-		l.warn = false
-		l.error = true
-	case "DEBUG":
-		l.debug = true
-		l.info = true
-		l.warn = true
-		l.error = true
-	case "INFO":
-		l.debug = false
-		l.info = true
-		l.warn = true
-		l.error = true
+	l.mu.Lock()
+	l.level = LogLevel(str)
+	l.mu.Unlock()
+}
+
+// Configure applies the settings coming from the config: format of the lines, level of each
+// subsystem given as "search=DEBUG,http=WARNING", rotation size in MB, rotation interval and number
+// of rotated files to keep
+func (l *log) Configure(s LogSettings) {
+	levels := make(map[string]int)
+	for _, chunk := range strings.Split(s.Levels, ",") {
+		kv := strings.SplitN(chunk, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			continue
+		}
+		levels[strings.ToLower(strings.TrimSpace(kv[0]))] = LogLevel(strings.TrimSpace(kv[1]))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch s.Format {
+	case LOG_FORMAT_JSON, LOG_FORMAT_LOGFMT:
+		l.format = s.Format
 	default:
-		l.debug = false
-		l.info = true
-		l.warn = true
-		l.error = true
+		l.format = LOG_FORMAT_TEXT
 	}
+	l.levels = levels
+	l.maxSize = int64(s.RotateSize) * 1024 * 1024
+	l.interval = s.RotateInterval
+	l.keep = s.Retention
+	if l.file != nil {
+		l.period = l.periodOf(time.Now())
+	}
+}
+
+func (l *log) Format() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.format
 }
 
-func(l *log) Enable(val bool) {
+func (l *log) Enable(val bool) {
+	l.mu.Lock()
 	l.enable = val
+	l.mu.Unlock()
+}
+
+func (l *log) write(level int, fields LogFields, format string, v ...interface{}) {
+	subsystem, _ := fields["subsystem"].(string)
+	if subsystem == "" {
+		subsystem = logSubsystem(format)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.enable == false {
+		return
+	}
+	threshold, ok := l.levels[subsystem]
+	if ok == false {
+		threshold = l.level
+	}
+	if level < threshold {
+		return
+	}
+
+	t := time.Now()
+	message := fmt.Sprintf(format, v...)
+	var line string
+	switch l.format {
+	case LOG_FORMAT_JSON:
+		line = logJSON(t, level, subsystem, message, fields)
+	case LOG_FORMAT_LOGFMT:
+		line = logLogfmt(t, level, subsystem, message, fields)
+	default:
+		line = fmt.Sprintf("%s %s %s\n", t.Format("2006/01/02 15:04:05"), logLevelName(level), message)
+	}
+
+	if l.file != nil {
+		if l.shouldRotate(t, int64(len(line))) {
+			if err := l.rotate(); err != nil {
+				slog.Printf("ERROR log rotation: %+v", err)
+			}
+		}
+		if l.file != nil {
+			n, _ := l.file.WriteString(line)
+			l.size += int64(n)
+		}
+	}
+	os.Stdout.WriteString(line)
+}
+
+func (l *log) open() error {
+	file, err := os.OpenFile(filepath.Join(GetCurrentDir(), LOG_PATH, logFilename), os.O_APPEND|os.O_WRONLY|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file = file
+	l.size = 0
+	l.period = l.periodOf(time.Now())
+	if s, err := file.Stat(); err == nil {
+		// a file left from a previous period gets rotated on the first write
+		l.size = s.Size()
+		if s.Size() > 0 {
+			l.period = l.periodOf(s.ModTime())
+		}
+	}
+	return nil
+}
+
+func (l *log) periodOf(t time.Time) string {
+	switch l.interval {
+	case "hourly":
+		return t.Format("2006010215")
+	case "daily":
+		return t.Format("20060102")
+	case "weekly":
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-%02d", y, w)
+	}
+	return ""
+}
+
+func (l *log) shouldRotate(t time.Time, n int64) bool {
+	if l.size == 0 {
+		return false
+	} else if l.maxSize > 0 && l.size+n > l.maxSize {
+		return true
+	}
+	return l.periodOf(t) != l.period
+}
+
+func (l *log) rotate() error {
+	current := l.file.Name()
+	l.file.Close()
+	l.file = nil
+
+	rotated := current + "." + time.Now().Format(logRotationFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s-%d", current, time.Now().Format(logRotationFormat), i)
+	}
+	renameErr := os.Rename(current, rotated)
+
+	file, err := os.OpenFile(current, os.O_APPEND|os.O_WRONLY|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.size = 0
+	l.period = l.periodOf(time.Now())
+	if renameErr != nil {
+		if s, err := file.Stat(); err == nil {
+			l.size = s.Size()
+		}
+		return renameErr
+	}
+
+	if l.keep > 0 {
+		files := LogFiles()
+		rotatedFiles := files[:len(files)-1]
+		for i := 0; i < len(rotatedFiles)-l.keep; i++ {
+			os.Remove(rotatedFiles[i])
+		}
+	}
+	return nil
+}
+
+// LogFiles gives the path of the log files from the oldest rotated one to the one currently
+// being written to
+func LogFiles() []string {
+	current := filepath.Join(GetCurrentDir(), LOG_PATH, logFilename)
+	rotated, _ := filepath.Glob(current + ".*")
+	suffix := func(path string) (string, int) {
+		// rotated files are suffixed with "20060102-150405" and "-n" when rotated within a second
+		s := strings.TrimPrefix(path, current+".")
+		if len(s) <= len(logRotationFormat) {
+			return s, 0
+		}
+		n, _ := strconv.Atoi(strings.TrimPrefix(s[len(logRotationFormat):], "-"))
+		return s[:len(logRotationFormat)], n
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		a, na := suffix(rotated[i])
+		b, nb := suffix(rotated[j])
+		if a != b {
+			return a < b
+		}
+		return na < nb
+	})
+	return append(rotated, current)
+}
+
+type logEntry struct {
+	l      *log
+	fields LogFields
+}
+
+func (e logEntry) Info(format string, v ...interface{}) {
+	e.l.write(LOG_INFO, e.fields, format, v...)
+}
+
+func (e logEntry) Warning(format string, v ...interface{}) {
+	e.l.write(LOG_WARNING, e.fields, format, v...)
+}
+
+func (e logEntry) Error(format string, v ...interface{}) {
+	e.l.write(LOG_ERROR, e.fields, format, v...)
+}
+
+func (e logEntry) Debug(format string, v ...interface{}) {
+	e.l.write(LOG_DEBUG, e.fields, format, v...)
+}
+
+func LogLevel(str string) int {
+	switch strings.ToUpper(str) {
+	case "DEBUG":
+		return LOG_DEBUG
+	case "WARNING", "WARN":
+		return LOG_WARNING
+	case "ERROR":
+		return LOG_ERROR
+	}
+	return LOG_INFO
+}
+
+func logLevelName(level int) string {
+	switch level {
+	case LOG_DEBUG:
+		return "DEBUG"
+	case LOG_WARNING:
+		return "WARN"
+	case LOG_ERROR:
+		return "ERROR"
+	}
+	return "INFO"
 }
 
-var Log = func () log {
-	l := log{}
-	l.Enable(true)
-	return l
-}()
+// logSubsystem guesses where a message comes from with the conventions used across the codebase:
+// "[admin] ...", "share::mv ..." or "HTTP 200 ..."
+func logSubsystem(format string) string {
+	if strings.HasPrefix(format, "[") {
+		if i := strings.Index(format, "]"); i > 1 {
+			return strings.ToLower(format[1:i])
+		}
+	} else if strings.HasPrefix(format, "HTTP ") {
+		return "http"
+	} else if m := logSubsystemRe.FindStringSubmatch(format); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return "app"
+}
+
+func logSortedKeys(fields LogFields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		if key == "subsystem" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func logJSON(t time.Time, level int, subsystem string, message string, fields LogFields) string {
+	line := make(map[string]interface{}, len(fields)+4)
+	for key, value := range fields {
+		line[key] = value
+	}
+	line["time"] = t.Format(time.RFC3339Nano)
+	line["level"] = strings.ToLower(logLevelName(level))
+	line["subsystem"] = subsystem
+	line["msg"] = message
+	b, err := json.Marshal(line)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"time": line["time"], "level": line["level"], "subsystem": subsystem, "msg": message,
+		})
+	}
+	return string(b) + "\n"
+}
+
+func logLogfmt(t time.Time, level int, subsystem string, message string, fields LogFields) string {
+	value := func(v interface{}) string {
+		s := fmt.Sprintf("%v", v)
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+			return strconv.Quote(s)
+		}
+		return s
+	}
+	var b strings.Builder
+	b.WriteString("time=" + t.Format(time.RFC3339Nano))
+	b.WriteString(" level=" + strings.ToLower(logLevelName(level)))
+	b.WriteString(" subsystem=" + value(subsystem))
+	b.WriteString(" msg=" + value(message))
+	for _, key := range logSortedKeys(fields) {
+		b.WriteString(" " + key + "=" + value(fields[key]))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+type LogLine struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Subsystem string    `json:"subsystem"`
+	Message   string    `json:"message"`
+	Fields    LogFields `json:"fields,omitempty"`
+}
+
+// LogParse reads back a line written in any of the log formats. Lines in the text format don't
+// carry fields except for the HTTP ones which are extracted from the message
+func LogParse(line string) (LogLine, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "{") {
+		return logParseJSON(line)
+	} else if strings.HasPrefix(line, "time=") {
+		return logParseLogfmt(line)
+	}
+	m := logTextRe.FindStringSubmatch(line)
+	if m == nil {
+		return LogLine{}, false
+	}
+	t, err := time.ParseInLocation("2006/01/02 15:04:05", m[1], time.Local)
+	if err != nil {
+		return LogLine{}, false
+	}
+	l := LogLine{
+		Time:      t,
+		Level:     strings.ToLower(m[2]),
+		Subsystem: logSubsystem(m[3]),
+		Message:   m[3],
+	}
+	if h := logHttpRe.FindStringSubmatch(m[3]); h != nil {
+		status, _ := strconv.Atoi(h[1])
+		duration, _ := strconv.ParseFloat(h[3], 64)
+		l.Fields = LogFields{"status": status, "method": h[2], "duration": duration, "path": h[4]}
+	}
+	return l, true
+}
+
+func logParseJSON(line string) (LogLine, bool) {
+	fields := make(LogFields)
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return LogLine{}, false
+	}
+	return logParseFields(fields)
+}
+
+func logParseLogfmt(line string) (LogLine, bool) {
+	fields := make(LogFields)
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			break
+		}
+		key := line[:i]
+		line = line[i+1:]
+		value := ""
+		if strings.HasPrefix(line, "\"") {
+			// look for the closing quote, skipping the escaped ones
+			end, escaped := 1, false
+			for ; end < len(line); end++ {
+				if escaped {
+					escaped = false
+				} else if line[end] == '\\' {
+					escaped = true
+				} else if line[end] == '"' {
+					break
+				}
+			}
+			if end >= len(line) {
+				return LogLine{}, false
+			}
+			v, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return LogLine{}, false
+			}
+			value = v
+			line = line[end+1:]
+		} else if j := strings.Index(line, " "); j >= 0 {
+			value = line[:j]
+			line = line[j:]
+		} else {
+			value = line
+			line = ""
+		}
+		fields[key] = value
+	}
+	if status, ok := fields["status"].(string); ok {
+		if n, err := strconv.Atoi(status); err == nil {
+			fields["status"] = n
+		}
+	}
+	if duration, ok := fields["duration"].(string); ok {
+		if n, err := strconv.ParseFloat(duration, 64); err == nil {
+			fields["duration"] = n
+		}
+	}
+	return logParseFields(fields)
+}
+
+func logParseFields(fields LogFields) (LogLine, bool) {
+	str := func(key string) string {
+		v, _ := fields[key].(string)
+		delete(fields, key)
+		return v
+	}
+	t, err := time.Parse(time.RFC3339Nano, str("time"))
+	if err != nil {
+		return LogLine{}, false
+	}
+	l := LogLine{
+		Time:      t,
+		Level:     str("level"),
+		Subsystem: str("subsystem"),
+		Message:   str("msg"),
+	}
+	if len(fields) > 0 {
+		l.Fields = fields
+	}
+	return l, true
+}
+
+var Log = &log{
+	enable:   true,
+	level:    LOG_INFO,
+	format:   LOG_FORMAT_TEXT,
+	maxSize:  100 * 1024 * 1024,
+	interval: "daily",
+	keep:     14,
+}
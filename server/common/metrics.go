@@ -0,0 +1,235 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Minimal implementation of the metrics types of Prometheus and of its text format, which is all
+ * we need to have the metrics scraped without pulling the whole client library
+ */
+var (
+	metrics   []metric
+	metricsMu sync.RWMutex
+
+	METRICS_DEFAULT_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+	mu     sync.Mutex
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	metricsRegister(c)
+	return c
+}
+
+func (this *CounterVec) Inc(labels ...string) {
+	this.Add(1, labels...)
+}
+
+func (this *CounterVec) Add(n float64, labels ...string) {
+	key := metricsLabels(this.labels, labels)
+	this.mu.Lock()
+	this.values[key] += n
+	this.mu.Unlock()
+}
+
+func (this *CounterVec) write(w io.Writer) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", this.name, this.help, this.name)
+	for _, key := range metricsSortedKeys(this.values) {
+		fmt.Fprintf(w, "%s%s %s\n", this.name, key, metricsFloat(this.values[key]))
+	}
+}
+
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+	mu      sync.Mutex
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	metricsRegister(h)
+	return h
+}
+
+func (this *HistogramVec) Observe(value float64, labels ...string) {
+	key := metricsLabels(this.labels, labels)
+	this.mu.Lock()
+	h, ok := this.values[key]
+	if ok == false {
+		h = &histogram{counts: make([]uint64, len(this.buckets))}
+		this.values[key] = h
+	}
+	for i := range this.buckets {
+		if value <= this.buckets[i] {
+			h.counts[i] += 1
+		}
+	}
+	h.count += 1
+	h.sum += value
+	this.mu.Unlock()
+}
+
+func (this *HistogramVec) ObserveSince(start time.Time, labels ...string) {
+	this.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (this *HistogramVec) write(w io.Writer) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", this.name, this.help, this.name)
+	keys := make([]string, 0, len(this.values))
+	for key := range this.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := this.values[key]
+		withLe := func(le string) string {
+			if key == "" {
+				return "{le=\"" + le + "\"}"
+			}
+			return strings.TrimSuffix(key, "}") + ",le=\"" + le + "\"}"
+		}
+		for i := range this.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", this.name, withLe(metricsFloat(this.buckets[i])), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", this.name, withLe("+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", this.name, key, metricsFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", this.name, key, h.count)
+	}
+}
+
+// GaugeFunc is a gauge computed when the metrics are collected, the function gives the value for
+// each value of the label
+type GaugeFunc struct {
+	name  string
+	help  string
+	label string
+	fn    func() map[string]float64
+}
+
+func NewGaugeFunc(name string, help string, label string, fn func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, label: label, fn: fn}
+	metricsRegister(g)
+	return g
+}
+
+func (this *GaugeFunc) write(w io.Writer) {
+	values := make(map[string]float64)
+	for value, n := range this.fn() {
+		if this.label == "" {
+			values[""] = n
+			continue
+		}
+		values[metricsLabels([]string{this.label}, []string{value})] = n
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", this.name, this.help, this.name)
+	for _, key := range metricsSortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", this.name, key, metricsFloat(values[key]))
+	}
+}
+
+func MetricsWrite(w io.Writer) {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	for i := range metrics {
+		metrics[i].write(w)
+	}
+}
+
+func metricsRegister(m metric) {
+	metricsMu.Lock()
+	metrics = append(metrics, m)
+	metricsMu.Unlock()
+}
+
+func metricsLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	pairs := make([]string, len(names))
+	for i := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = names[i] + "=\"" + escape.Replace(value) + "\""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func metricsSortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func metricsFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	} else if math.IsInf(f, -1) {
+		return "-Inf"
+	} else if math.IsNaN(f) {
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", f)
+}
+
+var (
+	metricsCaches    = make(map[string]*AppCache)
+	metricsCachesMu  sync.Mutex
+	metricsCacheOnce sync.Once
+)
+
+// MetricsCache adds the size of a cache to the metrics
+func MetricsCache(name string, c *AppCache) {
+	metricsCacheOnce.Do(func() {
+		NewGaugeFunc("filestash_cache_items", "Number of items in the caches", "cache", func() map[string]float64 {
+			values := make(map[string]float64)
+			metricsCachesMu.Lock()
+			for name, c := range metricsCaches {
+				if c.Cache != nil {
+					values[name] = float64(c.Cache.ItemCount())
+				}
+			}
+			metricsCachesMu.Unlock()
+			return values
+		})
+	})
+	metricsCachesMu.Lock()
+	metricsCaches[name] = c
+	metricsCachesMu.Unlock()
+}
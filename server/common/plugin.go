@@ -44,6 +44,24 @@ func (this Get) HttpEndpoint() []func(*mux.Router, *App) error {
 	return http_endpoint
 }
 
+/*
+ * Share proofs are what a visitor needs to provide before accessing a shared link: a password,
+ * an email, ... Required lists the proofs a shared link expects and Verify checks what's been
+ * submitted, the key being what identifies the kind of proof on both side
+ */
+type ShareProofHandler struct {
+	Key      string
+	Required func(Share) []Proof
+	Verify   func(Share, Proof) (Proof, error)
+}
+var share_proof []ShareProofHandler
+func (this Register) ShareProof(key string, required func(Share) []Proof, verify func(Share, Proof) (Proof, error)) {
+	share_proof = append(share_proof, ShareProofHandler{ key, required, verify })
+}
+func (this Get) ShareProof() []ShareProofHandler {
+	return share_proof
+}
+
 var starter_process []func(*mux.Router)
 func (this Register) Starter(fn func(*mux.Router)) {
 	starter_process = append(starter_process, fn)
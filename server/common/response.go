@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strings"
 )
@@ -25,13 +26,39 @@ type APISuccessResultsWithMetadata struct {
 }
 
 type APIErrorMessage struct {
-	Status  string `json:"status"`
-	Message string `json:"message,omitempty"`
+	Status  string            `json:"status"`
+	Message string            `json:"message,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+type APIError struct {
+	Error struct {
+		Status  int               `json:"status"`
+		Message string            `json:"message"`
+		Errors  map[string]string `json:"errors,omitempty"`
+	} `json:"error"`
+}
+
+// ApiVersion gives the version of the api the response is for. From the v2, the result is sent as is
+// without the {status, result} envelope and errors are objects carrying their status
+func ApiVersion(res http.ResponseWriter) int {
+	if obj, ok := res.(interface{ ApiVersion() int }); ok {
+		return obj.ApiVersion()
+	}
+	return 1
 }
 
 func SendSuccessResult(res http.ResponseWriter, data interface{}) {
 	encoder := json.NewEncoder(res)
 	encoder.SetEscapeHTML(false)
+	if ApiVersion(res) >= 2 {
+		if data == nil {
+			res.WriteHeader(http.StatusNoContent)
+			return
+		}
+		encoder.Encode(data)
+		return
+	}
 	encoder.Encode(APISuccessResult{"ok", data})
 }
 
@@ -64,31 +91,56 @@ func SendSuccessResultWithEtagAndGzip(res http.ResponseWriter, req *http.Request
 func SendSuccessResults(res http.ResponseWriter, data interface{}) {
 	encoder := json.NewEncoder(res)
 	encoder.SetEscapeHTML(false)
+	if ApiVersion(res) >= 2 {
+		encoder.Encode(data)
+		return
+	}
 	encoder.Encode(APISuccessResults{"ok", data})
 }
 
 func SendSuccessResultsWithMetadata(res http.ResponseWriter, data interface{}, p interface{}) {
 	encoder := json.NewEncoder(res)
 	encoder.SetEscapeHTML(false)
+	if ApiVersion(res) >= 2 {
+		encoder.Encode(struct {
+			Results  interface{} `json:"results"`
+			Metadata interface{} `json:"metadata,omitempty"`
+		}{data, p})
+		return
+	}
 	encoder.Encode(APISuccessResultsWithMetadata{"ok", data, p})
 }
 
 func SendErrorResult(res http.ResponseWriter, err error) {
 	encoder := json.NewEncoder(res)
 	encoder.SetEscapeHTML(false)
-	obj, ok := err.(interface{ Status() int })
-	if ok == true {
-		res.WriteHeader(obj.Status())
-	} else {
-		res.WriteHeader(http.StatusInternalServerError)
+	if r, ok := err.(interface{ RetryAfter() int }); ok == true {
+		res.Header().Set("Retry-After", fmt.Sprintf("%d", r.RetryAfter()))
 	}
+	status := http.StatusInternalServerError
+	if obj, ok := err.(interface{ Status() int }); ok == true {
+		status = obj.Status()
+	}
+	res.WriteHeader(status)
 	m := func(r string) string {
 		if r == "" {
 			return r
 		}
 		return strings.ToUpper(string(r[0])) + string(r[1:])
 	}(err.Error())
-	encoder.Encode(APIErrorMessage{"error", m})
+	var fields map[string]string
+	if obj, ok := err.(interface{ FieldErrors() map[string]string }); ok == true {
+		fields = obj.FieldErrors()
+	}
+	if ApiVersion(res) >= 2 {
+		var e APIError
+		e.Error.Status = status
+		e.Error.Message = m
+		e.Error.Errors = fields
+		encoder.Encode(e)
+		return
+	}
+	encoder.Encode(APIErrorMessage{"error", m, fields})
 }
 
 func Page(stuff string) string {
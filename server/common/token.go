@@ -1,6 +1,8 @@
 package common
 
 import (
+	"encoding/json"
+	"net/http"
 	"time"
 )
 
@@ -8,21 +10,53 @@ const (
 	ADMIN_CLAIM = "ADMIN"
 )
 
+// roles an admin account can be given, ADMIN_ROLE_ADMIN grants access to everything
+const (
+	ADMIN_ROLE_ADMIN  = "admin"
+	ADMIN_ROLE_CONFIG = "config"
+	ADMIN_ROLE_LOG    = "log"
+	ADMIN_ROLE_SHARE  = "share"
+)
+
+var ADMIN_ROLES = []string{ADMIN_ROLE_ADMIN, ADMIN_ROLE_CONFIG, ADMIN_ROLE_LOG, ADMIN_ROLE_SHARE}
+
 type AdminToken struct {
-	Claim  string     `json:"token"`
-	Expire time.Time  `json:"time"`
+	Claim    string     `json:"token"`
+	Expire   time.Time  `json:"time"`
+	Username string     `json:"username"`
+	Roles    []string   `json:"roles"`
 }
 
-func NewAdminToken() AdminToken {
+func NewAdminToken(username string, roles []string) AdminToken {
 	return AdminToken{
 		Claim: ADMIN_CLAIM,
 		Expire: time.Now().Add(time.Hour * 24),
+		Username: username,
+		Roles: roles,
 	}
 }
 
+func NewAdminTokenFromRequest(req *http.Request) (AdminToken, error) {
+	token := AdminToken{}
+	c, err := req.Cookie(COOKIE_NAME_ADMIN)
+	if err != nil {
+		return token, ErrPermissionDenied
+	}
+	str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_ADMIN, c.Value)
+	if err != nil {
+		return token, ErrPermissionDenied
+	}
+	if err = json.Unmarshal([]byte(str), &token); err != nil {
+		return token, ErrPermissionDenied
+	}
+	return token, nil
+}
+
 func (this AdminToken) IsAdmin() bool {
 	if this.Claim != ADMIN_CLAIM {
 		return false
+	} else if this.Username == "" {
+		return false
 	}
 	return true
 }
@@ -33,3 +67,12 @@ func (this AdminToken) IsValid() bool {
 	}
 	return true
 }
+
+func (this AdminToken) HasRole(role string) bool {
+	for _, r := range this.Roles {
+		if r == role || r == ADMIN_ROLE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
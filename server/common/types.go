@@ -74,6 +74,41 @@ type Metadata struct {
 
 const PASSWORD_DUMMY = "{{PASSWORD}}"
 
+type Proof struct {
+	Id      string  `json:"id"`
+	Key     string  `json:"key"`
+	Value   string  `json:"-"`
+	Email   string  `json:"email,omitempty"`
+	Expire  int64   `json:"expire,omitempty"`
+	Message *string `json:"message,omitempty"`
+	Error   *string `json:"error,omitempty"`
+}
+
+// Personal access token, what scripts use to call the API on behalf of a user
+type ApiToken struct {
+	Id        string     `json:"id"`
+	Name      string     `json:"name"`
+	Backend   string     `json:"-"`
+	Auth      string     `json:"-"`
+	Path      string     `json:"path"`
+	CanRead   bool       `json:"can_read"`
+	CanWrite  bool       `json:"can_write"`
+	CanUpload bool       `json:"can_upload"`
+	Expire    *int64     `json:"expire,omitempty"`
+	Created   time.Time  `json:"created"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+func (t ApiToken) IsValid() error {
+	if t.Expire != nil {
+		now := time.Now().UnixNano() / 1000000
+		if now > *t.Expire {
+			return NewError("Token has expired", 401)
+		}
+	}
+	return nil
+}
+
 type Share struct {
 	Id           string   `json:"id"`
 	Backend      string   `json:"-"`
@@ -81,6 +116,8 @@ type Share struct {
 	Path         string   `json:"path"`
 	Password     *string  `json:"password,omitempty"`
 	Users        *string  `json:"users,omitempty"`
+	Totp         *string  `json:"totp,omitempty"`
+	IpRanges     *string  `json:"ip_ranges,omitempty"`
 	Expire       *int64   `json:"expire,omitempty"`
 	Url          *string  `json:"url,omitempty"`
 	CanShare     bool     `json:"can_share"`
@@ -88,9 +125,23 @@ type Share struct {
 	CanRead      bool     `json:"can_read"`
 	CanWrite     bool     `json:"can_write"`
 	CanUpload    bool     `json:"can_upload"`
+	DropTypes    *string  `json:"drop_types,omitempty"`
+	DropMaxSize  *int64   `json:"drop_max_size,omitempty"`
+	DropMaxTotal *int64   `json:"drop_max_total,omitempty"`
+	DropFolder   bool     `json:"drop_folder"`
+	DropNotify   *string  `json:"drop_notify,omitempty"`
+	Orphan       bool     `json:"orphan,omitempty"`
+}
+
+// a drop box is a shared link people can upload files to without being able to see what's inside
+func (s Share) IsDropBox() bool {
+	return s.CanUpload == true && s.CanRead == false && s.CanWrite == false
 }
 
 func (s Share) IsValid() error {
+	if s.Orphan {
+		return NewError("Link is pointing to something that doesn't exist anymore", 410)
+	}
 	if s.Expire != nil {
 		now := time.Now().UnixNano() / 1000000
 		if now > *s.Expire {
@@ -113,6 +164,13 @@ func (s *Share) MarshalJSON() ([]byte, error) {
 			return nil
 		}(s.Password),
 		s.Users,
+		func(totp *string) *string{
+			if totp != nil {
+				return NewString(PASSWORD_DUMMY)
+			}
+			return nil
+		}(s.Totp),
+		s.IpRanges,
 		s.Expire,
 		s.Url,
 		s.CanShare,
@@ -120,6 +178,12 @@ func (s *Share) MarshalJSON() ([]byte, error) {
 		s.CanRead,
 		s.CanWrite,
 		s.CanUpload,
+		s.DropTypes,
+		s.DropMaxSize,
+		s.DropMaxTotal,
+		s.DropFolder,
+		s.DropNotify,
+		s.Orphan,
 	}
 	return json.Marshal(p)
 }
@@ -132,6 +196,8 @@ func(s *Share) UnmarshallJSON(b []byte) error {
 		switch key {
 		case "password": s.Password = NewStringpFromInterface(value)
 		case "users": s.Users = NewStringpFromInterface(value)
+		case "totp": s.Totp = NewStringpFromInterface(value)
+		case "ip_ranges": s.IpRanges = NewStringpFromInterface(value)
 		case "expire": s.Expire = NewInt64pFromInterface(value)
 		case "url": s.Url = NewStringpFromInterface(value)
 		case "can_share": s.CanShare = NewBoolFromInterface(value)
@@ -139,6 +205,12 @@ func(s *Share) UnmarshallJSON(b []byte) error {
 		case "can_read": s.CanRead = NewBoolFromInterface(value)
 		case "can_write": s.CanWrite = NewBoolFromInterface(value)
 		case "can_upload": s.CanUpload = NewBoolFromInterface(value)
+		case "drop_types": s.DropTypes = NewStringpFromInterface(value)
+		case "drop_max_size": s.DropMaxSize = NewInt64pFromInterface(value)
+		case "drop_max_total": s.DropMaxTotal = NewInt64pFromInterface(value)
+		case "drop_folder": s.DropFolder = NewBoolFromInterface(value)
+		case "drop_notify": s.DropNotify = NewStringpFromInterface(value)
+		case "orphan": s.Orphan = NewBoolFromInterface(value)
 		}
 	}
 	return nil
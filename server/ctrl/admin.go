@@ -2,38 +2,26 @@ package ctrl
 
 import (
 	"encoding/json"
+	"fmt"
 	. "github.com/mickael-kerjean/filestash/server/common"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/mickael-kerjean/filestash/server/model"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func AdminSessionGet(ctx App, res http.ResponseWriter, req *http.Request) {
-	if admin := Config.Get("auth.admin").String(); admin == "" {
+	if enabled, err := model.AdminEnabled(); err != nil {
+		SendErrorResult(res, err)
+		return
+	} else if enabled == false {
 		SendSuccessResult(res, true)
 		return
 	}
-	obfuscate := func() string{
-		c, err := req.Cookie(COOKIE_NAME_ADMIN)
-		if err != nil {
-			return ""
-		}
-		return c.Value
-	}()
-
-	str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_ADMIN, obfuscate);
-	if err != nil {
-		SendSuccessResult(res, false)
-		return
-	}
-	token := AdminToken{}
-	json.Unmarshal([]byte(str), &token)
-
-	if token.IsValid() == false {
-		SendSuccessResult(res, false)
-		return
-	} else if token.IsAdmin() == false {
+	if _, err := model.AdminTokenFromRequest(req); err != nil {
 		SendSuccessResult(res, false)
 		return
 	}
@@ -42,24 +30,40 @@ func AdminSessionGet(ctx App, res http.ResponseWriter, req *http.Request) {
 
 func AdminSessionAuthenticate(ctx App, res http.ResponseWriter, req *http.Request) {
 	// Step 1: Deliberatly make the request slower to make hacking attempt harder for the attacker
+	ip := GetClientIp(req)
+	if err := model.RateLimit.Check(ip, "admin"); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	defer model.RateLimit.Release(ip, "admin")
 	time.Sleep(1500*time.Millisecond)
 
 	// Step 2: Make sure current user has appropriate access
-	admin := Config.Get("auth.admin").String()
-	if admin == "" {
+	if enabled, err := model.AdminEnabled(); err != nil {
+		SendErrorResult(res, err)
+		return
+	} else if enabled == false {
 		SendErrorResult(res, NewError("Missing admin account, please contact your administrator", 500))
 		return
 	}
 	var params map[string]string
 	b, _ := ioutil.ReadAll(req.Body)
 	json.Unmarshal(b, &params)
-	if err := bcrypt.CompareHashAndPassword([]byte(admin), []byte(params["password"])); err != nil {
-		SendErrorResult(res, ErrInvalidPassword)
+	user, err := model.AdminUserAuthenticate(params["username"], params["password"], params["code"])
+	if err == model.ErrAdminTotpRequired {
+		// valid password, the client needs to ask for the second factor
+		SendErrorResult(res, err)
+		return
+	} else if err != nil {
+		model.RateLimit.Fail(ip, "admin")
+		SendErrorResult(res, err)
 		return
 	}
+	model.RateLimit.Success(ip, "admin")
+	Log.Info("[admin] '%s' logged in from %s", user.Username, ip)
 
 	// Step 3: Send response to the client
-	body, _ := json.Marshal(NewAdminToken())
+	body, _ := json.Marshal(NewAdminToken(user.Username, user.Roles))
 	obfuscate, err := EncryptString(SECRET_KEY_DERIVATE_FOR_ADMIN, string(body))
 	if err != nil {
 		SendErrorResult(res, err)
@@ -72,6 +76,7 @@ func AdminSessionAuthenticate(ctx App, res http.ResponseWriter, req *http.Reques
 		MaxAge: 60*60, // valid for 1 hour
 		SameSite: http.SameSiteStrictMode,
 	})
+	model.CsrfCookieSet(res, COOKIE_NAME_CSRF_ADMIN, obfuscate)
 	SendSuccessResult(res, true)
 }
 
@@ -84,3 +89,357 @@ func AdminBackend(ctx App, res http.ResponseWriter, req *http.Request) {
 	SendSuccessResultWithEtagAndGzip(res, req, backends)
 	return
 }
+
+func AdminShareList(ctx App, res http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	shares, err := model.ShareInventoryList(q.Get("backend"), q.Get("path"))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	now := time.Now().UnixNano() / 1000000
+	filtered := []model.ShareInventory{}
+	for _, s := range shares {
+		if expired := q.Get("expired"); expired != "" {
+			isExpired := s.Expire != nil && *s.Expire < now
+			if (expired == "true") != isExpired {
+				continue
+			}
+		}
+		if public := q.Get("public"); public != "" {
+			isPublic := len(s.Proofs) == 0 && s.IpRanges == nil
+			if (public == "true") != isPublic {
+				continue
+			}
+		}
+		if proof := q.Get("proof"); proof != "" {
+			found := false
+			for _, p := range s.Proofs {
+				if p == proof {
+					found = true
+					break
+				}
+			}
+			if found == false {
+				continue
+			}
+		}
+		if q.Get("can_write") == "true" && s.CanWrite == false {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+	SendSuccessResults(res, filtered)
+}
+
+func AdminShareUpdate(ctx App, res http.ResponseWriter, req *http.Request) {
+	action := NewStringFromInterface(ctx.Body["action"])
+	ids, ok := ctx.Body["ids"].([]interface{})
+	if ok == false {
+		SendErrorResult(res, NewError("Missing ids", 400))
+		return
+	}
+	var fn func(string) error
+	switch action {
+	case "revoke": fn = model.ShareDelete
+	case "expire": fn = model.ShareExpire
+	default:
+		SendErrorResult(res, NewError("Unknown action", 400))
+		return
+	}
+
+	errors := make(map[string]string)
+	for i := range ids {
+		id := NewStringFromInterface(ids[i])
+		if id == "" {
+			continue
+		}
+		if err := fn(id); err != nil {
+			errors[id] = err.Error()
+			continue
+		}
+		Log.Info("[admin] share '%s': %s", id, action)
+	}
+	if len(errors) > 0 {
+		SendSuccessResult(res, errors)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
+
+func AdminSecretRotate(ctx App, res http.ResponseWriter, req *http.Request) {
+	if env := Config.Get("general.secret_key").Debug().Env; env != "" {
+		// the environment would still win over the new key
+		SendErrorResult(res, NewError("The secret key is set from "+env+", change it there", 409))
+		return
+	}
+	Config.Get("general.secret_key").Set(RandomString(16))
+	secretKeyUpdate()
+	SendSuccessResult(res, nil)
+}
+
+func AdminSecretReencrypt(ctx App, res http.ResponseWriter, req *http.Request) {
+	updated, failed, err := model.ShareReencrypt()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	Log.Info("[admin] shared links re-encrypted: %d updated, %d failed", updated, failed)
+	if u, f, err := model.ApiTokenReencrypt(); err != nil {
+		Log.Warning("[admin] access tokens not re-encrypted: %s", err.Error())
+	} else {
+		Log.Info("[admin] access tokens re-encrypted: %d updated, %d failed", u, f)
+		updated, failed = updated + u, failed + f
+	}
+	if u, f, err := model.SessionReencrypt(); err != nil {
+		Log.Warning("[admin] sessions not re-encrypted: %s", err.Error())
+	} else {
+		Log.Info("[admin] sessions re-encrypted: %d updated, %d failed", u, f)
+		updated, failed = updated + u, failed + f
+	}
+	if u, f, err := model.VaultReencrypt(); err != nil {
+		Log.Warning("[admin] vault not re-encrypted: %s", err.Error())
+	} else {
+		Log.Info("[admin] vault re-encrypted: %d updated, %d failed", u, f)
+		updated, failed = updated + u, failed + f
+	}
+	if u, f, err := model.AdminUserTotpReencrypt(); err != nil {
+		Log.Warning("[admin] admin accounts not re-encrypted: %s", err.Error())
+	} else {
+		Log.Info("[admin] admin accounts re-encrypted: %d updated, %d failed", u, f)
+		updated, failed = updated + u, failed + f
+	}
+	SendSuccessResult(res, struct {
+		Updated int `json:"updated"`
+		Failed  int `json:"failed"`
+	}{ updated, failed })
+}
+
+func AdminRateLimitList(ctx App, res http.ResponseWriter, req *http.Request) {
+	SendSuccessResults(res, model.RateLimit.List())
+}
+
+func AdminRateLimitClear(ctx App, res http.ResponseWriter, req *http.Request) {
+	ip := req.URL.Query().Get("ip")
+	target := req.URL.Query().Get("target")
+	n := model.RateLimit.Clear(ip, target)
+	Log.Info("[admin] ratelimit cleared %d entries ip=%s target=%s", n, ip, target)
+	SendSuccessResult(res, n)
+}
+
+func AdminVaultList(ctx App, res http.ResponseWriter, req *http.Request) {
+	entries, err := model.VaultList()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, entries)
+}
+
+func AdminVaultProvision(ctx App, res http.ResponseWriter, req *http.Request) {
+	name := NewStringFromInterface(ctx.Body["name"])
+	ref, err := model.VaultProvision(name, NewStringFromInterface(ctx.Body["value"]))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	Log.Info("[admin] vault credential '%s' saved", name)
+	SendSuccessResult(res, ref)
+}
+
+func AdminVaultDelete(ctx App, res http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("name")
+	if err := model.VaultDelete(name); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	Log.Info("[admin] vault credential '%s' deleted", name)
+	SendSuccessResult(res, nil)
+}
+
+// AdminConnectionTest tries a connection definition with some credentials to log in with:
+// { "connection": { "type": "sftp", "hostname": "..." }, "credentials": { "username": "..." }, "timeout": 10 }
+func AdminConnectionTest(ctx App, res http.ResponseWriter, req *http.Request) {
+	conn, ok := ctx.Body["connection"].(map[string]interface{})
+	if ok == false {
+		SendErrorResult(res, NewError("Missing connection", 400))
+		return
+	}
+	params := model.MapStringInterfaceToMapStringString(conn)
+	if credentials, ok := ctx.Body["credentials"].(map[string]interface{}); ok {
+		for key, value := range model.MapStringInterfaceToMapStringString(credentials) {
+			params[key] = value
+		}
+	}
+	delete(params, "acl")
+	timeout := 10 * time.Second
+	if t, ok := ctx.Body["timeout"].(float64); ok && t > 0 && t <= 60 {
+		timeout = time.Duration(t * float64(time.Second))
+	}
+	result := model.ConnectionTest(params, timeout)
+	if result.Error != nil {
+		Log.Info("[admin] connection test to '%s' failed (%s): %s", params["type"], result.Error.Category, result.Error.Message)
+	}
+	SendSuccessResult(res, result)
+}
+
+func AdminUserSessionList(ctx App, res http.ResponseWriter, req *http.Request) {
+	sessions, err := model.SessionList(req.URL.Query().Get("backend"))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, sessions)
+}
+
+func AdminUserSessionRevoke(ctx App, res http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get("id")
+	backend := req.URL.Query().Get("backend")
+	n, err := model.SessionRevoke(id, backend)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	Log.Info("[admin] revoked %d sessions id=%s backend=%s", n, id, backend)
+	SendSuccessResult(res, n)
+}
+
+func AdminUserList(ctx App, res http.ResponseWriter, req *http.Request) {
+	users, err := model.AdminUserList()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, users)
+}
+
+func AdminUserUpsert(ctx App, res http.ResponseWriter, req *http.Request) {
+	username := NewStringFromInterface(ctx.Body["username"])
+	roles := []string{}
+	if r, ok := ctx.Body["roles"].([]interface{}); ok {
+		for i := range r {
+			roles = append(roles, NewStringFromInterface(r[i]))
+		}
+	}
+	if err := model.AdminUserUpsert(username, NewStringFromInterface(ctx.Body["password"]), roles); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	Log.Info("[admin] account '%s' saved with roles [%s]", username, strings.Join(roles, ","))
+	SendSuccessResult(res, nil)
+}
+
+func AdminUserDelete(ctx App, res http.ResponseWriter, req *http.Request) {
+	username := req.URL.Query().Get("username")
+	if token, err := NewAdminTokenFromRequest(req); err == nil && token.Username == username {
+		SendErrorResult(res, NewError("You can't delete your own account", 400))
+		return
+	}
+	if err := model.AdminUserDelete(username); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	Log.Info("[admin] account '%s' deleted", username)
+	SendSuccessResult(res, nil)
+}
+
+func AdminTotpGenerate(ctx App, res http.ResponseWriter, req *http.Request) {
+	token, err := NewAdminTokenFromRequest(req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	secret := NewTotpSecret()
+	SendSuccessResult(res, map[string]string{
+		"secret": secret,
+		"uri": fmt.Sprintf(
+			"otpauth://totp/%s?secret=%s&issuer=%s",
+			url.PathEscape("Filestash:" + token.Username), secret, url.QueryEscape("Filestash"),
+		),
+	})
+}
+
+func AdminTotpEnable(ctx App, res http.ResponseWriter, req *http.Request) {
+	token, err := NewAdminTokenFromRequest(req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	secret := NewStringFromInterface(ctx.Body["secret"])
+	if secret == "" || TotpVerify(secret, NewStringFromInterface(ctx.Body["code"])) == false {
+		SendErrorResult(res, NewError("Invalid code", 400))
+		return
+	}
+	if err = model.AdminUserTotpSet(token.Username, secret); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	Log.Info("[admin] '%s' enabled TOTP", token.Username)
+	SendSuccessResult(res, nil)
+}
+
+func AdminTotpDisable(ctx App, res http.ResponseWriter, req *http.Request) {
+	token, err := model.AdminTokenFromRequest(req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	username := req.URL.Query().Get("username")
+	if username == "" || username == token.Username {
+		// disabling your own second factor requires a valid code
+		username = token.Username
+		user, err := model.AdminUserGet(username)
+		if err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		secret, err := DecryptString(SECRET_KEY_DERIVATE_FOR_ADMIN, user.Totp)
+		if err != nil || TotpVerify(secret, req.URL.Query().Get("code")) == false {
+			SendErrorResult(res, NewError("Invalid code", 400))
+			return
+		}
+	} else if token.HasRole(ADMIN_ROLE_ADMIN) == false {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	if err = model.AdminUserTotpSet(username, ""); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	Log.Info("[admin] '%s' disabled TOTP of '%s'", token.Username, username)
+	SendSuccessResult(res, nil)
+}
+
+func AdminAuditList(ctx App, res http.ResponseWriter, req *http.Request) {
+	limit, offset := 100, 0
+	if l, err := strconv.Atoi(req.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	if o, err := strconv.Atoi(req.URL.Query().Get("offset")); err == nil && o > 0 {
+		offset = o
+	}
+	logs, err := model.AdminAuditList(req.URL.Query().Get("username"), limit, offset)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, logs)
+}
+
+// when the secret key has changed, the previous one goes to the keyring so that existing
+// sessions and shared links keep working until they get re-encrypted
+func secretKeyUpdate() {
+	key := Config.Get("general.secret_key").String()
+	if key == "" || key == SECRET_KEY {
+		return
+	}
+	previous := []string{ SECRET_KEY }
+	for _, k := range strings.Split(Config.Get("general.secret_key_previous").String(), ",") {
+		if k = strings.TrimSpace(k); k != "" && k != SECRET_KEY && k != key {
+			previous = append(previous, k)
+		}
+	}
+	Config.Get("general.secret_key_previous").Set(strings.Join(previous, ","))
+	InitSecretDerivate(key, previous...)
+	Log.Info("[admin] secret key has been rotated")
+}
@@ -0,0 +1,68 @@
+package ctrl
+
+import (
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+	"net/http"
+	"strings"
+)
+
+/*
+ * The v2 api is resource oriented: the path of the file is part of the url and the verb gives the
+ * operation. Handlers are the same as the v1, the path is given to them as they expect it
+ */
+func FileGetV2(ctx App, res http.ResponseWriter, req *http.Request) {
+	path := apiV2Path(req)
+	setQuery(req, "path", path)
+	if strings.HasSuffix(path, "/") {
+		FileLs(ctx, res, req)
+		return
+	}
+	FileCat(ctx, res, req)
+}
+
+func FilePutV2(ctx App, res http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(apiV2Path(req), "/") {
+		setQuery(req, "path", apiV2Path(req))
+		FileMkdir(ctx, res, req)
+		return
+	}
+	path, err := PathBuilder(ctx, apiV2Path(req))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	if model.CanEdit(&ctx, path) == false {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	fileSave(ctx, res, req, path, req.Body, req.ContentLength)
+}
+
+func FileDeleteV2(ctx App, res http.ResponseWriter, req *http.Request) {
+	setQuery(req, "path", apiV2Path(req))
+	FileRm(ctx, res, req)
+}
+
+// FilePatchV2 moves a file to the path given in the body: { "path": "/new/location" }
+func FilePatchV2(ctx App, res http.ResponseWriter, req *http.Request) {
+	to := NewStringFromInterface(ctx.Body["path"])
+	if to == "" {
+		SendErrorResult(res, NewError("Missing destination path", 400))
+		return
+	}
+	setQuery(req, "from", apiV2Path(req))
+	setQuery(req, "to", to)
+	FileMv(ctx, res, req)
+}
+
+func apiV2Path(req *http.Request) string {
+	return "/" + strings.TrimPrefix(mux.Vars(req)["path"], "/")
+}
+
+func setQuery(req *http.Request, key string, value string) {
+	q := req.URL.Query()
+	q.Set(key, value)
+	req.URL.RawQuery = q.Encode()
+}
@@ -1,50 +1,75 @@
 package ctrl
 
 import (
+	"bufio"
+	"github.com/gorilla/mux"
 	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 )
 
 var (
-	logpath = filepath.Join(GetCurrentDir(), LOG_PATH, "access.log")
 	configpath = filepath.Join(GetCurrentDir(), CONFIG_PATH, "config.json")
+	// one update at a time, otherwise the file, the loaded config and the history could disagree
+	configUpdateLock sync.Mutex
 )
 
 func FetchLogHandler(ctx App, res http.ResponseWriter, req *http.Request) {
-	file, err := os.OpenFile(logpath, os.O_RDONLY, os.ModePerm)
-	if err != nil {
-		SendErrorResult(res, err)
+	// the log is made of the rotated files followed by the current one
+	readers := make([]io.Reader, 0)
+	var total int64
+	var openErr error
+	for _, path := range LogFiles() {
+		file, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+		if err != nil {
+			openErr = err
+			continue
+		}
+		defer file.Close()
+		s, err := file.Stat()
+		if err != nil {
+			continue
+		}
+		readers = append(readers, io.NewSectionReader(file, 0, s.Size()))
+		total += s.Size()
+	}
+	if len(readers) == 0 && openErr != nil {
+		SendErrorResult(res, openErr)
 		return
 	}
-	defer file.Close()
-	maxSize := req.URL.Query().Get("maxSize")
-	if maxSize != "" {
-		cursor := func() int64 {
-			tmp, err := strconv.Atoi(maxSize)
-			if err != nil {
-				return 0
-			}
-			return int64(tmp)
-		}()
-		for cursor >= 0 {
-			if _, err := file.Seek(-cursor, io.SeekEnd); err != nil {
-				break
-			}
-			char := make([]byte, 1)
-			file.Read(char)
-			if char[0] == 10 || char[0] == 13 { // stop if we find a line
-				break
-			}
-			cursor += 1
+
+	var skip int64 = 0
+	if maxSize, err := strconv.ParseInt(req.URL.Query().Get("maxSize"), 10, 64); err == nil && maxSize >= 0 && maxSize < total {
+		skip = total - maxSize
+	}
+	partial := false
+	for len(readers) > 0 && skip > 0 {
+		r := readers[0].(*io.SectionReader)
+		if r.Size() > skip {
+			// start one byte early to know whether we've landed at the beginning of a line
+			readers[0] = io.NewSectionReader(r, skip-1, r.Size()-skip+1)
+			partial = true
+			break
 		}
+		skip -= r.Size()
+		readers = readers[1:]
 	}
 	res.Header().Set("Content-Type", "text/plain")
-	io.Copy(res, file)
+	reader := bufio.NewReader(io.MultiReader(readers...))
+	if partial {
+		if _, err := reader.ReadString('\n'); err != nil { // only keep complete lines
+			return
+		}
+	}
+	io.Copy(res, reader)
 }
 
 func PrivateConfigHandler(ctx App, res http.ResponseWriter, req *http.Request) {
@@ -53,20 +78,169 @@ func PrivateConfigHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 
 func PrivateConfigUpdateHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 	b, _ := ioutil.ReadAll(req.Body)
-	b = PrettyPrint(b)
-	file, err := os.Create(configpath)
+	if err := configUpdate(req, b); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
+
+func PrivateConfigRevisionList(ctx App, res http.ResponseWriter, req *http.Request) {
+	limit, offset := 50, 0
+	if l, err := strconv.Atoi(req.URL.Query().Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+	if o, err := strconv.Atoi(req.URL.Query().Get("offset")); err == nil && o > 0 {
+		offset = o
+	}
+	revisions, err := model.ConfigRevisionList(limit, offset)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, revisions)
+}
+
+func PrivateConfigRevisionGet(ctx App, res http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(req)["id"])
+	revision, err := model.ConfigRevisionGet(id)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, revision)
+}
+
+// PrivateConfigRevisionDiff compares 2 revisions, the current config is used when `to` isn't given
+func PrivateConfigRevisionDiff(ctx App, res http.ResponseWriter, req *http.Request) {
+	get := func(param string) ([]byte, error) {
+		if req.URL.Query().Get(param) == "" {
+			return ioutil.ReadFile(configpath)
+		}
+		id, err := strconv.Atoi(req.URL.Query().Get(param))
+		if err != nil {
+			return nil, ErrNotValid
+		}
+		revision, err := model.ConfigRevisionGet(id)
+		return []byte(revision.Config), err
+	}
+	from, err := get("from")
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	to, err := get("to")
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, model.ConfigDiff(from, to))
+}
+
+func PrivateConfigRevisionRollback(ctx App, res http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(req.URL.Query().Get("id"))
+	if err != nil {
+		SendErrorResult(res, ErrNotValid)
+		return
+	}
+	current, err := ioutil.ReadFile(configpath)
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
-	defer file.Close()
-	if _, err := file.Write(b); err != nil {
+	b, missing, err := model.ConfigRevisionRestore(id, current)
+	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
-	file.Close()
+	if err = configUpdate(req, b); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	Log.Info("[admin] config rolled back to revision %d", id)
+	SendSuccessResult(res, map[string]interface{}{
+		"missing_secrets": missing,
+	})
+}
+
+// keys that decide who gets into the admin console: whoever can change them gets every role
+var configAdminAuthKeys = []string{"auth.admin", "general.secret_key", "general.secret_key_previous"}
+
+func configAdminAuthCheck(req *http.Request, previous []byte, next []byte) error {
+	if enabled, err := model.AdminEnabled(); err != nil {
+		return err
+	} else if enabled == false {
+		return nil // initial setup
+	}
+	if token, err := model.AdminTokenFromRequest(req); err == nil && token.HasRole(ADMIN_ROLE_ADMIN) {
+		return nil
+	}
+	for _, key := range configAdminAuthKeys {
+		if gjson.GetBytes(previous, key).String() != gjson.GetBytes(next, key).String() {
+			Log.Warning("[admin] refused change of '%s' from an admin without the '%s' role", key, ADMIN_ROLE_ADMIN)
+			return NewError("Changing '"+key+"' requires the '"+ADMIN_ROLE_ADMIN+"' role", 403)
+		}
+	}
+	return nil
+}
+
+func configUpdate(req *http.Request, b []byte) error {
+	if err := Config.Validate(b); err != nil {
+		return err
+	}
+	b, _ = sjson.DeleteBytes(b, "constant")
+	b = PrettyPrint(Config.WithoutEnv(b))
+	configUpdateLock.Lock()
+	defer configUpdateLock.Unlock()
+	previous, _ := ioutil.ReadFile(configpath)
+	if err := configAdminAuthCheck(req, previous, b); err != nil {
+		return err
+	}
+
+	// the config is written next to the current one before taking its place, a failure along the way
+	// can't leave us with a truncated config
+	file, err := ioutil.TempFile(filepath.Dir(configpath), filepath.Base(configpath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := file.Name()
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(configpath); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err = file.Chmod(mode); err == nil {
+		if _, err = file.Write(b); err == nil {
+			err = file.Sync()
+		}
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, configpath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
 	Config.Load()
-	SendSuccessResult(res, nil)
+	secretKeyUpdate()
+
+	// the config we're replacing goes to the history as well in case it was edited by hand
+	username := ""
+	if token, err := NewAdminTokenFromRequest(req); err == nil {
+		username = token.Username
+	}
+	if len(previous) > 0 {
+		if err = model.ConfigRevisionInsert("", "", previous); err != nil {
+			Log.Warning("config::history %s", err.Error())
+		}
+	}
+	if err = model.ConfigRevisionInsert(username, GetClientIp(req), b); err != nil {
+		Log.Warning("config::history %s", err.Error())
+	}
+	return nil
 }
 
 func PublicConfigHandler(ctx App, res http.ResponseWriter, req *http.Request) {
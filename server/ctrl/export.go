@@ -33,7 +33,7 @@ func FileExport(ctx App, res http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		SendErrorResult(res, err)
 		return
-	} else if model.CanRead(&ctx) == false {
+	} else if model.CanRead(&ctx, path) == false {
 		SendErrorResult(res, ErrPermissionDenied)
 		return
 	}
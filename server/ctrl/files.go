@@ -26,6 +26,7 @@ var FileCache AppCache
 
 func init() {
 	FileCache = NewAppCache()
+	MetricsCache("file", &FileCache)
 	cachePath := filepath.Join(GetCurrentDir(), TMP_PATH)
 	FileCache.OnEvict(func(key string, value interface{}) {
 		os.RemoveAll(filepath.Join(cachePath, key))
@@ -33,28 +34,30 @@ func init() {
 }
 
 func FileLs(ctx App, res http.ResponseWriter, req *http.Request) {
-	if model.CanRead(&ctx) == false {
-		if model.CanUpload(&ctx) == false {
+	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	if model.CanRead(&ctx, path) == false {
+		if model.CanUpload(&ctx, path) == false {
 			SendErrorResult(res, ErrPermissionDenied)
 			return
 		}
 		SendSuccessResults(res, make([]FileInfo, 0))
 		return
 	}
-	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
-	if err != nil {
-		SendErrorResult(res, err)
-		return
-	}
 
+	start := time.Now()
 	entries, err := ctx.Backend.Ls(path)
+	model.BackendObserve(&ctx, "ls", start, err)
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
 	go model.SProc.HintLs(&ctx, path)
 
-	files := make([]FileInfo, len(entries))
+	files := make([]FileInfo, 0, len(entries))
 	etagger := fnv.New32()
 	etagger.Write([]byte(path + strconv.Itoa(len(entries))))
 	for i:=0; i<len(entries); i++ {
@@ -65,7 +68,7 @@ func FileLs(ctx App, res http.ResponseWriter, req *http.Request) {
 			etagger.Write([]byte(name + strconv.Itoa(int(modTime))))
 		}
 
-		files[i] = FileInfo{
+		f := FileInfo{
 			Name: name,
 			Size: entries[i].Size(),
 			Time: modTime,
@@ -76,6 +79,13 @@ func FileLs(ctx App, res http.ResponseWriter, req *http.Request) {
 				return "directory"
 			}(entries[i].Mode()),
 		}
+		if f.Type == "directory" {
+			name += "/"
+		}
+		if model.AclVisible(&ctx, path + name) == false {
+			continue
+		}
+		files = append(files, f)
 	}
 
 	var perms Metadata = Metadata{}
@@ -83,20 +93,20 @@ func FileLs(ctx App, res http.ResponseWriter, req *http.Request) {
 		perms = obj.Meta(path)
 	}
 
-	if model.CanEdit(&ctx) == false {
+	if model.CanEdit(&ctx, path) == false {
 		perms.CanCreateFile = NewBool(false)
 		perms.CanCreateDirectory = NewBool(false)
 		perms.CanRename = NewBool(false)
 		perms.CanMove = NewBool(false)
 		perms.CanDelete = NewBool(false)
 	}
-	if model.CanUpload(&ctx) == false {
+	if model.CanUpload(&ctx, path) == false {
 		perms.CanCreateDirectory = NewBool(false)
 		perms.CanRename = NewBool(false)
 		perms.CanMove = NewBool(false)
 		perms.CanDelete = NewBool(false)
 	}
-	if model.CanShare(&ctx) == false {
+	if model.CanShare(&ctx, path) == false {
 		perms.CanShare = NewBool(false)
 	}
 
@@ -117,15 +127,15 @@ func FileCat(ctx App, res http.ResponseWriter, req *http.Request) {
 		MaxAge: -1,
 		Path:   "/",
 	})
-	if model.CanRead(&ctx) == false {
-		SendErrorResult(res, ErrPermissionDenied)
-		return
-	}
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if model.CanRead(&ctx, path) == false {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
 
 	var file io.ReadCloser
 	var contentLength int64 = -1
@@ -147,7 +157,10 @@ func FileCat(ctx App, res http.ResponseWriter, req *http.Request) {
 
 	// perform the actual `cat` if needed
 	if file == nil {
-		if file, err = ctx.Backend.Cat(path); err != nil {
+		start := time.Now()
+		file, err = ctx.Backend.Cat(path)
+		model.BackendObserve(&ctx, "cat", start, err)
+		if err != nil {
 			SendErrorResult(res, err)
 			return
 		}
@@ -259,14 +272,19 @@ func FileCat(ctx App, res http.ResponseWriter, req *http.Request) {
 }
 
 func FileAccess(ctx App, res http.ResponseWriter, req *http.Request) {
+	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
 	allowed := []string{}
-	if model.CanRead(&ctx){
+	if model.CanRead(&ctx, path){
 		allowed = append(allowed, "GET")
 	}
-	if model.CanEdit(&ctx){
+	if model.CanEdit(&ctx, path){
 		allowed = append(allowed, "PUT")
 	}
-	if model.CanUpload(&ctx){
+	if model.CanUpload(&ctx, path){
 		allowed = append(allowed, "POST")
 	}
 	header := res.Header()
@@ -275,41 +293,59 @@ func FileAccess(ctx App, res http.ResponseWriter, req *http.Request) {
 }
 
 func FileSave(ctx App, res http.ResponseWriter, req *http.Request) {
-	if model.CanEdit(&ctx) == false {
-		SendErrorResult(res, NewError("Permission denied", 403))
-		return
-	}
-
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if model.CanEdit(&ctx, path) == false {
+		SendErrorResult(res, NewError("Permission denied", 403))
+		return
+	}
 
-	file, _, err := req.FormFile("file")
+	file, header, err := req.FormFile("file")
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
 	defer file.Close()
+	fileSave(ctx, res, req, path, file, header.Size)
+}
+
+func fileSave(ctx App, res http.ResponseWriter, req *http.Request, path string, file io.Reader, size int64) {
+	var err error
+	if ctx.Share.Id != "" {
+		if err = model.ShareDropVerifier(ctx.Share, filepath.Base(path), size); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		defer model.ShareDropRelease(ctx.Share, size)
+		if path, err = DropPathBuilder(ctx, res, req, path); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+	}
 
+	start := time.Now()
 	err = ctx.Backend.Save(path, file)
-	file.Close()
+	model.BackendObserve(&ctx, "save", start, err)
 	if err != nil {
 		SendErrorResult(res, NewError(err.Error(), 403))
 		return
 	}
+	if ctx.Share.Id != "" && ctx.Share.IsDropBox() {
+		// recorded before the reservation is released so the quota always sees the upload
+		email := model.ShareProofGetEmail(req, ctx.Share)
+		if err := model.ShareDropRecord(ctx.Share, "/" + strings.TrimPrefix(path, ctx.Share.Path), size, email); err != nil {
+			Log.Warning("share::drop %s", err.Error())
+		}
+	}
 	go model.SProc.HintLs(&ctx, filepath.Dir(path) + "/")
 	go model.SProc.HintFile(&ctx, path)
 	SendSuccessResult(res, nil)
 }
 
 func FileMv(ctx App, res http.ResponseWriter, req *http.Request) {
-	if model.CanEdit(&ctx) == false {
-		SendErrorResult(res, NewError("Permission denied", 403))
-		return
-	}
-
 	from, err := PathBuilder(ctx, req.URL.Query().Get("from"))
 	if err != nil {
 		SendErrorResult(res, err)
@@ -324,51 +360,72 @@ func FileMv(ctx App, res http.ResponseWriter, req *http.Request) {
 		SendErrorResult(res, NewError("missing path parameter", 400))
 		return
 	}
+	if model.CanEditRecursiveTo(&ctx, from, to) == false {
+		SendErrorResult(res, NewError("Permission denied", 403))
+		return
+	}
 
+	start := time.Now()
 	err = ctx.Backend.Mv(from, to)
+	model.BackendObserve(&ctx, "mv", start, err)
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
 
+	if err = model.ShareMove(shareBackendId(ctx), from, to); err != nil {
+		Log.Warning("share::mv %s", err.Error())
+	}
 	go model.SProc.HintRm(&ctx, filepath.Dir(from) + "/")
 	go model.SProc.HintLs(&ctx, filepath.Dir(to) + "/")
 	SendSuccessResult(res, nil)
 }
 
 func FileRm(ctx App, res http.ResponseWriter, req *http.Request) {
-	if model.CanEdit(&ctx) == false {
-		SendErrorResult(res, NewError("Permission denied", 403))
-		return
-	}
-
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if model.CanEditRecursive(&ctx, path) == false {
+		SendErrorResult(res, NewError("Permission denied", 403))
+		return
+	}
+	start := time.Now()
 	err = ctx.Backend.Rm(path)
+	model.BackendObserve(&ctx, "rm", start, err)
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if err = model.ShareRemoved(shareBackendId(ctx), path); err != nil {
+		Log.Warning("share::rm %s", err.Error())
+	}
 	model.SProc.HintRm(&ctx, path)
 	SendSuccessResult(res, nil)
 }
 
 func FileMkdir(ctx App, res http.ResponseWriter, req *http.Request) {
-	if model.CanUpload(&ctx) == false {
-		SendErrorResult(res, NewError("Permission denied", 403))
-		return
-	}
-
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if model.CanUpload(&ctx, path) == false {
+		SendErrorResult(res, NewError("Permission denied", 403))
+		return
+	}
+
+	if ctx.Share.Id != "" {
+		if path, err = DropPathBuilder(ctx, res, req, path); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+	}
 
+	start := time.Now()
 	err = ctx.Backend.Mkdir(path)
+	model.BackendObserve(&ctx, "mkdir", start, err)
 	if err != nil {
 		SendErrorResult(res, err)
 		return
@@ -378,18 +435,30 @@ func FileMkdir(ctx App, res http.ResponseWriter, req *http.Request) {
 }
 
 func FileTouch(ctx App, res http.ResponseWriter, req *http.Request) {
-	if model.CanUpload(&ctx) == false {
-		SendErrorResult(res, NewError("Permission denied", 403))
-		return
-	}
-
 	path, err := PathBuilder(ctx, req.URL.Query().Get("path"))
 	if err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if model.CanUpload(&ctx, path) == false {
+		SendErrorResult(res, NewError("Permission denied", 403))
+		return
+	}
 
+	if ctx.Share.Id != "" {
+		if err = model.ShareDropVerifier(ctx.Share, filepath.Base(path), 0); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		if path, err = DropPathBuilder(ctx, res, req, path); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+	}
+
+	start := time.Now()
 	err = ctx.Backend.Touch(path)
+	model.BackendObserve(&ctx, "touch", start, err)
 	if err != nil {
 		SendErrorResult(res, err)
 		return
@@ -398,6 +467,97 @@ func FileTouch(ctx App, res http.ResponseWriter, req *http.Request) {
 	SendSuccessResult(res, nil)
 }
 
+/*
+ * In a drop box, each uploader gets its own folder so that people don't override each other files
+ * without knowing about it. The folder is named after the verified email or the time of the first
+ * upload when the shared link doesn't require an email
+ */
+func DropPathBuilder(ctx App, res http.ResponseWriter, req *http.Request, path string) (string, error) {
+	if ctx.Share.IsDropBox() == false || ctx.Share.DropFolder == false {
+		return path, nil
+	}
+	folder := model.ShareProofGetEmail(req, ctx.Share)
+	if folder == "" {
+		if c, err := req.Cookie(COOKIE_NAME_DROP); err == nil {
+			folder = dropCookieVerify(ctx.Share, c.Value)
+		}
+		if folder == "" {
+			folder = time.Now().Format("2006-01-02_150405") + "_" + RandomString(4)
+		}
+		http.SetCookie(res, &http.Cookie{
+			Name:     COOKIE_NAME_DROP,
+			Value:    folder + "." + dropCookieSign(ctx.Share, folder),
+			MaxAge:   60 * 60 * 24,
+			Path:     COOKIE_PATH,
+			HttpOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	folder = strings.NewReplacer("/", "_", "\\", "_").Replace(folder)
+	if folder == "." || folder == ".." {
+		return "", ErrNotValid
+	}
+
+	root := ctx.Session["path"]
+	dropRoot := root + folder + "/"
+	if strings.HasPrefix(path, dropRoot) {
+		return path, nil
+	}
+	ctx.Backend.Mkdir(dropRoot)
+	return dropRoot + strings.TrimPrefix(path, root), nil
+}
+
+// the drop cookie is signed so that an uploader can't pick the folder of somebody else
+func dropCookieSign(s Share, folder string) string {
+	return Sign(SECRET_KEY_DERIVATE_FOR_SIGNATURE, "drop\n" + s.Id + "\n" + folder)
+}
+
+func dropCookieVerify(s Share, value string) string {
+	i := strings.LastIndex(value, ".")
+	if i == -1 {
+		return ""
+	}
+	folder := value[:i]
+	if VerifySignature(SECRET_KEY_DERIVATE_FOR_SIGNATURE, "drop\n" + s.Id + "\n" + folder, value[i+1:]) == false {
+		return ""
+	}
+	return folder
+}
+
+func FileSign(ctx App, res http.ResponseWriter, req *http.Request) {
+	if ctx.Share.Id != "" || ctx.Token.Id != "" {
+		SendErrorResult(res, ErrNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	if _, err := PathBuilder(ctx, query.Get("path")); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	ttl := 3600
+	if t, err := strconv.Atoi(query.Get("expire")); err == nil {
+		ttl = t
+	}
+	sessionId := ""
+	if cookie, err := req.Cookie(COOKIE_NAME_AUTH); err == nil && model.IsSessionId(cookie.Value) {
+		sessionId = cookie.Value
+	}
+	u, err := model.SignedUrlCreate(ctx.Session, sessionId, query.Get("op"), query.Get("path"), ttl)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, u)
+}
+
+// the backend id shared links are attached to, as computed when the link was created
+func shareBackendId(ctx App) string {
+	if ctx.Share.Id != "" {
+		return ctx.Share.Backend
+	}
+	return GenerateID(&ctx)
+}
+
 func PathBuilder(ctx App, path string) (string, error) {
 	if path == "" {
 		return "", NewError("No path available", 400)
@@ -0,0 +1,152 @@
+package ctrl
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminLogQuery searches the logs, most recent first. The backend filter only works with lines
+// carrying fields which is the case of the json and logfmt formats, it's refused with the text one
+func AdminLogQuery(ctx App, res http.ResponseWriter, req *http.Request) {
+	q, err := logQuery(req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	limit, offset := 100, 0
+	if l, err := strconv.Atoi(req.URL.Query().Get("limit")); err == nil && l > 0 && l <= model.LOG_QUERY_MAX_LIMIT {
+		limit = l
+	}
+	if o, err := strconv.Atoi(req.URL.Query().Get("offset")); err == nil && o > 0 && o <= model.LOG_QUERY_MAX_OFFSET {
+		offset = o
+	}
+	lines, total, err := model.LogSearch(q, limit, offset)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResultsWithMetadata(res, lines, map[string]int{
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+// AdminLogTail streams the new lines matching the filters as server sent events
+func AdminLogTail(ctx App, res http.ResponseWriter, req *http.Request) {
+	q, err := logQuery(req)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	flusher, ok := res.(http.Flusher)
+	if ok == false {
+		SendErrorResult(res, NewError("Streaming isn't supported", 500))
+		return
+	}
+	header := res.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprintf(res, "retry: 3000\n\n")
+	flusher.Flush()
+
+	lines := make(chan LogLine, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- model.LogTail(req.Context(), q, func(l LogLine) error {
+			select {
+			case lines <- l:
+			case <-req.Context().Done():
+			}
+			return nil
+		})
+	}()
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case l := <-lines:
+			b, err := json.Marshal(l)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(res, "event: log\ndata: %s\n\n", b)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprintf(res, ": ping\n\n")
+			flusher.Flush()
+		case err := <-done:
+			if err != nil {
+				Log.Warning("[admin] log tail %s", err.Error())
+				fmt.Fprintf(res, "event: error\ndata: %q\n\n", err.Error())
+				flusher.Flush()
+			}
+			return
+		}
+	}
+}
+
+func logQuery(req *http.Request) (model.LogQuery, error) {
+	query := req.URL.Query()
+	errs := make(map[string]string)
+	q := model.LogQuery{
+		Path:    query.Get("path"),
+		Backend: query.Get("backend"),
+		Text:    query.Get("q"),
+	}
+	if q.Backend != "" && Log.Format() == LOG_FORMAT_TEXT {
+		errs["backend"] = "lines written with the text format don't carry the backend, use the json or logfmt format"
+	}
+	if level := strings.ToUpper(query.Get("level")); level != "" {
+		switch level {
+		case "DEBUG", "INFO", "WARN", "WARNING", "ERROR":
+			q.Level = level
+		default:
+			errs["level"] = "expected one of DEBUG, INFO, WARNING, ERROR"
+		}
+	}
+	for _, key := range []string{"from", "to"} {
+		value := query.Get(key)
+		if value == "" {
+			continue
+		}
+		var t time.Time
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			t = time.Unix(n, 0)
+		} else if t, err = time.Parse(time.RFC3339, value); err != nil {
+			errs[key] = "expected a RFC3339 date or a unix timestamp"
+			continue
+		}
+		if key == "from" {
+			q.From = t
+		} else {
+			q.To = t
+		}
+	}
+	if status := query.Get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			s = strings.ToLower(strings.TrimSpace(s))
+			if len(s) != 3 || s[0] < '1' || s[0] > '5' {
+				errs["status"] = "expected a list of status like 404 or 5xx"
+				break
+			} else if _, err := strconv.Atoi(s); err != nil && s[1:] != "xx" {
+				errs["status"] = "expected a list of status like 404 or 5xx"
+				break
+			}
+			q.Status = append(q.Status, s)
+		}
+	}
+	if len(errs) > 0 {
+		return q, ValidationError{Fields: errs}
+	}
+	return q, nil
+}
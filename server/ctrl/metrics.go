@@ -0,0 +1,42 @@
+package ctrl
+
+import (
+	"crypto/subtle"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+	"net/http"
+	"strings"
+)
+
+// MetricsHandler exposes the metrics in the Prometheus text format to the scraper holding the token
+// from the config. Admins can read the same thing from /admin/api/metrics as the admin cookie isn't
+// sent outside of the admin api
+func MetricsHandler(ctx App, res http.ResponseWriter, req *http.Request) {
+	if model.METRICS_ENABLE() == false {
+		SendErrorResult(res, ErrNotFound)
+		return
+	}
+	token := model.METRICS_TOKEN()
+	auth := req.Header.Get("Authorization")
+	if token == "" || strings.HasPrefix(auth, "Bearer ") == false ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		SendErrorResult(res, ErrNotAuthorized)
+		return
+	}
+	metricsWrite(res)
+}
+
+func AdminMetricsHandler(ctx App, res http.ResponseWriter, req *http.Request) {
+	if model.METRICS_ENABLE() == false {
+		SendErrorResult(res, ErrNotFound)
+		return
+	}
+	metricsWrite(res)
+}
+
+func metricsWrite(res http.ResponseWriter) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	MetricsWrite(res)
+}
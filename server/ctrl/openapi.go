@@ -0,0 +1,273 @@
+package ctrl
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+ * The OpenAPI document is generated from the routes registered on the router so that it can't drift
+ * away from what the server actually does. Only the api is documented, not the pages of the app
+ */
+var openAPIParamRegexp = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+func OpenAPIHandler(r *mux.Router) func(App, http.ResponseWriter, *http.Request) {
+	var (
+		doc  []byte
+		once sync.Once
+	)
+	return func(ctx App, res http.ResponseWriter, req *http.Request) {
+		once.Do(func() {
+			doc, _ = json.Marshal(openAPIGenerate(r))
+		})
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(doc)
+	}
+}
+
+func openAPIGenerate(r *mux.Router) map[string]interface{} {
+	paths := make(map[string]map[string]interface{})
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// the routes without methods are the handlers of everything under a prefix, eg: the
+			// export and webdav. Subrouters don't have a handler of their own
+			if route.GetHandler() == nil {
+				return nil
+			}
+			if strings.HasPrefix(tmpl, "/s/") {
+				methods = []string{"GET", "HEAD", "PUT", "DELETE", "OPTIONS"}
+			} else {
+				methods = []string{"GET"}
+			}
+			tmpl += "/{path:.*}"
+		} else if strings.HasPrefix(tmpl, "/api/") == false && strings.HasPrefix(tmpl, "/admin/api/") == false {
+			return nil
+		}
+		path := openAPIParamRegexp.ReplaceAllString(tmpl, "{$1}")
+		if _, ok := paths[path]; ok == false {
+			paths[path] = make(map[string]interface{})
+		}
+		for _, method := range methods {
+			paths[path][strings.ToLower(method)] = openAPIOperation(tmpl, path, method)
+		}
+		return nil
+	})
+
+	errorSchema := func(v2 bool) map[string]interface{} {
+		if v2 {
+			return map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"error": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"status":  map[string]string{"type": "integer"},
+							"message": map[string]string{"type": "string"},
+						},
+					},
+				},
+			}
+		}
+		return map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"status":  map[string]interface{}{"type": "string", "enum": []string{"error"}},
+				"message": map[string]string{"type": "string"},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "Filestash",
+			"version": APP_VERSION,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Error":   errorSchema(true),
+				"ErrorV1": errorSchema(false),
+			},
+			"securitySchemes": map[string]interface{}{
+				"cookieAuth": map[string]string{"type": "apiKey", "in": "cookie", "name": COOKIE_NAME_AUTH},
+				"adminAuth":  map[string]string{"type": "apiKey", "in": "cookie", "name": COOKIE_NAME_ADMIN},
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func openAPIOperation(tmpl string, path string, method string) map[string]interface{} {
+	v2 := strings.HasPrefix(path, "/api/v2/")
+	op := map[string]interface{}{
+		"operationId": strings.ToLower(method) + strings.NewReplacer("/", "_", "{", "", "}", "", ".", "_").Replace(path),
+		"tags":        []string{openAPITag(path)},
+	}
+
+	params := []map[string]interface{}{}
+	for _, m := range openAPIParamRegexp.FindAllStringSubmatch(tmpl, -1) {
+		params = append(params, map[string]interface{}{
+			"name":     m[1],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]string{"type": "string"},
+		})
+	}
+	sort.Slice(params, func(i, j int) bool {
+		return params[i]["name"].(string) < params[j]["name"].(string)
+	})
+	r, ok := openAPIRoutes[method+" "+path]
+	if ok == false {
+		r = openAPIRoutes["* "+path]
+	}
+	for _, name := range r.Query {
+		params = append(params, map[string]interface{}{
+			"name":     name,
+			"in":       "query",
+			"required": name == "path" || name == "from" || name == "to",
+			"schema":   map[string]string{"type": "string"},
+		})
+	}
+	if strings.HasPrefix(path, "/api/files/") {
+		params = append(params, map[string]interface{}{
+			"name":        "share",
+			"in":          "query",
+			"required":    false,
+			"description": "Id of the shared link the request is made through",
+			"schema":      map[string]string{"type": "string"},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if r.Upload != "" {
+		var schema interface{} = map[string]string{"type": "string", "format": "binary"}
+		if r.Upload == "multipart/form-data" {
+			schema = map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"file": schema},
+			}
+		}
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				r.Upload: map[string]interface{}{"schema": schema},
+			},
+		}
+	} else if len(r.Body) > 0 {
+		properties := make(map[string]interface{}, len(r.Body))
+		for name, t := range r.Body {
+			if t == "array" {
+				properties[name] = map[string]interface{}{"type": t, "items": map[string]string{"type": "string"}}
+				continue
+			}
+			properties[name] = map[string]string{"type": t}
+		}
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{"type": "object", "properties": properties},
+				},
+			},
+		}
+	}
+
+	if strings.HasPrefix(path, "/admin/api/") && path != "/admin/api/session" {
+		op["security"] = []map[string][]string{{"adminAuth": {}}}
+	} else if strings.HasPrefix(path, "/api/files") || strings.HasPrefix(path, "/api/v2/files") ||
+		strings.HasPrefix(path, "/api/tokens") || strings.HasPrefix(path, "/api/share") {
+		op["security"] = []map[string][]string{{"cookieAuth": {}}, {"bearerAuth": {}}}
+	}
+
+	errorRef := "#/components/schemas/ErrorV1"
+	if v2 {
+		errorRef = "#/components/schemas/Error"
+	}
+	op["responses"] = map[string]interface{}{
+		"200": map[string]string{"description": "Success"},
+		"default": map[string]interface{}{
+			"description": "Error, the http status code is the one of the error",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]string{"$ref": errorRef},
+				},
+			},
+		},
+	}
+	return op
+}
+
+// what the handlers read from the query string and the body, per method and path. A method of
+// "*" applies to all the methods of the path
+type openAPIRoute struct {
+	Query  []string
+	Body   map[string]string
+	Upload string
+}
+
+var openAPIRoutes = map[string]openAPIRoute{
+	"* /api/files/ls":            {Query: []string{"path"}},
+	"GET /api/files/cat":         {Query: []string{"path"}},
+	"HEAD /api/files/cat":        {Query: []string{"path"}},
+	"OPTIONS /api/files/cat":     {Query: []string{"path"}},
+	"POST /api/files/cat":        {Query: []string{"path"}, Upload: "multipart/form-data"},
+	"* /api/files/mv":            {Query: []string{"from", "to"}},
+	"* /api/files/rm":            {Query: []string{"path"}},
+	"* /api/files/mkdir":         {Query: []string{"path"}},
+	"* /api/files/touch":         {Query: []string{"path"}},
+	"* /api/files/sign":          {Query: []string{"path", "op", "expire"}},
+	"* /api/files/search":        {Query: []string{"path", "q"}},
+	"PUT /api/v2/files/{path}":   {Upload: "application/octet-stream"},
+	"PATCH /api/v2/files/{path}": {Body: map[string]string{"path": "string"}},
+	"GET /api/share":             {Query: []string{"path"}},
+	"POST /api/share/{share}": {Body: map[string]string{
+		"path": "string", "password": "string", "users": "string", "totp": "boolean", "totp_rotate": "boolean",
+		"ip_ranges": "string", "expire": "integer", "url": "string", "can_manage_own": "boolean",
+		"can_share": "boolean", "can_read": "boolean", "can_write": "boolean", "can_upload": "boolean",
+		"drop_types": "string", "drop_max_size": "integer", "drop_max_total": "integer",
+		"drop_folder": "boolean", "drop_notify": "string",
+	}},
+	"POST /api/share/{share}/proof": {Body: map[string]string{"type": "string", "value": "string"}},
+	"POST /api/tokens": {Body: map[string]string{
+		"path": "string", "name": "string", "can_read": "boolean", "can_write": "boolean",
+		"can_upload": "boolean", "expire": "integer",
+	}},
+	"GET /admin/api/config/diff":       {Query: []string{"from", "to"}},
+	"POST /admin/api/config/rollback":  {Query: []string{"id"}},
+	"POST /admin/api/shares":           {Body: map[string]string{"action": "string", "ids": "array"}},
+	"DELETE /admin/api/ratelimit":      {Query: []string{"ip", "target"}},
+	"POST /admin/api/vault":            {Body: map[string]string{"name": "string", "value": "string"}},
+	"DELETE /admin/api/vault":          {Query: []string{"name"}},
+	"POST /admin/api/connections/test": {Body: map[string]string{"connection": "object", "credentials": "object", "timeout": "number"}},
+	"DELETE /admin/api/sessions":       {Query: []string{"id", "backend"}},
+	"POST /admin/api/users":            {Body: map[string]string{"username": "string", "roles": "array", "password": "string"}},
+	"DELETE /admin/api/users":          {Query: []string{"username"}},
+	"POST /admin/api/totp":             {Body: map[string]string{"secret": "string", "code": "string"}},
+	"DELETE /admin/api/totp":           {Query: []string{"username", "code"}},
+}
+
+func openAPITag(path string) string {
+	p := strings.Split(strings.Trim(path, "/"), "/")
+	if p[0] == "admin" {
+		return "admin"
+	} else if p[0] == "s" {
+		return "webdav"
+	} else if len(p) > 2 && p[1] == "v2" {
+		return p[2]
+	} else if len(p) > 1 {
+		return p[1]
+	}
+	return p[0]
+}
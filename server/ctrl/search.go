@@ -13,7 +13,7 @@ func FileSearch(ctx App, res http.ResponseWriter, req *http.Request) {
 		path = "/"
 	}
 	q := req.URL.Query().Get("q")
-	if model.CanRead(&ctx) == false {
+	if model.CanRead(&ctx, path) == false {
 		SendErrorResult(res, ErrPermissionDenied)
 		return
 	}
@@ -24,6 +24,13 @@ func FileSearch(ctx App, res http.ResponseWriter, req *http.Request) {
 	} else {
 		searchResults = model.SearchStateLess(&ctx, path, q)
 	}
+	visibleResults := make([]File, 0, len(searchResults))
+	for i := range searchResults {
+		if model.AclVisible(&ctx, searchResults[i].FPath) {
+			visibleResults = append(visibleResults, searchResults[i])
+		}
+	}
+	searchResults = visibleResults
 
 	if ctx.Session["path"] != "" {
 		for i:=0; i<len(searchResults); i++ {
@@ -7,6 +7,7 @@ import (
 	. "github.com/mickael-kerjean/filestash/server/common"
 	"github.com/mickael-kerjean/filestash/server/model"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -36,11 +37,19 @@ func SessionGet(ctx App, res http.ResponseWriter, req *http.Request) {
 
 func SessionAuthenticate(ctx App, res http.ResponseWriter, req *http.Request) {
 	ctx.Body["timestamp"] = time.Now().String()
-	session := model.MapStringInterfaceToMapStringString(ctx.Body)
-	session["path"] = EnforceDirectory(session["path"])
+	session := sessionFromBody(ctx.Body)
+
+	ip := GetClientIp(req)
+	target := model.RateLimitBackendTarget(session)
+	if err := model.RateLimit.Check(ip, target); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	defer model.RateLimit.Release(ip, target)
 
 	backend, err := model.NewBackend(&ctx, session)
 	if err != nil {
+		model.RateLimit.Fail(ip, target)
 		SendErrorResult(res, err)
 		return
 	}
@@ -50,12 +59,14 @@ func SessionAuthenticate(ctx App, res http.ResponseWriter, req *http.Request) {
 	}); ok {
 		err := obj.OAuthToken(&ctx.Body)
 		if err != nil {
+			model.RateLimit.Fail(ip, target)
 			SendErrorResult(res, NewError("Can't authenticate (OAuth error)", 401))
 			return
 		}
-		session = model.MapStringInterfaceToMapStringString(ctx.Body)
+		session = sessionFromBody(ctx.Body)
 		backend, err = model.NewBackend(&ctx, session)
 		if err != nil {
+			model.RateLimit.Fail(ip, target)
 			SendErrorResult(res, NewError("Can't authenticate", 401))
 			return
 		}
@@ -63,34 +74,187 @@ func SessionAuthenticate(ctx App, res http.ResponseWriter, req *http.Request) {
 
 	home, err := model.GetHome(backend, session["path"])
 	if err != nil {
+		model.RateLimit.Fail(ip, target)
 		SendErrorResult(res, ErrAuthenticationFailed)
 		return
 	}
+	model.RateLimit.Success(ip, target)
+
+	if err = sessionCookieCreate(res, req, session); err != nil {
+		SendErrorResult(res, NewError(err.Error(), 500))
+		return
+	}
+
+	if home != "" {
+		SendSuccessResult(res, home)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
 
-	s, err := json.Marshal(session);
+// sessionFromBody builds a session out of what the user has sent, leaving out the keys only the
+// single sign on flow can set as the access control rules rely on them
+func sessionFromBody(body map[string]interface{}) map[string]string {
+	session := model.MapStringInterfaceToMapStringString(body)
+	session["path"] = EnforceDirectory(session["path"])
+	delete(session, "sso")
+	delete(session, "groups")
+	delete(session, "acl")
+	return session
+}
+
+func SessionOIDC(ctx App, res http.ResponseWriter, req *http.Request) {
+	provider, err := model.OIDCGetProvider()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	next := req.URL.Query().Get("next")
+	if strings.HasPrefix(next, "/") == false || strings.HasPrefix(next, "//") {
+		next = ""
+	}
+	state := model.NewOIDCState(next)
+	b, _ := json.Marshal(state)
+	obfuscate, err := EncryptString(SECRET_KEY_DERIVATE_FOR_USER, string(b))
 	if err != nil {
 		SendErrorResult(res, NewError(err.Error(), 500))
 		return
 	}
-	obfuscate, err := EncryptString(SECRET_KEY_DERIVATE_FOR_USER, string(s))
+	http.SetCookie(res, &http.Cookie{
+		Name:     COOKIE_NAME_OIDC,
+		Value:    obfuscate,
+		MaxAge:   60 * 10,
+		Path:     COOKIE_PATH_OIDC,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // the provider sends the user back with a top level navigation
+	})
+	http.Redirect(res, req, provider.AuthURL(state, oidcRedirectUri(req)), http.StatusTemporaryRedirect)
+}
+
+func SessionOIDCCallback(ctx App, res http.ResponseWriter, req *http.Request) {
+	ip := GetClientIp(req)
+	if err := model.RateLimit.Check(ip, "oidc"); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	defer model.RateLimit.Release(ip, "oidc")
+	var state model.OIDCState
+	c, err := req.Cookie(COOKIE_NAME_OIDC)
+	if err != nil {
+		SendErrorResult(res, NewError("Missing login state, please try again", 400))
+		return
+	}
+	http.SetCookie(res, &http.Cookie{
+		Name:   COOKIE_NAME_OIDC,
+		Value:  "",
+		MaxAge: -1,
+		Path:   COOKIE_PATH_OIDC,
+	})
+	if str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_USER, c.Value); err != nil {
+		SendErrorResult(res, ErrNotValid)
+		return
+	} else if err = json.Unmarshal([]byte(str), &state); err != nil {
+		SendErrorResult(res, ErrNotValid)
+		return
+	}
+	query := req.URL.Query()
+	if e := query.Get("error"); e != "" {
+		Log.Debug("oidc::callback error=%s description=%s", e, query.Get("error_description"))
+		SendErrorResult(res, ErrAuthenticationFailed)
+		return
+	}
+	if state.State == "" || query.Get("state") != state.State {
+		model.RateLimit.Fail(ip, "oidc")
+		SendErrorResult(res, NewError("Invalid login state", 400))
+		return
+	}
+
+	provider, err := model.OIDCGetProvider()
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	claims, err := provider.Exchange(state, query.Get("code"), oidcRedirectUri(req))
+	if err != nil {
+		model.RateLimit.Fail(ip, "oidc")
+		SendErrorResult(res, err)
+		return
+	}
+	session, err := model.OIDCSession(claims)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	session["path"] = EnforceDirectory(session["path"])
+	session["timestamp"] = time.Now().String()
+	backend, err := model.NewBackend(&ctx, session)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	home, err := model.GetHome(backend, session["path"])
 	if err != nil {
+		SendErrorResult(res, ErrAuthenticationFailed)
+		return
+	}
+	if err = sessionCookieCreate(res, req, session); err != nil {
 		SendErrorResult(res, NewError(err.Error(), 500))
 		return
 	}
+	Log.Info("[oidc] login sub=%v connection=%s", claims["sub"], session["sso"])
+
+	next := state.Next
+	if next == "" {
+		next = "/files" + home
+	}
+	http.Redirect(res, req, next, http.StatusSeeOther)
+}
+
+func oidcRedirectUri(req *http.Request) string {
+	if host := Config.Get("general.host").String(); host != "" {
+		return "https://" + host + COOKIE_PATH_OIDC + "/callback"
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + COOKIE_PATH_OIDC + "/callback"
+}
+
+// sessionCookieCreate gives the auth cookie to the user. Unless sessions are kept in the database,
+// the cookie carries the whole session encrypted
+func sessionCookieCreate(res http.ResponseWriter, req *http.Request, session map[string]string) error {
+	var value string
+	if err := model.VaultSeal(session); err != nil {
+		return err
+	}
+	if model.SessionStoreEnabled() {
+		id, err := model.SessionCreate(session, GetClientIp(req), req.UserAgent())
+		if err != nil {
+			return err
+		}
+		value = id
+	} else {
+		s, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		if value, err = EncryptString(SECRET_KEY_DERIVATE_FOR_USER, string(s)); err != nil {
+			return err
+		} else if len(value) > 4000 {
+			return NewError("Your credentials don't fit in a cookie, ask your administrator to enable the vault", 500)
+		}
+	}
 	http.SetCookie(res, &http.Cookie{
 		Name:     COOKIE_NAME_AUTH,
-		Value:    obfuscate,
+		Value:    value,
 		MaxAge:   60 * 60 * 24 * 30,
 		Path:     COOKIE_PATH,
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
 	})
-
-	if home != "" {
-		SendSuccessResult(res, home)
-		return
-	}
-	SendSuccessResult(res, nil)
+	model.CsrfCookieSet(res, COOKIE_NAME_CSRF, value)
+	return nil
 }
 
 func SessionLogout(ctx App, res http.ResponseWriter, req *http.Request) {
@@ -99,6 +263,11 @@ func SessionLogout(ctx App, res http.ResponseWriter, req *http.Request) {
 			go obj.Close()
 		}
 	}
+	if c, err := req.Cookie(COOKIE_NAME_AUTH); err == nil && model.IsSessionId(c.Value) {
+		if err = model.SessionDelete(c.Value); err != nil {
+			Log.Warning("session::logout %s", err.Error())
+		}
+	}
 	http.SetCookie(res, &http.Cookie{
 		Name:   COOKIE_NAME_AUTH,
 		Value:  "",
@@ -117,9 +286,29 @@ func SessionLogout(ctx App, res http.ResponseWriter, req *http.Request) {
 		MaxAge: -1,
 		Path:   COOKIE_PATH,
 	})
+	model.CsrfCookieSet(res, COOKIE_NAME_CSRF, "")
 	SendSuccessResult(res, nil)
 }
 
+// SessionLogoutEverywhere closes every session opened against the current backend, which is only
+// possible when sessions are kept in the database
+func SessionLogoutEverywhere(ctx App, res http.ResponseWriter, req *http.Request) {
+	if model.SessionStoreEnabled() == false {
+		SendErrorResult(res, NewError("Feature isn't enable, contact your administrator", 405))
+		return
+	} else if ctx.Share.Id != "" || ctx.Token.Id != "" {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	n, err := model.SessionRevokeBackend(GenerateID(&ctx))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SessionLogout(ctx, res, req)
+	Log.Info("[session] logout everywhere closed %d sessions", n)
+}
+
 func SessionOAuthBackend(ctx App, res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	a := map[string]string{
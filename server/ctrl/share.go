@@ -7,6 +7,7 @@ import (
 	. "github.com/mickael-kerjean/filestash/server/common"
 	"github.com/mickael-kerjean/filestash/server/model"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -44,7 +45,15 @@ func ShareUpsert(ctx App, res http.ResponseWriter, req *http.Request) {
 				a, err := req.Cookie(COOKIE_NAME_AUTH)
 				if err != nil {
 					return ""
-				}				
+				} else if model.IsSessionId(a.Value) {
+					// a shared link must outlive the session it was created from
+					s, err := json.Marshal(ctx.Session)
+					if err != nil {
+						return ""
+					}
+					auth, _ := EncryptString(SECRET_KEY_DERIVATE_FOR_USER, string(s))
+					return auth
+				}
 				return a.Value
 			}
 			return ctx.Share.Auth
@@ -69,6 +78,8 @@ func ShareUpsert(ctx App, res http.ResponseWriter, req *http.Request) {
 		}(),
 		Password:     NewStringpFromInterface(ctx.Body["password"]),
 		Users:        NewStringpFromInterface(ctx.Body["users"]),
+		Totp:         NewStringpFromInterface(ctx.Body["totp"]),
+		IpRanges:     NewStringpFromInterface(ctx.Body["ip_ranges"]),
 		Expire:       NewInt64pFromInterface(ctx.Body["expire"]),
 		Url:          NewStringpFromInterface(ctx.Body["url"]),
 		CanManageOwn: NewBoolFromInterface(ctx.Body["can_manage_own"]),
@@ -76,14 +87,71 @@ func ShareUpsert(ctx App, res http.ResponseWriter, req *http.Request) {
 		CanRead:      NewBoolFromInterface(ctx.Body["can_read"]),
 		CanWrite:     NewBoolFromInterface(ctx.Body["can_write"]),
 		CanUpload:    NewBoolFromInterface(ctx.Body["can_upload"]),
+		DropTypes:    NewStringpFromInterface(ctx.Body["drop_types"]),
+		DropMaxSize:  NewInt64pFromInterface(ctx.Body["drop_max_size"]),
+		DropMaxTotal: NewInt64pFromInterface(ctx.Body["drop_max_total"]),
+		DropFolder:   NewBoolFromInterface(ctx.Body["drop_folder"]),
+		DropNotify:   NewStringpFromInterface(ctx.Body["drop_notify"]),
+	}
+	if model.CanShare(&ctx, s.Path) == false {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
+	var existing Share
+	if e, err := model.ShareGet(share_id); err == nil && e.Backend == s.Backend {
+		existing = e
+		shareKeepUnsent(ctx.Body, &s, existing)
+	}
+	var totpSecret *string
+	if NewBoolFromInterface(ctx.Body["totp"]) == true {
+		if existing.Totp != nil && NewBoolFromInterface(ctx.Body["totp_rotate"]) == false {
+			// saving the link again mustn't invalidate the authenticator app of the owner
+			s.Totp = NewString(PASSWORD_DUMMY)
+		} else {
+			// the secret is shown only once so that the owner can enrol it in an authenticator app
+			totpSecret = NewString(NewTotpSecret())
+			s.Totp = NewString(*totpSecret)
+		}
 	}
 	if err := model.ShareUpsert(&s); err != nil {
 		SendErrorResult(res, err)
 		return
 	}
+	if totpSecret != nil {
+		SendSuccessResult(res, struct {
+			Totp string `json:"totp"`
+		}{ *totpSecret })
+		return
+	}
 	SendSuccessResult(res, nil)
 }
 
+// the dialog creating links doesn't know about every option of a share. What it doesn't send is
+// kept from the stored link instead of being wiped out on every save
+func shareKeepUnsent(body map[string]interface{}, s *Share, existing Share) {
+	if _, ok := body["ip_ranges"]; ok == false {
+		s.IpRanges = existing.IpRanges
+	}
+	if _, ok := body["drop_types"]; ok == false {
+		s.DropTypes = existing.DropTypes
+	}
+	if _, ok := body["drop_max_size"]; ok == false {
+		s.DropMaxSize = existing.DropMaxSize
+	}
+	if _, ok := body["drop_max_total"]; ok == false {
+		s.DropMaxTotal = existing.DropMaxTotal
+	}
+	if _, ok := body["drop_folder"]; ok == false {
+		s.DropFolder = existing.DropFolder
+	}
+	if _, ok := body["drop_notify"]; ok == false {
+		s.DropNotify = existing.DropNotify
+	}
+	if _, ok := body["totp"]; ok == false && existing.Totp != nil {
+		s.Totp = NewString(PASSWORD_DUMMY)
+	}
+}
+
 func ShareDelete(ctx App, res http.ResponseWriter, req *http.Request) {
 	share_target := mux.Vars(req)["share"]
 	if err := model.ShareDelete(share_target); err != nil {
@@ -93,11 +161,28 @@ func ShareDelete(ctx App, res http.ResponseWriter, req *http.Request) {
 	SendSuccessResult(res, nil)
 }
 
+func ShareLog(ctx App, res http.ResponseWriter, req *http.Request) {
+	limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(req.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	logs, err := model.ShareAccessList(mux.Vars(req)["share"], limit, offset)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, logs)
+}
+
 func ShareVerifyProof(ctx App, res http.ResponseWriter, req *http.Request) {
-	var submittedProof model.Proof
-	var verifiedProof []model.Proof
-	var requiredProof []model.Proof
-	var remainingProof []model.Proof
+	var submittedProof Proof
+	var verifiedProof []Proof
+	var requiredProof []Proof
+	var remainingProof []Proof
 	var s Share
 	var err error
 
@@ -108,7 +193,7 @@ func ShareVerifyProof(ctx App, res http.ResponseWriter, req *http.Request) {
 		SendErrorResult(res, err)
 		return
 	}
-	submittedProof = model.Proof{
+	submittedProof = Proof{
 		Key: fmt.Sprint(ctx.Body["type"]),
 		Value: fmt.Sprint(ctx.Body["value"]),
 	}
@@ -130,17 +215,29 @@ func ShareVerifyProof(ctx App, res http.ResponseWriter, req *http.Request) {
 		SendErrorResult(res, err)
 		return
 	}
+	if s.IpRanges != nil && model.ShareProofVerifierIp(*s.IpRanges, GetClientIp(req)) == false {
+		SendErrorResult(res, ErrNotAllowed)
+		return
+	}
+
+	ip := GetClientIp(req)
+	if err := model.RateLimit.Check(ip, "share::" + s.Id); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	defer model.RateLimit.Release(ip, "share::" + s.Id)
 
 	// 3) process the proof sent by the user
 	submittedProof, err = model.ShareProofVerifier(s, submittedProof);
 	if err != nil {
+		model.RateLimit.Fail(ip, "share::" + s.Id)
 		submittedProof.Error = NewString(err.Error())
 		SendSuccessResult(res, submittedProof)
 		return
 	}
-	if submittedProof.Key == "code" {
+	if submittedProof.Message != nil {
+		// the proof requires another step from the user. eg: email => code
 		submittedProof.Value = ""
-		submittedProof.Message = NewString("We've sent you a message with a verification code")
 		SendSuccessResult(res, submittedProof)
 		return
 	}
@@ -156,10 +253,15 @@ func ShareVerifyProof(ctx App, res http.ResponseWriter, req *http.Request) {
 	// 5) persist proofs in client cookie
 	cookie := http.Cookie{
 		Name: COOKIE_NAME_PROOF,
-		Value: func(p []model.Proof) string {
-			j, _ := json.Marshal(p)
-			str, _ := EncryptString(SECRET_KEY_DERIVATE_FOR_PROOF, string(j))
-			return str
+		Value: func(p []Proof) string {
+			for {
+				j, _ := json.Marshal(p)
+				str, _ := EncryptString(SECRET_KEY_DERIVATE_FOR_PROOF, string(j))
+				if len(str) <= model.SHARE_PROOF_COOKIE_MAX || len(p) == 0 {
+					return str
+				}
+				p = p[1:] // a cookie too large would be ignored, the oldest proofs go first
+			}
 		}(verifiedProof),
 		Path: COOKIE_PATH,
 		MaxAge: 60 * 60 * 24 * 30,
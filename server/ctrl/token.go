@@ -0,0 +1,79 @@
+package ctrl
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+	"net/http"
+)
+
+func TokenList(ctx App, res http.ResponseWriter, req *http.Request) {
+	if ctx.Token.Id != "" || ctx.Share.Id != "" {
+		SendErrorResult(res, ErrNotAllowed)
+		return
+	}
+	tokens, err := model.ApiTokenList(GenerateID(&ctx))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResults(res, tokens)
+}
+
+func TokenCreate(ctx App, res http.ResponseWriter, req *http.Request) {
+	if ctx.Token.Id != "" || ctx.Share.Id != "" {
+		SendErrorResult(res, ErrNotAllowed)
+		return
+	}
+	path := NewStringFromInterface(ctx.Body["path"])
+	if path == "" {
+		path = "/"
+	}
+	path, err := PathBuilder(ctx, EnforceDirectory(path))
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	s, err := json.Marshal(ctx.Session)
+	if err != nil {
+		SendErrorResult(res, NewError(err.Error(), 500))
+		return
+	}
+	auth, err := EncryptString(SECRET_KEY_DERIVATE_FOR_USER, string(s))
+	if err != nil {
+		SendErrorResult(res, NewError(err.Error(), 500))
+		return
+	}
+	t := ApiToken{
+		Name:      NewStringFromInterface(ctx.Body["name"]),
+		Backend:   GenerateID(&ctx),
+		Auth:      auth,
+		Path:      path,
+		CanRead:   NewBoolFromInterface(ctx.Body["can_read"]),
+		CanWrite:  NewBoolFromInterface(ctx.Body["can_write"]),
+		CanUpload: NewBoolFromInterface(ctx.Body["can_upload"]),
+		Expire:    NewInt64pFromInterface(ctx.Body["expire"]),
+	}
+	token, err := model.ApiTokenCreate(&t)
+	if err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, struct {
+		ApiToken
+		Token string `json:"token"`
+	}{ t, token })
+}
+
+func TokenDelete(ctx App, res http.ResponseWriter, req *http.Request) {
+	if ctx.Token.Id != "" || ctx.Share.Id != "" {
+		SendErrorResult(res, ErrNotAllowed)
+		return
+	}
+	if err := model.ApiTokenDelete(GenerateID(&ctx), mux.Vars(req)["token"]); err != nil {
+		SendErrorResult(res, err)
+		return
+	}
+	SendSuccessResult(res, nil)
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/mickael-kerjean/filestash/server/model"
 	"github.com/mickael-kerjean/net/webdav"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"strings"
 )
@@ -15,10 +16,17 @@ func WebdavHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	h := &webdav.Handler{
+		Prefix: "/s/" + ctx.Share.Id,
+		FileSystem: model.NewWebdavFs(&ctx, ctx.Share.Backend, ctx.Share.Path, req),
+		LockSystem: model.NewWebdavLock(),
+	}
+
 	// https://github.com/golang/net/blob/master/webdav/webdav.go#L49-L68
-	canRead := model.CanRead(&ctx)
-	canWrite := model.CanRead(&ctx)
-	canUpload := model.CanUpload(&ctx)
+	path := ctx.Share.Path + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, h.Prefix), "/")
+	canRead := model.CanRead(&ctx, path)
+	canWrite := model.CanEdit(&ctx, path)
+	canUpload := model.CanUpload(&ctx, path)
 	switch req.Method {
 	case "OPTIONS", "GET", "HEAD", "POST", "PROPFIND":
 		if canRead == false {
@@ -30,22 +38,58 @@ func WebdavHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 			SendErrorResult(res, ErrPermissionDenied)
 			return
 		}
+		if req.Method == "COPY" || req.Method == "MOVE" {
+			// the content of a folder is checked as it gets copied or moved, see model.WebdavFs
+			u, err := url.Parse(req.Header.Get("Destination"))
+			if err != nil || strings.HasPrefix(u.Path, h.Prefix+"/") == false {
+				SendErrorResult(res, ErrNotValid)
+				return
+			}
+			destination := ctx.Share.Path + strings.TrimPrefix(filepath.ToSlash(filepath.Clean(strings.TrimPrefix(u.Path, h.Prefix))), "/")
+			if model.CanEdit(&ctx, destination) == false {
+				SendErrorResult(res, ErrPermissionDenied)
+				return
+			}
+		}
 	case "PUT", "LOCK", "UNLOCK":
 		if canWrite == false && canUpload == false {
 			SendErrorResult(res, ErrPermissionDenied)
 			return
 		}
+		if req.Method == "PUT" {
+			if err := model.ShareDropVerifier(ctx.Share, filepath.Base(req.URL.Path), req.ContentLength); err != nil {
+				SendErrorResult(res, err)
+				return
+			}
+			defer model.ShareDropRelease(ctx.Share, req.ContentLength)
+		}
 	default:
 		SendErrorResult(res, ErrNotImplemented)
 		return
 	}
 
-	h := &webdav.Handler{
-		Prefix: "/s/" + ctx.Share.Id,
-		FileSystem: model.NewWebdavFs(ctx.Backend, ctx.Share.Backend, ctx.Share.Path, req),
-		LockSystem: model.NewWebdavLock(),
+	if req.Method == "PUT" || req.Method == "LOCK" {
+		// each uploader of a drop box gets its own folder as with the upload route. The LOCK goes
+		// along or the lock wouldn't match the PUT that follows
+		dropPath, err := DropPathBuilder(ctx, res, req, path)
+		if err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		req.URL.Path = h.Prefix + "/" + strings.TrimPrefix(dropPath, ctx.Share.Path)
 	}
+
 	h.ServeHTTP(res, req)
+
+	if req.Method == "PUT" && req.ContentLength >= 0 && ctx.Share.IsDropBox() {
+		if obj, ok := res.(interface{ Status() int }); ok && obj.Status() >= 200 && obj.Status() < 300 {
+			email := model.ShareProofGetEmail(req, ctx.Share)
+			path := "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, h.Prefix), "/")
+			if err := model.ShareDropRecord(ctx.Share, path, req.ContentLength, email); err != nil {
+				Log.Warning("share::drop %s", err.Error())
+			}
+		}
+	}
 }
 
 
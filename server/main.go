@@ -32,8 +32,13 @@ func Init(a *App) {
 	session.HandleFunc("",                NewMiddlewareChain(SessionAuthenticate, middlewares, *a)).Methods("POST")
 	middlewares = []Middleware{ ApiHeaders, SecureHeaders, SecureAjax, SessionTry }
 	session.HandleFunc("",                NewMiddlewareChain(SessionLogout,       middlewares, *a)).Methods("DELETE")
+	middlewares = []Middleware{ ApiHeaders, SecureHeaders, SecureAjax, SessionStart, LoggedInOnly }
+	session.HandleFunc("/all",            NewMiddlewareChain(SessionLogoutEverywhere, middlewares, *a)).Methods("DELETE")
 	middlewares = []Middleware{ ApiHeaders, SecureHeaders, SecureAjax }
 	session.HandleFunc("/auth/{service}", NewMiddlewareChain(SessionOAuthBackend, middlewares, *a)).Methods("GET")
+	middlewares = []Middleware{ ApiHeaders, SecureHeaders }
+	session.HandleFunc("/oidc",           NewMiddlewareChain(SessionOIDC,         middlewares, *a)).Methods("GET")
+	session.HandleFunc("/oidc/callback",  NewMiddlewareChain(SessionOIDCCallback, middlewares, *a)).Methods("GET")
 
 	// API for admin
 	middlewares = []Middleware{ ApiHeaders, SecureAjax }
@@ -43,8 +48,38 @@ func Init(a *App) {
 	middlewares = []Middleware{ ApiHeaders, AdminOnly, SecureAjax }
 	admin.HandleFunc("/config",  NewMiddlewareChain(PrivateConfigHandler,       middlewares, *a)).Methods("GET")
 	admin.HandleFunc("/config",  NewMiddlewareChain(PrivateConfigUpdateHandler, middlewares, *a)).Methods("POST")
+	admin.HandleFunc("/config/revisions",             NewMiddlewareChain(PrivateConfigRevisionList,     middlewares, *a)).Methods("GET")
+	admin.HandleFunc("/config/revisions/{id:[0-9]+}", NewMiddlewareChain(PrivateConfigRevisionGet,      middlewares, *a)).Methods("GET")
+	admin.HandleFunc("/config/diff",                  NewMiddlewareChain(PrivateConfigRevisionDiff,     middlewares, *a)).Methods("GET")
+	admin.HandleFunc("/config/rollback",              NewMiddlewareChain(PrivateConfigRevisionRollback, middlewares, *a)).Methods("POST")
+	admin.HandleFunc("/shares",  NewMiddlewareChain(AdminShareList,             middlewares, *a)).Methods("GET")
+	middlewares = []Middleware{ ApiHeaders, AdminOnly, SecureAjax, BodyParser }
+	admin.HandleFunc("/shares",  NewMiddlewareChain(AdminShareUpdate,           middlewares, *a)).Methods("POST")
+	middlewares = []Middleware{ ApiHeaders, AdminOnly, SecureAjax }
+	admin.HandleFunc("/secret/rotate",    NewMiddlewareChain(AdminSecretRotate,    middlewares, *a)).Methods("POST")
+	admin.HandleFunc("/secret/reencrypt", NewMiddlewareChain(AdminSecretReencrypt, middlewares, *a)).Methods("POST")
+	admin.HandleFunc("/ratelimit",        NewMiddlewareChain(AdminRateLimitList,   middlewares, *a)).Methods("GET")
+	admin.HandleFunc("/ratelimit",        NewMiddlewareChain(AdminRateLimitClear,  middlewares, *a)).Methods("DELETE")
+	admin.HandleFunc("/users",            NewMiddlewareChain(AdminUserList,        middlewares, *a)).Methods("GET")
+	admin.HandleFunc("/users",            NewMiddlewareChain(AdminUserDelete,      middlewares, *a)).Methods("DELETE")
+	admin.HandleFunc("/audit",            NewMiddlewareChain(AdminAuditList,       middlewares, *a)).Methods("GET")
+	admin.HandleFunc("/sessions",         NewMiddlewareChain(AdminUserSessionList,   middlewares, *a)).Methods("GET")
+	admin.HandleFunc("/sessions",         NewMiddlewareChain(AdminUserSessionRevoke, middlewares, *a)).Methods("DELETE")
+	admin.HandleFunc("/vault",            NewMiddlewareChain(AdminVaultList,       middlewares, *a)).Methods("GET")
+	admin.HandleFunc("/vault",            NewMiddlewareChain(AdminVaultDelete,     middlewares, *a)).Methods("DELETE")
+	admin.HandleFunc("/totp",             NewMiddlewareChain(AdminTotpGenerate,    middlewares, *a)).Methods("GET")
+	admin.HandleFunc("/totp",             NewMiddlewareChain(AdminTotpDisable,     middlewares, *a)).Methods("DELETE")
+	middlewares = []Middleware{ ApiHeaders, AdminOnly, SecureAjax, BodyParser }
+	admin.HandleFunc("/users",            NewMiddlewareChain(AdminUserUpsert,      middlewares, *a)).Methods("POST")
+	admin.HandleFunc("/totp",             NewMiddlewareChain(AdminTotpEnable,      middlewares, *a)).Methods("POST")
+	admin.HandleFunc("/vault",            NewMiddlewareChain(AdminVaultProvision,  middlewares, *a)).Methods("POST")
+	admin.HandleFunc("/connections/test", NewMiddlewareChain(AdminConnectionTest,  middlewares, *a)).Methods("POST")
 	middlewares = []Middleware{ IndexHeaders, AdminOnly, SecureAjax }
 	admin.HandleFunc("/log",                        NewMiddlewareChain(FetchLogHandler,          middlewares, *a)).Methods("GET")	
+	admin.HandleFunc("/metrics",                    NewMiddlewareChain(AdminMetricsHandler,      middlewares, *a)).Methods("GET")
+	admin.HandleFunc("/logs",                       NewMiddlewareChain(AdminLogQuery,            middlewares, *a)).Methods("GET")
+	middlewares = []Middleware{ AdminOnly } // EventSource can't set the headers SecureAjax looks for
+	admin.HandleFunc("/logs/tail",                  NewMiddlewareChain(AdminLogTail,             middlewares, *a)).Methods("GET")
 
 	// API for File management
 	files := r.PathPrefix("/api/files").Subrouter()
@@ -54,6 +89,12 @@ func Init(a *App) {
 	files.HandleFunc("/cat",    NewMiddlewareChain(FileAccess, middlewares, *a)).Methods("OPTIONS")
 	files.HandleFunc("/cat",    NewMiddlewareChain(FileSave,   middlewares, *a)).Methods("POST")
 	files.HandleFunc("/ls",     NewMiddlewareChain(FileLs,     middlewares, *a)).Methods("GET")
+	files.HandleFunc("/mv",     NewMiddlewareChain(FileMv,     middlewares, *a)).Methods("POST")
+	files.HandleFunc("/rm",     NewMiddlewareChain(FileRm,     middlewares, *a)).Methods("DELETE")
+	files.HandleFunc("/mkdir",  NewMiddlewareChain(FileMkdir,  middlewares, *a)).Methods("POST")
+	files.HandleFunc("/touch",  NewMiddlewareChain(FileTouch,  middlewares, *a)).Methods("POST")
+	files.HandleFunc("/sign",   NewMiddlewareChain(FileSign,   middlewares, *a)).Methods("GET")
+	middlewares = []Middleware{ ApiHeaders, SecureHeaders, SecureAjax, LegacyGet, SessionStart, LoggedInOnly }
 	files.HandleFunc("/mv",     NewMiddlewareChain(FileMv,     middlewares, *a)).Methods("GET")
 	files.HandleFunc("/rm",     NewMiddlewareChain(FileRm,     middlewares, *a)).Methods("GET")
 	files.HandleFunc("/mkdir",  NewMiddlewareChain(FileMkdir,  middlewares, *a)).Methods("GET")
@@ -61,6 +102,18 @@ func Init(a *App) {
 	middlewares = []Middleware{ ApiHeaders, SessionStart, LoggedInOnly }
 	files.HandleFunc("/search",  NewMiddlewareChain(FileSearch,  middlewares, *a)).Methods("GET")
 
+	// API v2: resource oriented routes, the v1 is kept as is for existing clients
+	v2 := r.PathPrefix("/api/v2").Subrouter()
+	middlewares = []Middleware{ ApiV2, ApiHeaders, SecureHeaders, SessionStart, LoggedInOnly }
+	v2.HandleFunc("/files/{path:.*}", NewMiddlewareChain(FileGetV2,    middlewares, *a)).Methods("GET", "HEAD")
+	middlewares = []Middleware{ ApiV2, ApiHeaders, SecureHeaders, SecureAjax, SessionStart, LoggedInOnly }
+	v2.HandleFunc("/files/{path:.*}", NewMiddlewareChain(FilePutV2,    middlewares, *a)).Methods("PUT")
+	v2.HandleFunc("/files/{path:.*}", NewMiddlewareChain(FileDeleteV2, middlewares, *a)).Methods("DELETE")
+	middlewares = []Middleware{ ApiV2, ApiHeaders, SecureHeaders, SecureAjax, BodyParser, SessionStart, LoggedInOnly }
+	v2.HandleFunc("/files/{path:.*}", NewMiddlewareChain(FilePatchV2,  middlewares, *a)).Methods("PATCH")
+	middlewares = []Middleware{ ApiHeaders }
+	v2.HandleFunc("/openapi.json",    NewMiddlewareChain(OpenAPIHandler(r), middlewares, *a)).Methods("GET")
+
 	// API for exporter
 	middlewares = []Middleware{ ApiHeaders, SecureHeaders, RedirectSharedLoginIfNeeded, SessionStart, LoggedInOnly }
 	r.PathPrefix("/api/export/{share}/{mtype0}/{mtype1}").Handler(NewMiddlewareChain(FileExport,  middlewares, *a))
@@ -73,9 +126,18 @@ func Init(a *App) {
 	share.HandleFunc("/{share}/proof", NewMiddlewareChain(ShareVerifyProof, middlewares, *a)).Methods("POST")
 	middlewares = []Middleware{ ApiHeaders, SecureHeaders, SecureAjax, CanManageShare }
 	share.HandleFunc("/{share}",       NewMiddlewareChain(ShareDelete,      middlewares, *a)).Methods("DELETE")
+	share.HandleFunc("/{share}/log",   NewMiddlewareChain(ShareLog,         middlewares, *a)).Methods("GET")
 	middlewares = []Middleware{ ApiHeaders, SecureHeaders, SecureAjax, BodyParser, CanManageShare }
 	share.HandleFunc("/{share}",       NewMiddlewareChain(ShareUpsert,      middlewares, *a)).Methods("POST")
 
+	// API for personal access tokens
+	token := r.PathPrefix("/api/tokens").Subrouter()
+	middlewares = []Middleware{ ApiHeaders, SecureHeaders, SecureAjax, SessionStart, LoggedInOnly }
+	token.HandleFunc("",          NewMiddlewareChain(TokenList,   middlewares, *a)).Methods("GET")
+	token.HandleFunc("/{token}",  NewMiddlewareChain(TokenDelete, middlewares, *a)).Methods("DELETE")
+	middlewares = []Middleware{ ApiHeaders, SecureHeaders, SecureAjax, BodyParser, SessionStart, LoggedInOnly }
+	token.HandleFunc("",          NewMiddlewareChain(TokenCreate, middlewares, *a)).Methods("POST")
+
 	// Webdav server / Shared Link
 	middlewares = []Middleware{ IndexHeaders, SecureHeaders }
 	r.HandleFunc("/s/{share}",         NewMiddlewareChain(IndexHandler(FILE_INDEX), middlewares, *a)).Methods("GET")
@@ -94,6 +156,8 @@ func Init(a *App) {
 	// Other endpoints
 	middlewares = []Middleware{ ApiHeaders }
 	r.HandleFunc("/report",      NewMiddlewareChain(ReportHandler,                                   middlewares, *a)).Methods("POST")
+	middlewares = []Middleware{}
+	r.HandleFunc("/metrics",     NewMiddlewareChain(MetricsHandler,                                  middlewares, *a)).Methods("GET")
 	middlewares = []Middleware{ IndexHeaders }
 	r.HandleFunc("/about",       NewMiddlewareChain(AboutHandler,                                    middlewares, *a)).Methods("GET")
 	r.HandleFunc("/robots.txt", func(res http.ResponseWriter, req *http.Request) {
@@ -3,9 +3,11 @@ package middleware
 import (
 	"fmt"
 	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func ApiHeaders(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
@@ -19,11 +21,73 @@ func ApiHeaders(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App,
 
 func SecureAjax(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
 	return func(ctx App, res http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+			// personal access tokens aren't sent automatically by the browser
+			fn(ctx, res, req)
+			return
+		}
+		if req.URL.Query().Get("sig") != "" {
+			// a valid signed url is meant to be used from a plain link or script
+			if _, err := model.SignedUrlVerify(req); err == nil {
+				fn(ctx, res, req)
+				return
+			}
+		}
 		if req.Header.Get("X-Requested-With") != "XmlHttpRequest" {
-			Log.Warning("Intrusion detection: %s - %s", req.RemoteAddr, req.URL.String())
+			Log.Warning("Intrusion detection: %s - %s", req.RemoteAddr, logRequestURI(req))
 			SendErrorResult(res, ErrNotAllowed)
 			return
 		}
+		if model.CSRF_ENABLE() {
+			if err := model.CsrfVerify(res, req); err != nil {
+				Log.Warning("Intrusion detection: %s - %s csrf", req.RemoteAddr, logRequestURI(req))
+				SendErrorResult(res, err)
+				return
+			}
+		}
+		fn(ctx, res, req)
+	}
+}
+
+// ApiV2 is for the routes of the v2 api, responses are sent without envelope, see ApiVersion
+func ApiV2(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
+	return func(ctx App, res http.ResponseWriter, req *http.Request) {
+		fn(ctx, &apiV2ResponseWriter{res}, req)
+	}
+}
+
+type apiV2ResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *apiV2ResponseWriter) ApiVersion() int {
+	return 2
+}
+
+func (w *apiV2ResponseWriter) Status() int {
+	if obj, ok := w.ResponseWriter.(interface{ Status() int }); ok {
+		return obj.Status()
+	}
+	return 0
+}
+
+// LegacyGet is for the routes that change something while being reachable with GET. They are kept
+// for existing clients until they get disabled from the config
+func LegacyGet(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
+	return func(ctx App, res http.ResponseWriter, req *http.Request) {
+		if model.LEGACY_GET_ROUTES() == false {
+			SendErrorResult(res, NewError("Method not allowed", 405))
+			return
+		}
+		res.Header().Set("Deprecation", "true")
+		if model.CSRF_ENABLE() && strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") == false {
+			// the csrf check of SecureAjax lets GET through
+			if err := model.CsrfRequire(res, req); err != nil {
+				Log.Warning("Intrusion detection: %s - %s csrf", req.RemoteAddr, logRequestURI(req))
+				SendErrorResult(res, err)
+				return
+			}
+		}
 		fn(ctx, res, req)
 	}
 }
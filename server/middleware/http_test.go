@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSecureAjaxSignedUrl(t *testing.T) {
+	previous := SECRET_KEY
+	InitSecretDerivate(RandomString(16))
+	defer InitSecretDerivate(previous)
+
+	url, err := model.SignedUrlCreate(map[string]string{"type": "sftp", "username": "alice"}, "", "ls", "/", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	handler := SecureAjax(func(ctx App, res http.ResponseWriter, req *http.Request) {
+		called = true
+	})
+	handler(App{}, httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	if called == false {
+		t.Errorf("a signed url should work without the X-Requested-With header")
+	}
+
+	called = false
+	handler(App{}, httptest.NewRecorder(), httptest.NewRequest("GET", url+"x", nil))
+	if called {
+		t.Errorf("an invalid signature mustn't skip the X-Requested-With check")
+	}
+}
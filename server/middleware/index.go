@@ -3,19 +3,38 @@ package middleware
 import (
 	"bytes"
 	"encoding/json"
+	"github.com/gorilla/mux"
 	"net/http"
 	. "github.com/mickael-kerjean/filestash/server/common"
+	"strconv"
 	"time"
 	"sync"
 )
 
+var (
+	metricsHttpRequests = NewCounterVec(
+		"filestash_http_requests_total", "Number of HTTP requests by route and status",
+		"route", "method", "status",
+	)
+	metricsHttpDuration = NewHistogramVec(
+		"filestash_http_request_duration_seconds", "Time taken to answer HTTP requests by route and status",
+		METRICS_DEFAULT_BUCKETS, "route", "method", "status",
+	)
+)
+
 type Middleware func(func(App, http.ResponseWriter, *http.Request)) func(App, http.ResponseWriter, *http.Request)
 
 func NewMiddlewareChain(fn func(App, http.ResponseWriter, *http.Request), m []Middleware, app App) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		var resw ResponseWriter                             = NewResponseWriter(res)
-		var f func(App, http.ResponseWriter, *http.Request) = fn
+		var last App                                        = app
+		var f func(App, http.ResponseWriter, *http.Request) = func(ctx App, res http.ResponseWriter, req *http.Request) {
+			last = ctx // the logger needs the session and share the middlewares have set
+			fn(ctx, res, req)
+		}
 
+		resw.requestId = requestId(req)
+		res.Header().Set("X-Request-Id", resw.requestId)
 		for i := len(m) - 1; i >= 0; i-- {
 			f = m[i](f)
 		}
@@ -23,14 +42,15 @@ func NewMiddlewareChain(fn func(App, http.ResponseWriter, *http.Request), m []Mi
 		if req.Body != nil {
 			req.Body.Close()
 		}
-		go Logger(app, &resw, req)
+		go Logger(last, &resw, req)
 	}
 }
 
 type ResponseWriter struct {
 	http.ResponseWriter
-	status int
-	start  time.Time
+	status    int
+	start     time.Time
+	requestId string
 }
 
 func NewResponseWriter(res http.ResponseWriter) ResponseWriter {
@@ -45,6 +65,10 @@ func (w *ResponseWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
+func (w *ResponseWriter) Status() int {
+	return w.status
+}
+
 func (w *ResponseWriter) Write(b []byte) (int, error) {
 	if w.status == 0 {
 		w.status = 200
@@ -52,6 +76,26 @@ func (w *ResponseWriter) Write(b []byte) (int, error) {
 	return w.ResponseWriter.Write(b)
 }
 
+func (w *ResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// requestId reuses the id given by a reverse proxy so that both logs can be correlated
+func requestId(req *http.Request) string {
+	id := req.Header.Get("X-Request-Id")
+	if len(id) == 0 || len(id) > 64 {
+		return QuickString(16)
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' {
+			return QuickString(16)
+		}
+	}
+	return id
+}
+
 type LogEntry struct {
 	Host       string    `json:"host"`
 	Method     string    `json:"method"`
@@ -74,24 +118,86 @@ func Logger(ctx App, res http.ResponseWriter, req *http.Request) {
 			Scheme:     req.URL.Scheme,
 			Host:       req.Host,
 			Method:     req.Method,
-			RequestURI: req.RequestURI,
+			RequestURI: logRequestURI(req),
 			Proto:      req.Proto,
 			Status:     obj.status,
 			UserAgent:  req.Header.Get("User-Agent"),
-			Ip:         req.RemoteAddr,
+			Ip:         GetClientIp(req),
 			Referer:    req.Referer(),
 			Duration:   float64(time.Now().Sub(obj.start)) / (1000 * 1000),
 			Backend:    ctx.Session["type"],
 		}
+		metricsRecord(req, point)
 		if Config.Get("log.telemetry").Bool() {
 			telemetry.Record(point)
 		}
 		if Config.Get("log.enable").Bool() {
-			Log.Info("HTTP %3d %3s %6.1fms %s", point.Status, point.Method, point.Duration, point.RequestURI)
+			fields := LogFields{
+				"request_id": obj.requestId,
+				"duration":   point.Duration,
+				"status":     point.Status,
+				"method":     point.Method,
+				"path":       point.RequestURI,
+				"ip":         point.Ip,
+			}
+			if point.Backend != "" {
+				fields["backend"] = point.Backend
+			}
+			if ctx.Share.Id != "" {
+				fields["share_id"] = ctx.Share.Id
+			}
+			Log.WithFields(fields).Info("HTTP %3d %3s %6.1fms %s", point.Status, point.Method, point.Duration, point.RequestURI)
 		}
 	}
 }
 
+// the query parameters of signed urls and shared links are credentials, they must not end up in
+// the logs
+var logRedactedParams = []string{"sig", "auth", "exp", "share"}
+
+func logRequestURI(req *http.Request) string {
+	u := *req.URL
+	query := u.Query()
+	redacted := false
+	for _, key := range logRedactedParams {
+		if _, ok := query[key]; ok {
+			query.Del(key)
+			redacted = true
+		}
+	}
+	if redacted {
+		u.RawQuery = query.Encode()
+	}
+	return u.RequestURI()
+}
+
+func metricsRecord(req *http.Request, point LogEntry) {
+	// the route template is used rather than the url to keep the number of series bounded
+	route := "unknown"
+	if r := mux.CurrentRoute(req); r != nil {
+		if tmpl, err := r.GetPathTemplate(); err == nil {
+			route = tmpl
+		}
+	}
+	status := point.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	method := point.Method
+	if metricsMethods[method] == false {
+		// the method is whatever the client sent, same as the route it mustn't create new series
+		method = "other"
+	}
+	metricsHttpRequests.Inc(route, method, strconv.Itoa(status))
+	metricsHttpDuration.Observe(point.Duration / 1000, route, method, strconv.Itoa(status))
+}
+
+var metricsMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true,
+	// webdav
+	"PROPFIND": true, "PROPPATCH": true, "MKCOL": true, "COPY": true, "MOVE": true, "LOCK": true, "UNLOCK": true,
+}
+
 type Telemetry struct {
 	Data []LogEntry
 	mu   sync.Mutex
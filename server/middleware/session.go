@@ -1,8 +1,6 @@
 package middleware
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	. "github.com/mickael-kerjean/filestash/server/common"
@@ -25,30 +23,77 @@ func LoggedInOnly(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App
 
 func AdminOnly(fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
 	return func(ctx App, res http.ResponseWriter, req *http.Request) {
-		if admin := Config.Get("auth.admin").String(); admin != "" {
-			c, err := req.Cookie(COOKIE_NAME_ADMIN);
-			if err != nil {
-				SendErrorResult(res, ErrPermissionDenied)
-				return
-			}
+		if enabled, err := model.AdminEnabled(); err != nil {
+			SendErrorResult(res, err)
+			return
+		} else if enabled == false {
+			fn(ctx, res, req)
+			return
+		}
+		token, err := model.AdminTokenFromRequest(req)
+		if err != nil {
+			SendErrorResult(res, ErrPermissionDenied)
+			return
+		}
+		if role := _adminRouteRole(req); role != "" && token.HasRole(role) == false {
+			Log.Debug("Admin '%s' is missing the role '%s' for %s", token.Username, _adminRouteRole(req), req.URL.Path)
+			SendErrorResult(res, ErrPermissionDenied)
+			return
+		}
+		fn(ctx, res, req)
 
-			str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_ADMIN, c.Value);
-			if err != nil {
-				SendErrorResult(res, ErrPermissionDenied)
-				return
+		if req.Method != "GET" && req.Method != "HEAD" {
+			a := model.AdminAudit{
+				Username: token.Username,
+				Ip:       GetClientIp(req),
+				Method:   req.Method,
+				Path:     req.URL.RequestURI(),
 			}
-			token := AdminToken{}
-			json.Unmarshal([]byte(str), &token)
-
-			if token.IsValid() == false || token.IsAdmin() == false {
-				SendErrorResult(res, ErrPermissionDenied)
-				return
+			if obj, ok := res.(interface{ Status() int }); ok {
+				a.Status = obj.Status()
 			}
+			go func() {
+				if err := model.AdminAuditInsert(a); err != nil {
+					Log.Warning("admin::audit %s", err.Error())
+				}
+			}()
 		}
-		fn(ctx, res, req)
 	}
 }
 
+// role required to access an admin route, anything not listed here is reserved to ADMIN_ROLE_ADMIN
+// and an empty role is for routes any admin can use on their own account
+var adminRouteRoles = map[string]string{
+	"/admin/api/totp":                         "",
+	"/admin/api/config":                       ADMIN_ROLE_CONFIG,
+	"/admin/api/config/revisions":             ADMIN_ROLE_CONFIG,
+	"/admin/api/config/revisions/{id:[0-9]+}": ADMIN_ROLE_CONFIG,
+	"/admin/api/config/diff":                  ADMIN_ROLE_CONFIG,
+	"/admin/api/config/rollback":              ADMIN_ROLE_CONFIG,
+	"/admin/api/secret/rotate":                ADMIN_ROLE_CONFIG,
+	"/admin/api/secret/reencrypt":             ADMIN_ROLE_CONFIG,
+	"/admin/api/vault":                        ADMIN_ROLE_CONFIG,
+	"/admin/api/connections/test":             ADMIN_ROLE_CONFIG,
+	"/admin/api/log":                          ADMIN_ROLE_LOG,
+	"/admin/api/metrics":                      ADMIN_ROLE_LOG,
+	"/admin/api/logs":                         ADMIN_ROLE_LOG,
+	"/admin/api/logs/tail":                    ADMIN_ROLE_LOG,
+	"/admin/api/shares":                       ADMIN_ROLE_SHARE,
+}
+
+func _adminRouteRole(req *http.Request) string {
+	path := req.URL.Path
+	if route := mux.CurrentRoute(req); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			path = tmpl
+		}
+	}
+	if role, ok := adminRouteRoles[path]; ok {
+		return role
+	}
+	return ADMIN_ROLE_ADMIN
+}
+
 func SessionStart (fn func(App, http.ResponseWriter, *http.Request)) func(ctx App, res http.ResponseWriter, req *http.Request) {
 	return func(ctx App, res http.ResponseWriter, req *http.Request) {
 		var err error
@@ -56,6 +101,10 @@ func SessionStart (fn func(App, http.ResponseWriter, *http.Request)) func(ctx Ap
 			SendErrorResult(res, err)
 			return
 		}
+		if ctx.Token, err = _extractToken(req); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
 		if ctx.Session, err = _extractSession(req, &ctx); err != nil {
 			SendErrorResult(res, err)
 			return
@@ -68,6 +117,9 @@ func SessionStart (fn func(App, http.ResponseWriter, *http.Request)) func(ctx Ap
 			SendErrorResult(res, err)
 			return
 		}
+		if ctx.Share.Id != "" {
+			_logShareAccess(&ctx, req)
+		}
 		fn(ctx, res, req)
 	}
 }
@@ -185,48 +237,94 @@ func _extractShare(req *http.Request) (Share, error) {
 	if err = s.IsValid(); err != nil {
 		return Share{}, err
 	}
+	if s.IpRanges != nil && model.ShareProofVerifierIp(*s.IpRanges, GetClientIp(req)) == false {
+		Log.Debug("Shared link '%s' can't be accessed from '%s'", s.Id, GetClientIp(req))
+		return Share{}, ErrNotAllowed
+	}
 
-	var verifiedProof []model.Proof = model.ShareProofGetAlreadyVerified(req)
-	username, password := func(authHeader string) (string, string){
-		decoded, err := base64.StdEncoding.DecodeString(
-			strings.TrimPrefix(authHeader, "Basic "),
-		)
-		if err != nil {
-			return "", ""
-		}
-		s := bytes.Split(decoded, []byte(":"))
-		if len(s) < 2 {
-			return "", ""
-		}
-		p := string(bytes.Join(s[1:], []byte(":")))
-		usr := regexp.MustCompile(`^(.*)\[([0-9a-zA-Z]+)\]$`).FindStringSubmatch(string(s[0]))
-		if len(usr) != 3 {
-			return "", p
+	var verifiedProof []Proof = model.ShareProofGetAlreadyVerified(req)
+	username, password := model.ShareProofGetCredentials(req)
+	ip, failed, verified := GetClientIp(req), false, false
+	if username != "" || password != "" {
+		// credentials given with basic auth, as webdav clients do, go through the same rate limit
+		// as the proofs sent from the share page
+		if err := model.RateLimit.Check(ip, "share::" + s.Id); err != nil {
+			return Share{}, err
 		}
-		if Hash(usr[1] + SECRET_KEY_DERIVATE_FOR_HASH, 10) != usr[2] {
-			return "", p
-		}
-		return usr[1], p
-	}(req.Header.Get("Authorization"))
-
+		defer model.RateLimit.Release(ip, "share::" + s.Id)
+	}
 	if s.Users != nil && username != "" {
 		if v, ok := model.ShareProofVerifierEmail(*s.Users, username); ok {
-			verifiedProof = append(verifiedProof, model.Proof{ Key: "email", Value: v })
+			verifiedProof = append(verifiedProof, Proof{ Key: "email", Value: v, Email: username })
+			verified = true
+		} else {
+			failed = true
 		}
 	}
 	if s.Password != nil && password != "" {
 		if v, ok := model.ShareProofVerifierPassword(*s.Password, password); ok {
-			verifiedProof = append(verifiedProof, model.Proof{ Key: "password", Value: v })
+			verifiedProof = append(verifiedProof, Proof{ Key: "password", Value: v })
+			verified = true
+		} else {
+			failed = true
 		}
 	}
-	var requiredProof []model.Proof = model.ShareProofGetRequired(s)
-	var remainingProof []model.Proof = model.ShareProofCalculateRemainings(requiredProof, verifiedProof)
+	if failed {
+		model.RateLimit.Fail(ip, "share::" + s.Id)
+	}
+	var requiredProof []Proof = model.ShareProofGetRequired(s)
+	var remainingProof []Proof = model.ShareProofCalculateRemainings(requiredProof, verifiedProof)
 	if len(remainingProof) != 0 {
 		return Share{}, NewError("Unauthorized Shared space", 400)
 	}
+	if verified && failed == false {
+		// only once the credentials open the shared link, a valid email alone isn't enough
+		model.RateLimit.Success(ip, "share::" + s.Id)
+	}
 	return s, nil
 }
 
+func _extractToken(req *http.Request) (ApiToken, error) {
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") == false {
+		return ApiToken{}, nil
+	} else if _extractShareId(req) != "" {
+		return ApiToken{}, ErrNotValid
+	}
+	return model.ApiTokenVerify(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+}
+
+func _logShareAccess(ctx *App, req *http.Request) {
+	a := model.ShareAccess{
+		Ip:        GetClientIp(req),
+		UserAgent: req.Header.Get("User-Agent"),
+		Email:     model.ShareProofGetEmail(req, ctx.Share),
+		Path:      req.URL.Query().Get("path"),
+	}
+	if strings.HasPrefix(req.URL.Path, "/api/files/") {
+		a.Operation = strings.TrimPrefix(req.URL.Path, "/api/files/")
+		if a.Operation == "cat" && req.Method == "POST" {
+			a.Operation = "save"
+		} else if a.Operation == "mv" {
+			a.Path = req.URL.Query().Get("from") + " -> " + req.URL.Query().Get("to")
+		}
+	} else if strings.HasPrefix(req.URL.Path, "/api/export/") {
+		a.Operation = "export"
+		a.Path = regexp.MustCompile(`^/api/export/[^\/]+/[^\/]+/[^\/]+(\/.+)$`).ReplaceAllString(req.URL.Path, `$1`)
+	} else if strings.HasPrefix(req.URL.Path, "/s/") {
+		// webdav client mounting the shared link as a network drive
+		a.Operation = "webdav:" + strings.ToLower(req.Method)
+		a.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/s/" + ctx.Share.Id), "/")
+	} else {
+		a.Operation = strings.TrimPrefix(req.URL.Path, "/api/")
+	}
+	go func() {
+		if err := model.ShareAccessInsert(ctx.Share.Id, a); err != nil {
+			Log.Warning("share::log %s", err.Error())
+		}
+	}()
+}
+
 func _extractSession(req *http.Request, ctx *App) (map[string]string, error) {
 	var str string
 	var err error
@@ -255,11 +353,29 @@ func _extractSession(req *http.Request, ctx *App) (map[string]string, error) {
 			session["path"] = strings.TrimSuffix(ctx.Share.Path, path) + "/"
 		}
 		return session, err
+	} else if ctx.Token.Id != "" {
+		str, err = DecryptString(SECRET_KEY_DERIVATE_FOR_USER, ctx.Token.Auth)
+		if err != nil {
+			return session, nil
+		}
+		err = json.Unmarshal([]byte(str), &session)
+		session["path"] = ctx.Token.Path
+		return session, err
+	} else if req.URL.Query().Get("sig") != "" {
+		// signed url: the session is carried by the url itself and not by the cookie
+		return model.SignedUrlVerify(req)
 	} else {
 		cookie, err := req.Cookie(COOKIE_NAME_AUTH)
 		if err != nil {
 			return session, nil
 		}
+		if model.IsSessionId(cookie.Value) {
+			if session, err = model.SessionGet(cookie.Value); err != nil {
+				// revoked or expired session
+				return make(map[string]string), nil
+			}
+			return session, nil
+		}
 		str = cookie.Value
 		str, err = DecryptString(SECRET_KEY_DERIVATE_FOR_USER, str)
 		if err != nil {
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/base64"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/mickael-kerjean/filestash/server/model"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestShareBasicAuthParallel(t *testing.T) {
+	Config.Get("features.share.enable").Set(true)
+	share := Share{
+		Id:       "test" + RandomString(8),
+		Backend:  "test",
+		Path:     "/",
+		Password: NewString("secret"),
+		CanRead:  true,
+	}
+	if err := model.ShareUpsert(&share); err != nil {
+		t.Fatal(err)
+	}
+	defer model.ShareDelete(share.Id)
+	defer model.RateLimit.Clear("", "share::"+share.Id)
+
+	request := func(password string) error {
+		req := httptest.NewRequest("PROPFIND", "/s/"+share.Id+"/?share="+share.Id, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("webdav:"+password)))
+		_, err := _extractShare(req)
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- request("secret")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("parallel requests with valid credentials mustn't be limited: %s", err.Error())
+		}
+	}
+
+	for i := 0; i <= model.RATELIMIT_ATTEMPTS(); i++ {
+		request("wrong")
+	}
+	if err := request("secret"); err == nil {
+		t.Errorf("a client guessing the password should be limited")
+	}
+}
+
+func TestAdminOnlyDatabaseError(t *testing.T) {
+	admin := Config.Get("auth.admin").String()
+	defer Config.Get("auth.admin").Set(admin)
+	Config.Get("auth.admin").Set("")
+
+	db := model.DB
+	defer func() {
+		model.DB = db
+	}()
+	closed, _ := sql.Open("sqlite3", ":memory:")
+	closed.Close()
+	model.DB = closed
+
+	called := false
+	res := httptest.NewRecorder()
+	AdminOnly(func(ctx App, res http.ResponseWriter, req *http.Request) {
+		called = true
+	})(App{}, res, httptest.NewRequest("GET", "/admin/api/config", nil))
+	if called {
+		t.Fatalf("admin routes mustn't be opened when the admin accounts can't be read")
+	} else if res.Code != 500 {
+		t.Errorf("unexpected status %d", res.Code)
+	}
+}
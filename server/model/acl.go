@@ -0,0 +1,322 @@
+package model
+
+import (
+	"fmt"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+/*
+ * Access control policies are defined per connection under the "acl" key of Config.Conn:
+ *
+ * "acl": [
+ *     { "path": ".env", "allow": "hide" },
+ *     { "path": "/finance/**", "subject": "group:finance", "allow": "read-write" },
+ *     { "path": "/finance/**", "allow": "read" }
+ * ]
+ *
+ * Paths are globs on the absolute path of the backend where `*` matches within a folder and `**` across
+ * folders, a glob that doesn't start with a slash matches at any depth. The subject is either "*" (the
+ * default), "user:name", "group:name" or "share", users and groups are only known to sessions created
+ * through single sign on. The first rule matching both the path and the subject gives the operations
+ * that are allowed: any combination of read, write, upload and share. Without a matching rule,
+ * everything is allowed. Paths a user can't do anything with don't appear in listings
+ */
+const (
+	ACL_READ   = "read"
+	ACL_WRITE  = "write"
+	ACL_UPLOAD = "upload"
+	ACL_SHARE  = "share"
+)
+
+var aclAliases = map[string][]string{
+	"none":       []string{},
+	"hide":       []string{},
+	"read-only":  []string{ACL_READ},
+	"read-write": []string{ACL_READ, ACL_WRITE, ACL_UPLOAD},
+	"all":        []string{ACL_READ, ACL_WRITE, ACL_UPLOAD, ACL_SHARE},
+	"*":          []string{ACL_READ, ACL_WRITE, ACL_UPLOAD, ACL_SHARE},
+}
+
+type AclRule struct {
+	Path    string
+	Subject string
+	Allow   map[string]bool
+	pattern *regexp.Regexp
+}
+
+var aclCache = struct {
+	rules map[string][]AclRule
+	sync.RWMutex
+}{rules: make(map[string][]AclRule)}
+
+// AclAllow tells if an operation can be done on a path by the user of the current session
+func AclAllow(ctx *App, path string, operation string) bool {
+	if path == "" {
+		return true
+	}
+	rules := aclRules(ctx.Session)
+	for i := range rules {
+		if rules[i].pattern.MatchString(path) == false || aclSubjectMatch(ctx, rules[i].Subject) == false {
+			continue
+		}
+		return rules[i].Allow[operation]
+	}
+	return true
+}
+
+// AclAllowRecursive tells if an operation can be done on a path and everything below it, as with a
+// rm. When a rule which doesn't allow the operation could apply to something in the folder, what the
+// folder contains is checked one entry at a time
+func AclAllowRecursive(ctx *App, path string, operation string) bool {
+	return aclAllowTree(ctx, path, path, operation)
+}
+
+// AclAllowRecursiveTo is AclAllowRecursive for a mv or a copy: everything in the folder must be
+// allowed both where it is and where it ends up
+func AclAllowRecursiveTo(ctx *App, from string, to string, operation string) bool {
+	if strings.HasSuffix(from, "/") && strings.HasSuffix(to, "/") == false {
+		to += "/"
+	}
+	return aclAllowTree(ctx, from, from, operation) && aclAllowTree(ctx, from, to, operation)
+}
+
+// the number of entries looked at before giving up on a recursive check
+const ACL_WALK_MAX = 10000
+
+// aclAllowTree checks the content of the folder src as if it was in the folder dst
+func aclAllowTree(ctx *App, src string, dst string, operation string) bool {
+	if AclAllow(ctx, dst, operation) == false {
+		return false
+	} else if strings.HasSuffix(src, "/") == false {
+		return true
+	}
+	rules := aclRules(ctx.Session)
+	walk := false
+	for i := range rules {
+		if aclSubjectMatch(ctx, rules[i].Subject) == false {
+			continue
+		}
+		glob := aclGlobNormalise(rules[i].Path)
+		if strings.HasSuffix(glob, "/**") && rules[i].pattern.MatchString(dst) {
+			// the rules after this one can't apply to anything in the folder
+			return rules[i].Allow[operation]
+		}
+		if rules[i].Allow[operation] == false && aclGlobBelow(glob, dst) {
+			walk = true
+			break
+		}
+	}
+	if walk == false {
+		return true
+	} else if ctx.Backend == nil {
+		return false
+	}
+	n := 0
+	var fn func(rel string) bool
+	fn = func(rel string) bool {
+		files, err := ctx.Backend.Ls(src + rel)
+		if err != nil {
+			Log.Warning("acl::walk %s", err.Error())
+			return false
+		}
+		for i := range files {
+			if n += 1; n > ACL_WALK_MAX {
+				Log.Warning("acl::walk too many files in '%s'", src)
+				return false
+			}
+			name := rel + files[i].Name()
+			if files[i].IsDir() {
+				name += "/"
+			}
+			if AclAllow(ctx, dst+name, operation) == false {
+				return false
+			} else if files[i].IsDir() && fn(name) == false {
+				return false
+			}
+		}
+		return true
+	}
+	return fn("")
+}
+
+// aclGlobBelow tells if a glob could match something inside a folder by comparing their segments,
+// "**" standing for any number of them
+func aclGlobBelow(glob string, folder string) bool {
+	g := strings.Split(strings.Trim(glob, "/"), "/")
+	p := []string{}
+	if f := strings.Trim(folder, "/"); f != "" {
+		p = strings.Split(f, "/")
+	}
+	var match func(i int, j int) bool
+	match = func(i int, j int) bool {
+		if j == len(p) {
+			// the folder itself isn't below the folder
+			return i < len(g)
+		} else if i == len(g) {
+			return false
+		}
+		if strings.Contains(g[i], "**") {
+			return match(i+1, j) || match(i, j+1)
+		}
+		return aclGlob("/"+g[i]).MatchString("/"+p[j]) && match(i+1, j+1)
+	}
+	return match(0, 0)
+}
+
+// AclVisible tells if a path should be shown to the user
+func AclVisible(ctx *App, path string) bool {
+	for _, op := range []string{ACL_READ, ACL_WRITE, ACL_UPLOAD, ACL_SHARE} {
+		if AclAllow(ctx, path, op) {
+			return true
+		}
+	}
+	return false
+}
+
+func aclRules(session map[string]string) []AclRule {
+	rules := []AclRule{}
+	for _, conn := range ConnMatch(session) {
+		raw, ok := conn["acl"]
+		if ok == false || raw == nil {
+			continue
+		}
+		key := fmt.Sprintf("%v", raw)
+		aclCache.RLock()
+		r, ok := aclCache.rules[key]
+		aclCache.RUnlock()
+		if ok == false {
+			r = aclParse(raw)
+			aclCache.Lock()
+			aclCache.rules[key] = r
+			aclCache.Unlock()
+		}
+		rules = append(rules, r...)
+	}
+	return rules
+}
+
+func aclParse(raw interface{}) []AclRule {
+	list, ok := raw.([]interface{})
+	if ok == false {
+		Log.Warning("acl::parse expected a list of rules")
+		return []AclRule{}
+	}
+	rules := make([]AclRule, 0, len(list))
+	for i := range list {
+		r, ok := list[i].(map[string]interface{})
+		if ok == false {
+			Log.Warning("acl::parse invalid rule #%d", i)
+			continue
+		}
+		rule := AclRule{
+			Path:    NewStringFromInterface(r["path"]),
+			Subject: NewStringFromInterface(r["subject"]),
+			Allow:   make(map[string]bool),
+		}
+		if rule.Path == "" {
+			Log.Warning("acl::parse missing path in rule #%d", i)
+			continue
+		}
+		if rule.Subject == "" {
+			rule.Subject = "*"
+		}
+		ops := []string{}
+		switch allow := r["allow"].(type) {
+		case string:
+			ops = strings.Split(allow, ",")
+		case []interface{}:
+			for j := range allow {
+				ops = append(ops, NewStringFromInterface(allow[j]))
+			}
+		}
+		for _, op := range ops {
+			op = strings.TrimSpace(op)
+			if alias, ok := aclAliases[op]; ok {
+				for _, o := range alias {
+					rule.Allow[o] = true
+				}
+				continue
+			}
+			rule.Allow[op] = true
+		}
+		rule.pattern = aclGlob(rule.Path)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func aclGlobNormalise(glob string) string {
+	if strings.HasPrefix(glob, "/") == false && strings.HasPrefix(glob, "**") == false {
+		return "/**/" + glob
+	}
+	return glob
+}
+
+func aclGlob(glob string) *regexp.Regexp {
+	glob = aclGlobNormalise(glob)
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**") == false {
+				b.WriteString("[^/]*")
+				continue
+			}
+			i += 1
+			if strings.HasPrefix(glob[i+1:], "/") {
+				// "/**/" also match no folder at all
+				b.WriteString("(.*/)?")
+				i += 1
+			} else {
+				b.WriteString(".*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	pattern := b.String()
+	if strings.HasSuffix(pattern, "/.*") {
+		// "/folder/**" also match the folder itself
+		pattern = strings.TrimSuffix(pattern, "/.*") + "(/.*)?"
+	} else if strings.HasSuffix(pattern, "/") == false {
+		// a rule on "/folder" also apply to "/folder/" as folders are given with a trailing slash
+		pattern += "/?"
+	}
+	return regexp.MustCompile(pattern + "$")
+}
+
+func aclSubjectMatch(ctx *App, subject string) bool {
+	if subject == "*" {
+		return true
+	} else if subject == "share" {
+		return ctx.Share.Id != ""
+	} else if strings.HasPrefix(subject, "user:") {
+		if ctx.Share.Id != "" {
+			return false
+		}
+		// the user name of a regular login is whatever was typed in, many backends never check it
+		// against the credentials. Only the single sign on flow gives an identity we can trust
+		if ctx.Session["sso"] == "" {
+			return false
+		}
+		user := strings.TrimPrefix(subject, "user:")
+		return user != "" && (ctx.Session["user"] == user || ctx.Session["username"] == user)
+	} else if strings.HasPrefix(subject, "group:") {
+		if ctx.Share.Id != "" {
+			return false
+		}
+		group := strings.TrimPrefix(subject, "group:")
+		for _, g := range strings.Split(ctx.Session["groups"], ",") {
+			if g != "" && g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
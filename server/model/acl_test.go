@@ -0,0 +1,109 @@
+package model
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"os"
+	"testing"
+)
+
+var aclTestTree = map[string][]os.FileInfo{
+	"/":          {File{FName: "docs", FType: "directory"}, File{FName: "app", FType: "directory"}},
+	"/docs/":     {File{FName: "notes.txt", FType: "file"}, File{FName: "old", FType: "directory"}},
+	"/docs/old/": {File{FName: "notes.txt", FType: "file"}},
+	"/app/":      {File{FName: "main.go", FType: "file"}, File{FName: ".env", FType: "file"}},
+}
+
+func aclTestSetup() (*App, func()) {
+	conn := Config.Conn
+	Config.Conn = []map[string]interface{}{{
+		"type": "dummy_acl_test",
+		"acl": []interface{}{
+			map[string]interface{}{"path": "**/.env", "allow": "hide"},
+			map[string]interface{}{"path": "/finance/**", "allow": "read-only"},
+		},
+	}}
+	ctx := &App{
+		Session: map[string]string{"type": "dummy_acl_test"},
+		Backend: DummyBackend{
+			OnLs: func(path string) ([]os.FileInfo, error) {
+				if files, ok := aclTestTree[path]; ok {
+					return files, nil
+				}
+				return nil, ErrNotFound
+			},
+		},
+	}
+	return ctx, func() {
+		Config.Conn = conn
+	}
+}
+
+func TestAclAllowRecursive(t *testing.T) {
+	ctx, teardown := aclTestSetup()
+	defer teardown()
+	for _, tc := range []struct {
+		path     string
+		expected bool
+	}{
+		{"/docs/", true},
+		{"/docs/old/", true},
+		{"/app/main.go", true},
+		{"/app/.env", false},
+		{"/app/", false},
+		{"/", false},
+		{"/finance/", false},
+		{"/finance/report.pdf", false},
+	} {
+		if AclAllowRecursive(ctx, tc.path, ACL_WRITE) != tc.expected {
+			t.Errorf("rm '%s': expected %t", tc.path, tc.expected)
+		}
+	}
+}
+
+func TestAclAllowRecursiveTo(t *testing.T) {
+	ctx, teardown := aclTestSetup()
+	defer teardown()
+	for _, tc := range []struct {
+		from     string
+		to       string
+		expected bool
+	}{
+		{"/docs/", "/archive/", true},
+		{"/docs/", "/archive", true},
+		{"/docs/", "/finance/docs/", false},
+		{"/app/", "/archive/", false},
+		{"/docs/notes.txt", "/.env", false},
+	} {
+		if AclAllowRecursiveTo(ctx, tc.from, tc.to, ACL_WRITE) != tc.expected {
+			t.Errorf("mv '%s' '%s': expected %t", tc.from, tc.to, tc.expected)
+		}
+	}
+
+	ctx.Backend = nil
+	if AclAllowRecursive(ctx, "/docs/", ACL_WRITE) == true {
+		t.Errorf("a folder that can't be listed mustn't be allowed")
+	}
+}
+
+func TestAclGlobBelow(t *testing.T) {
+	for _, tc := range []struct {
+		glob     string
+		folder   string
+		expected bool
+	}{
+		{"/**/.env", "/", true},
+		{"/**/.env", "/docs/", true},
+		{"/finance/**", "/", true},
+		{"/finance/**", "/docs/", false},
+		{"/finance/*.pdf", "/finance/", true},
+		{"/finance/*.pdf", "/finance/2020/", false},
+		{"/finance/*.pdf", "/", true},
+		{"/finance/", "/finance/", false},
+		{"/home/*/secret/**", "/home/alice/", true},
+		{"/home/*/secret/**", "/home/alice/public/", false},
+	} {
+		if aclGlobBelow(tc.glob, tc.folder) != tc.expected {
+			t.Errorf("'%s' below '%s': expected %t", tc.glob, tc.folder, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Named admin accounts, each with its own password and a set of roles restricting which part of the
+ * admin console can be used. The password from `auth.admin` is still accepted for an account named
+ * "admin" with every role so that existing installations keep working
+ */
+type AdminUser struct {
+	Username  string     `json:"username"`
+	Password  string     `json:"-"`
+	Totp      string     `json:"-"`
+	HasTotp   bool       `json:"totp"`
+	Roles     []string   `json:"roles"`
+	Created   time.Time  `json:"created"`
+	LastLogin *time.Time `json:"last_login,omitempty"`
+}
+
+type AdminAudit struct {
+	Time     time.Time `json:"time"`
+	Username string    `json:"username"`
+	Ip       string    `json:"ip"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+}
+
+const ADMIN_LEGACY_USERNAME = "admin"
+
+var ErrAdminTotpRequired = NewError("Missing second factor", 401)
+
+// a valid hash compared against when the account doesn't exist so that usernames can't be guessed from timing
+var adminDummyHash, _ = bcrypt.GenerateFromPassword([]byte(RandomString(16)), bcrypt.DefaultCost)
+
+func AdminUserCount() (int, error) {
+	var n int
+	if err := DB.QueryRow("SELECT count(*) FROM AdminUser").Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// AdminEnabled is false when no admin account exists yet, which is the case during the initial setup.
+// When the accounts can't be read, we can't tell and the error must be treated as a refusal
+func AdminEnabled() (bool, error) {
+	if Config.Get("auth.admin").String() != "" {
+		return true, nil
+	}
+	n, err := AdminUserCount()
+	if err != nil {
+		Log.Warning("admin::enabled %s", err.Error())
+		return true, NewError("Can't read the admin accounts", 500)
+	}
+	return n > 0, nil
+}
+
+func AdminUserList() ([]AdminUser, error) {
+	rows, err := DB.Query("SELECT username, roles, totp, created, last_login FROM AdminUser ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []AdminUser{}
+	for rows.Next() {
+		var u AdminUser
+		var roles string
+		var totp sql.NullString
+		var lastLogin sql.NullTime
+		if err = rows.Scan(&u.Username, &roles, &totp, &u.Created, &lastLogin); err != nil {
+			return nil, err
+		}
+		u.Roles = adminRolesParse(roles)
+		u.HasTotp = totp.String != ""
+		if lastLogin.Valid {
+			u.LastLogin = &lastLogin.Time
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func AdminUserGet(username string) (AdminUser, error) {
+	var u AdminUser
+	var roles string
+	var totp sql.NullString
+	var lastLogin sql.NullTime
+	err := DB.QueryRow(
+		"SELECT username, password, roles, totp, created, last_login FROM AdminUser WHERE username = ?", username,
+	).Scan(&u.Username, &u.Password, &roles, &totp, &u.Created, &lastLogin)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return u, ErrNotFound
+		}
+		return u, err
+	}
+	u.Roles = adminRolesParse(roles)
+	u.Totp = totp.String
+	u.HasTotp = totp.String != ""
+	if lastLogin.Valid {
+		u.LastLogin = &lastLogin.Time
+	}
+	if u.Username == ADMIN_LEGACY_USERNAME && u.Password == "" {
+		// the account from `auth.admin` only keeps its second factor here, the password stays in the config
+		u.Password = Config.Get("auth.admin").String()
+	}
+	return u, nil
+}
+
+func (this AdminUser) HasRole(role string) bool {
+	return NewAdminToken(this.Username, this.Roles).HasRole(role)
+}
+
+// AdminUserUpsert creates or updates an account, an empty password keeps the existing one
+func AdminUserUpsert(username string, password string, roles []string) error {
+	if regexp.MustCompile(`^[a-zA-Z0-9\.\-_@]{1,64}$`).MatchString(username) == false {
+		return NewError("Invalid username", 400)
+	}
+	for _, role := range roles {
+		if adminRoleExists(role) == false {
+			return NewError(fmt.Sprintf("Unknown role '%s'", role), 400)
+		}
+	}
+	if password == "" {
+		res, err := DB.Exec("UPDATE AdminUser SET roles = ? WHERE username = ?", strings.Join(roles, ","), username)
+		if err != nil {
+			return err
+		} else if n, _ := res.RowsAffected(); n == 0 {
+			return NewError("Missing password", 400)
+		}
+		return nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec(
+		"INSERT INTO AdminUser(username, password, roles) VALUES(?, ?, ?) ON CONFLICT(username) DO UPDATE SET password = excluded.password, roles = excluded.roles",
+		username, string(hash), strings.Join(roles, ","),
+	)
+	return err
+}
+
+func AdminUserDelete(username string) error {
+	res, err := DB.Exec("DELETE FROM AdminUser WHERE username = ?", username)
+	if err != nil {
+		return err
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AdminUserAuthenticate returns the account matching the credentials, accounts with a second
+// factor also need a valid code which can't be used again
+func AdminUserAuthenticate(username string, password string, code string) (AdminUser, error) {
+	return adminUserAuthenticate(username, password, code, true)
+}
+
+func adminUserAuthenticate(username string, password string, code string, once bool) (AdminUser, error) {
+	if username == "" {
+		username = ADMIN_LEGACY_USERNAME
+	}
+	u, err := AdminUserGet(username)
+	if err == ErrNotFound && username == ADMIN_LEGACY_USERNAME && Config.Get("auth.admin").String() != "" {
+		u = adminLegacyUser()
+	} else if err == ErrNotFound {
+		bcrypt.CompareHashAndPassword(adminDummyHash, []byte(password))
+		return u, ErrInvalidPassword
+	} else if err != nil {
+		return u, err
+	}
+	if err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		return u, ErrInvalidPassword
+	}
+	if u.Totp != "" {
+		if code == "" {
+			return u, ErrAdminTotpRequired
+		}
+		secret, err := DecryptString(SECRET_KEY_DERIVATE_FOR_ADMIN, u.Totp)
+		if err != nil {
+			return u, err
+		}
+		counter := TotpCounter(secret, code)
+		if counter == -1 {
+			return u, NewError("Invalid code", 403)
+		}
+		if once {
+			adminTotpUsed.Lock()
+			if counter <= adminTotpUsed.counter[u.Username] {
+				adminTotpUsed.Unlock()
+				return u, NewError("Code already used, wait for the next one", 403)
+			}
+			adminTotpUsed.counter[u.Username] = counter
+			adminTotpUsed.Unlock()
+		}
+	}
+	DB.Exec("UPDATE AdminUser SET last_login = datetime('now') WHERE username = ?", u.Username)
+	return u, nil
+}
+
+/*
+ * Basic auth has no room for a second factor, accounts with TOTP enabled append their current
+ * code to the password, eg: "mypassword123456". The browser sends the same credentials with every
+ * request, the code is accepted again for as long as it's valid
+ */
+func AdminUserAuthenticateBasic(username string, password string) (AdminUser, error) {
+	code := ""
+	if u, err := AdminUserGet(username); err == nil && u.Totp != "" && len(password) > 6 {
+		password, code = password[:len(password)-6], password[len(password)-6:]
+	}
+	return adminUserAuthenticate(username, password, code, false)
+}
+
+// AdminUserTotpSet enables the second factor of an account, an empty secret disables it
+func AdminUserTotpSet(username string, secret string) error {
+	encrypted := ""
+	if secret != "" {
+		var err error
+		if encrypted, err = EncryptString(SECRET_KEY_DERIVATE_FOR_ADMIN, secret); err != nil {
+			return err
+		}
+	}
+	if _, err := AdminUserGet(username); err == ErrNotFound && username == ADMIN_LEGACY_USERNAME && Config.Get("auth.admin").String() != "" {
+		// the account from `auth.admin` has nowhere else to keep its secret. Its password isn't copied,
+		// it's still read from the config so that changing it there keeps working
+		u := adminLegacyUser()
+		_, err = DB.Exec(
+			"INSERT INTO AdminUser(username, password, roles, totp) VALUES(?, '', ?, ?)",
+			u.Username, strings.Join(u.Roles, ","), encrypted,
+		)
+		return err
+	} else if err != nil {
+		return err
+	}
+	_, err := DB.Exec("UPDATE AdminUser SET totp = ? WHERE username = ?", encrypted, username)
+	return err
+}
+
+// re-encrypt the second factor of admin accounts with the current secret key
+func AdminUserTotpReencrypt() (updated int, failed int, err error) {
+	rows, err := DB.Query("SELECT username, totp FROM AdminUser WHERE totp IS NOT NULL AND totp != ''")
+	if err != nil {
+		return 0, 0, err
+	}
+	secrets := make(map[string]string)
+	for rows.Next() {
+		var username, totp string
+		rows.Scan(&username, &totp)
+		secrets[username] = totp
+	}
+	rows.Close()
+	for username, totp := range secrets {
+		secret, err := DecryptString(SECRET_KEY_DERIVATE_FOR_ADMIN, totp)
+		if err != nil {
+			failed += 1
+			continue
+		}
+		if err = AdminUserTotpSet(username, secret); err != nil {
+			failed += 1
+			continue
+		}
+		updated += 1
+	}
+	return updated, failed, nil
+}
+
+// the last time step used with the second factor of each account, a code can only be used once
+var adminTotpUsed = struct {
+	sync.Mutex
+	counter map[string]int64
+}{counter: make(map[string]int64)}
+
+// AdminTokenFromRequest gives the token of the admin making the request with the roles the account
+// has now rather than the ones it had when the cookie was issued, deleted accounts are refused
+func AdminTokenFromRequest(req *http.Request) (AdminToken, error) {
+	token, err := NewAdminTokenFromRequest(req)
+	if err != nil {
+		return token, err
+	} else if token.IsValid() == false || token.IsAdmin() == false {
+		return token, ErrPermissionDenied
+	}
+	u, err := AdminUserGet(token.Username)
+	if err == ErrNotFound && token.Username == ADMIN_LEGACY_USERNAME && Config.Get("auth.admin").String() != "" {
+		u = adminLegacyUser()
+	} else if err != nil {
+		return token, ErrPermissionDenied
+	}
+	token.Roles = u.Roles
+	return token, nil
+}
+
+func adminLegacyUser() AdminUser {
+	return AdminUser{
+		Username: ADMIN_LEGACY_USERNAME,
+		Password: Config.Get("auth.admin").String(),
+		Roles:    []string{ADMIN_ROLE_ADMIN},
+	}
+}
+
+func AdminAuditInsert(a AdminAudit) error {
+	_, err := DB.Exec(
+		"INSERT INTO AdminAudit(username, ip, method, path, status) VALUES(?, ?, ?, ?, ?)",
+		a.Username, a.Ip, a.Method, a.Path, a.Status,
+	)
+	return err
+}
+
+func AdminAuditList(username string, limit int, offset int) ([]AdminAudit, error) {
+	rows, err := DB.Query(
+		"SELECT time, username, ip, method, path, status FROM AdminAudit WHERE ? = '' OR username = ? ORDER BY time DESC LIMIT ? OFFSET ?",
+		username, username, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	logs := []AdminAudit{}
+	for rows.Next() {
+		var a AdminAudit
+		rows.Scan(&a.Time, &a.Username, &a.Ip, &a.Method, &a.Path, &a.Status)
+		logs = append(logs, a)
+	}
+	return logs, nil
+}
+
+func adminRolesParse(roles string) []string {
+	r := []string{}
+	for _, role := range strings.Split(roles, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			r = append(r, role)
+		}
+	}
+	return r
+}
+
+func adminRoleExists(role string) bool {
+	for _, r := range ADMIN_ROLES {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
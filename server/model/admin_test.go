@@ -0,0 +1,51 @@
+package model
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+	"time"
+)
+
+func adminTestLegacyPassword(t *testing.T, password string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.Get("auth.admin").Set(string(hash))
+}
+
+func TestAdminLegacyTotp(t *testing.T) {
+	previous := Config.Get("auth.admin").String()
+	defer Config.Get("auth.admin").Set(previous)
+	AdminUserDelete(ADMIN_LEGACY_USERNAME)
+	defer AdminUserDelete(ADMIN_LEGACY_USERNAME)
+	adminTotpUsed.Lock()
+	delete(adminTotpUsed.counter, ADMIN_LEGACY_USERNAME)
+	adminTotpUsed.Unlock()
+
+	adminTestLegacyPassword(t, "first")
+	secret := NewTotpSecret()
+	if err := AdminUserTotpSet(ADMIN_LEGACY_USERNAME, secret); err != nil {
+		t.Fatal(err)
+	}
+	// the password is changed from the config after the second factor was enabled
+	adminTestLegacyPassword(t, "second")
+	code, _ := TotpCode(secret, time.Now())
+
+	if _, err := AdminUserAuthenticate("", "first", code); err != ErrInvalidPassword {
+		t.Errorf("the previous password from the config must be refused, got %v", err)
+	}
+	if _, err := AdminUserAuthenticate("", "second", ""); err != ErrAdminTotpRequired {
+		t.Errorf("expected the second factor to be required, got %v", err)
+	}
+	if _, err := AdminUserAuthenticate("", "second", code); err != nil {
+		t.Fatalf("expected the login to work with the password from the config, got %s", err.Error())
+	}
+	if _, err := AdminUserAuthenticate("", "second", code); err == nil {
+		t.Errorf("a code mustn't be used twice")
+	}
+	if _, err := AdminUserAuthenticateBasic(ADMIN_LEGACY_USERNAME, "second"+code); err != nil {
+		t.Errorf("basic auth sends the same code with every request, got %s", err.Error())
+	}
+}
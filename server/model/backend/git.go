@@ -29,6 +29,7 @@ func init() {
 	Backend.Register("git", Git{})
 
 	GitCache = NewAppCache()
+	MetricsCache("git", &GitCache)
 	cachePath := filepath.Join(GetCurrentDir(), GitCachePath)
 	os.RemoveAll(cachePath)
 	os.MkdirAll(cachePath, os.ModePerm)
@@ -92,10 +93,6 @@ func (git Git) Init(params map[string]string, app *App) (IBackend, error) {
 	if p.committerEmail == "" {
 		p.committerEmail = "https://filestash.app"
 	}
-	if len(params["password"]) > 2700 {
-		return nil, NewError("Your password doesn't fit in a cookie :/", 500)
-	}
-
 	hash := GenerateID(app)	
 	p.basePath = GetAbsolutePath(GitCachePath + "repo_" + hash + "/")
 
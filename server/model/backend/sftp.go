@@ -22,6 +22,7 @@ func init() {
 	Backend.Register("sftp", Sftp{})
 
 	SftpCache = NewAppCache()
+	MetricsCache("sftp", &SftpCache)
 	SftpCache.OnEvict(func(key string, value interface{}) {
 		c := value.(*Sftp)
 		c.Close()
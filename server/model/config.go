@@ -0,0 +1,230 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Every configuration accepted from the admin console is kept in the history so that a bad save can be
+ * reverted. Secrets never make it to the history as is: they are replaced by a keyed hash, which is
+ * enough to see if they changed and to find them back in the current config when rolling back
+ */
+const (
+	CONFIG_REVISION_MAX  = 500
+	CONFIG_SECRET_PREFIX = "hash:"
+)
+
+type ConfigRevision struct {
+	Id       int             `json:"id"`
+	Time     time.Time       `json:"time"`
+	Username string          `json:"username"`
+	Ip       string          `json:"ip"`
+	Config   json.RawMessage `json:"config,omitempty"`
+}
+
+type ConfigChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"`
+	From interface{} `json:"from,omitempty"`
+	To   interface{} `json:"to,omitempty"`
+}
+
+// ConfigRevisionInsert records a new revision unless the config is the same as the last one
+func ConfigRevisionInsert(username string, ip string, config []byte) error {
+	if gjson.ValidBytes(config) == false {
+		return ErrNotValid
+	}
+	config = configRedact(config)
+	var last string
+	err := DB.QueryRow("SELECT config FROM ConfigRevision ORDER BY id DESC LIMIT 1").Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	} else if err == nil && reflect.DeepEqual(configFlatten([]byte(last)), configFlatten(config)) {
+		return nil
+	}
+	if _, err = DB.Exec(
+		"INSERT INTO ConfigRevision(username, ip, config) VALUES(?, ?, ?)",
+		username, ip, string(config),
+	); err != nil {
+		return err
+	}
+	_, err = DB.Exec(
+		"DELETE FROM ConfigRevision WHERE id NOT IN (SELECT id FROM ConfigRevision ORDER BY id DESC LIMIT ?)",
+		CONFIG_REVISION_MAX,
+	)
+	return err
+}
+
+func ConfigRevisionList(limit int, offset int) ([]ConfigRevision, error) {
+	rows, err := DB.Query(
+		"SELECT id, time, username, ip FROM ConfigRevision ORDER BY id DESC LIMIT ? OFFSET ?",
+		limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := []ConfigRevision{}
+	for rows.Next() {
+		var r ConfigRevision
+		if err = rows.Scan(&r.Id, &r.Time, &r.Username, &r.Ip); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, nil
+}
+
+func ConfigRevisionGet(id int) (ConfigRevision, error) {
+	var r ConfigRevision
+	var config string
+	err := DB.QueryRow(
+		"SELECT id, time, username, ip, config FROM ConfigRevision WHERE id = ?", id,
+	).Scan(&r.Id, &r.Time, &r.Username, &r.Ip, &config)
+	if err == sql.ErrNoRows {
+		return r, ErrNotFound
+	} else if err != nil {
+		return r, err
+	}
+	r.Config = json.RawMessage(config)
+	return r, nil
+}
+
+// ConfigDiff gives the keys that are different from one config to another
+func ConfigDiff(from []byte, to []byte) []ConfigChange {
+	a := configFlatten(configRedact(from))
+	b := configFlatten(configRedact(to))
+	changes := []ConfigChange{}
+	for key, value := range a {
+		if other, ok := b[key]; ok == false {
+			changes = append(changes, ConfigChange{Path: key, Op: "removed", From: value})
+		} else if reflect.DeepEqual(value, other) == false {
+			changes = append(changes, ConfigChange{Path: key, Op: "changed", From: value, To: other})
+		}
+	}
+	for key, value := range b {
+		if _, ok := a[key]; ok == false {
+			changes = append(changes, ConfigChange{Path: key, Op: "added", To: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// ConfigRevisionRestore gives the config of a revision with its secrets taken back from the current
+// config. Secrets that can't be found anymore are given back so the admin can fill them up again:
+// connections don't get any as the order of the list might have changed, other keys keep their
+// current value
+func ConfigRevisionRestore(id int, current []byte) ([]byte, []string, error) {
+	revision, err := ConfigRevisionGet(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	secrets := make(map[string]bool)
+	for _, key := range configSecretKeys(current) {
+		if value := gjson.GetBytes(current, key).String(); value != "" {
+			secrets[value] = true
+		}
+	}
+
+	config := []byte(revision.Config)
+	missing := []string{}
+	for key, value := range configFlatten(config) {
+		hash, ok := value.(string)
+		if ok == false || strings.HasPrefix(hash, CONFIG_SECRET_PREFIX) == false {
+			continue
+		}
+		found := false
+		for secret := range secrets {
+			if configSecretMatch(hash, secret) {
+				config, _ = sjson.SetBytes(config, key, secret)
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		missing = append(missing, key)
+		if value := gjson.GetBytes(current, key); value.Exists() && strings.HasPrefix(key, "connections.") == false {
+			config, _ = sjson.SetBytes(config, key, value.Value())
+		} else {
+			config, _ = sjson.DeleteBytes(config, key)
+		}
+	}
+	sort.Strings(missing)
+	return config, missing, nil
+}
+
+func configRedact(config []byte) []byte {
+	for _, key := range configSecretKeys(config) {
+		value := gjson.GetBytes(config, key)
+		if value.Type != gjson.String || value.String() == "" || strings.HasPrefix(value.String(), CONFIG_SECRET_PREFIX) {
+			continue
+		}
+		config, _ = sjson.SetBytes(config, key, configSecretHash(value.String(), SECRET_KEY_DERIVATE_FOR_HASH))
+	}
+	return config
+}
+
+func configSecretKeys(config []byte) []string {
+	keys := Config.Secrets()
+	for i, conn := range gjson.GetBytes(config, "connections").Array() {
+		for _, key := range vaultSensitiveKeys {
+			if conn.Get(key).Exists() {
+				keys = append(keys, "connections."+strconv.Itoa(i)+"."+key)
+			}
+		}
+	}
+	return keys
+}
+
+func configSecretHash(secret string, key string) string {
+	return CONFIG_SECRET_PREFIX + Hash(key+secret, 32)
+}
+
+func configSecretMatch(hash string, secret string) bool {
+	for _, key := range SecretKeyring(SECRET_KEY_DERIVATE_FOR_HASH) {
+		if configSecretHash(secret, key) == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func configFlatten(config []byte) map[string]interface{} {
+	flat := make(map[string]interface{})
+	var recur func(res gjson.Result, prefix string)
+	recur = func(res gjson.Result, prefix string) {
+		i := 0
+		res.ForEach(func(key, value gjson.Result) bool {
+			k := strings.NewReplacer(".", `\.`, "*", `\*`, "?", `\?`).Replace(key.String())
+			if res.IsArray() {
+				k = strconv.Itoa(i)
+			}
+			i += 1
+			if prefix != "" {
+				k = prefix + "." + k
+			}
+			if value.IsObject() || value.IsArray() {
+				recur(value, k)
+				return true
+			}
+			flat[k] = value.Value()
+			return true
+		})
+	}
+	recur(gjson.ParseBytes(config), "")
+	return flat
+}
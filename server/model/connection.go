@@ -0,0 +1,181 @@
+package model
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+ * Checking a connection goes through the same steps as a user login: the backend gets initialised
+ * and we list the content of the home folder. Each step is timed and the first error is given a
+ * category so that admins know where to look at
+ */
+const (
+	CONN_ERR_DNS        = "dns"
+	CONN_ERR_TLS        = "tls"
+	CONN_ERR_NETWORK    = "network"
+	CONN_ERR_TIMEOUT    = "timeout"
+	CONN_ERR_AUTH       = "auth"
+	CONN_ERR_PERMISSION = "permission"
+	CONN_ERR_CONFIG     = "config"
+	CONN_ERR_UNKNOWN    = "unknown"
+)
+
+type ConnectionTestStep struct {
+	Name    string `json:"name"`
+	Latency int64  `json:"latency"`
+}
+
+type ConnectionTestError struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+type ConnectionTestResult struct {
+	Ok      bool                 `json:"ok"`
+	Latency int64                `json:"latency"`
+	Steps   []ConnectionTestStep `json:"steps"`
+	Home    string               `json:"home,omitempty"`
+	Error   *ConnectionTestError `json:"error,omitempty"`
+}
+
+// a step giving up on its timeout keeps running in the background as backends can't be
+// interrupted. The number of those is capped so that testing an unresponsive server again and
+// again doesn't pile up goroutines
+const CONN_TEST_MAX_PENDING = 4
+
+var connTestPending = make(chan struct{}, CONN_TEST_MAX_PENDING)
+
+// ConnectionTest connects to a backend the same way a user would, which means the connection must
+// be part of the config. The test gives up after the timeout, leaving the backend to finish on its
+// own
+func ConnectionTest(params map[string]string, timeout time.Duration) ConnectionTestResult {
+	result := ConnectionTestResult{Steps: []ConnectionTestStep{}}
+	start := time.Now()
+	fail := func(err error) ConnectionTestResult {
+		result.Latency = time.Since(start).Milliseconds()
+		result.Error = &ConnectionTestError{
+			Category: ConnectionErrorCategory(err),
+			Message:  err.Error(),
+		}
+		return result
+	}
+	step := func(name string, fn func() error) error {
+		select {
+		case connTestPending <- struct{}{}:
+		default:
+			return NewError("Too many connection tests are still running", 429)
+		}
+		t := time.Now()
+		done := make(chan error, 1)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					done <- NewError("backend panic", 500)
+				}
+				<-connTestPending
+			}()
+			done <- fn()
+		}()
+		timer := time.NewTimer(timeout - time.Since(start))
+		defer timer.Stop()
+		select {
+		case err := <-done:
+			result.Steps = append(result.Steps, ConnectionTestStep{name, time.Since(t).Milliseconds()})
+			return err
+		case <-timer.C:
+			return NewError("Timeout while waiting for the "+name, 504)
+		}
+	}
+
+	if _, ok := Backend.Drivers()[params["type"]]; ok == false {
+		return fail(NewError("Unknown backend type", 400))
+	}
+	// the steps left running after a timeout keep using the params, they get their own copy
+	conn := make(map[string]string, len(params))
+	for key, value := range params {
+		conn[key] = value
+	}
+	params = conn
+	params["path"] = EnforceDirectory(params["path"])
+
+	var backend IBackend
+	if err := step("init", func() (err error) {
+		backend, err = NewBackend(&App{Session: params}, params)
+		return err
+	}); err != nil {
+		return fail(err)
+	}
+	home := ""
+	if err := step("ls", func() (err error) {
+		home, err = GetHome(backend, params["path"])
+		return err
+	}); err != nil {
+		return fail(err)
+	}
+	result.Ok = true
+	result.Home = home
+	result.Latency = time.Since(start).Milliseconds()
+	return result
+}
+
+func ConnectionErrorCategory(err error) string {
+	var dnsErr *net.DNSError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certErr x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	var netErr net.Error
+	if errors.As(err, &dnsErr) {
+		return CONN_ERR_DNS
+	} else if errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &certErr) || errors.As(err, &recordErr) {
+		return CONN_ERR_TLS
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		return CONN_ERR_TIMEOUT
+	}
+	if err == ErrAuthenticationFailed {
+		return CONN_ERR_AUTH
+	} else if obj, ok := err.(interface{ Status() int }); ok {
+		switch obj.Status() {
+		case 400:
+			return CONN_ERR_CONFIG
+		case 401:
+			return CONN_ERR_AUTH
+		case 403:
+			return CONN_ERR_PERMISSION
+		case 504:
+			return CONN_ERR_TIMEOUT
+		}
+	}
+
+	// most backends don't keep the original error around, we're left with the message
+	msg := strings.ToLower(err.Error())
+	for _, c := range []struct {
+		category string
+		patterns []string
+	}{
+		{CONN_ERR_DNS, []string{"no such host", "server misbehaving", "lookup "}},
+		{CONN_ERR_TLS, []string{"x509", "tls", "certificate", "handshake"}},
+		{CONN_ERR_TIMEOUT, []string{"timeout", "timed out", "deadline exceeded"}},
+		{CONN_ERR_NETWORK, []string{"connection refused", "connection reset", "unreachable", "no route to host", "eof"}},
+		{CONN_ERR_AUTH, []string{"auth", "login", "password", "credential", "unauthori", "invalid account", "530 "}},
+		{CONN_ERR_PERMISSION, []string{"permission", "denied", "forbidden", "not allowed"}},
+		{CONN_ERR_CONFIG, []string{"missing", "invalid", "bucket", "not found"}},
+	} {
+		for _, pattern := range c.patterns {
+			if strings.Contains(msg, pattern) {
+				return c.category
+			}
+		}
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return CONN_ERR_NETWORK
+	}
+	return CONN_ERR_UNKNOWN
+}
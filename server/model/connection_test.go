@@ -0,0 +1,93 @@
+package model
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"os"
+	"testing"
+	"time"
+)
+
+var connTestRelease chan struct{}
+
+func init() {
+	Backend.Register("dummy_conn_test", DummyBackend{})
+	Backend.Register("dummy_conn_test_slow", DummyBackend{
+		OnLs: func(path string) ([]os.FileInfo, error) {
+			<-connTestRelease
+			return []os.FileInfo{}, nil
+		},
+	})
+}
+
+func connTestSetup() func() {
+	conn := Config.Conn
+	Config.Conn = []map[string]interface{}{
+		{"type": "dummy_conn_test", "label": "test", "hostname": "allowed.example.com"},
+		{"type": "dummy_conn_test_slow", "label": "slow", "hostname": "allowed.example.com"},
+	}
+	return func() {
+		Config.Conn = conn
+	}
+}
+
+func TestConnectionTestOk(t *testing.T) {
+	defer connTestSetup()()
+	result := ConnectionTest(map[string]string{
+		"type":     "dummy_conn_test",
+		"hostname": "allowed.example.com",
+	}, time.Second)
+	if result.Ok == false {
+		t.Fatalf("expected the test to pass, got %+v", result.Error)
+	} else if len(result.Steps) != 2 || result.Steps[0].Name != "init" || result.Steps[1].Name != "ls" {
+		t.Errorf("unexpected steps: %+v", result.Steps)
+	} else if result.Home != "/" {
+		t.Errorf("unexpected home: %s", result.Home)
+	}
+}
+
+func TestConnectionTestNotInConfig(t *testing.T) {
+	defer connTestSetup()()
+	result := ConnectionTest(map[string]string{
+		"type":     "dummy_conn_test",
+		"hostname": "elsewhere.example.com",
+	}, time.Second)
+	if result.Ok || result.Error == nil {
+		t.Fatalf("a connection outside of the config mustn't be tested")
+	}
+}
+
+func TestConnectionTestUnknownType(t *testing.T) {
+	defer connTestSetup()()
+	result := ConnectionTest(map[string]string{"type": "doesnt_exist"}, time.Second)
+	if result.Error == nil || result.Error.Category != CONN_ERR_CONFIG {
+		t.Fatalf("expected a config error, got %+v", result.Error)
+	}
+}
+
+func TestConnectionTestTimeout(t *testing.T) {
+	defer connTestSetup()()
+	connTestRelease = make(chan struct{})
+	params := map[string]string{"type": "dummy_conn_test_slow", "hostname": "allowed.example.com"}
+	result := ConnectionTest(params, 50*time.Millisecond)
+	if result.Error == nil || result.Error.Category != CONN_ERR_TIMEOUT {
+		t.Fatalf("expected a timeout, got %+v", result.Error)
+	}
+
+	// the steps which timed out are still running, past the cap new tests are refused
+	for i := 1; i < CONN_TEST_MAX_PENDING; i++ {
+		ConnectionTest(params, 10*time.Millisecond)
+	}
+	result = ConnectionTest(params, 10*time.Millisecond)
+	if result.Error == nil || result.Error.Message != "Too many connection tests are still running" {
+		t.Fatalf("expected the test to be refused, got %+v", result.Error)
+	}
+
+	close(connTestRelease)
+	deadline := time.Now().Add(time.Second)
+	for len(connTestPending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(connTestPending); n != 0 {
+		t.Fatalf("expected the pending steps to be done, got %d", n)
+	}
+}
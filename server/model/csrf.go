@@ -0,0 +1,122 @@
+package model
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"net/http"
+	"strings"
+)
+
+var (
+	CSRF_ENABLE       func() bool
+	LEGACY_GET_ROUTES func() bool
+)
+
+/*
+ * Protection against cross site request forgery with a signed double submit cookie: the server gives
+ * a token in a cookie readable from javascript which the client sends back in the X-Csrf-Token header
+ * of every request that change something. The token is signed together with the session cookie so
+ * that a token obtained with one session can't be reused with another one
+ */
+const CSRF_HEADER = "X-Csrf-Token"
+
+func init() {
+	CSRF_ENABLE = func() bool {
+		return Config.Get("features.protection.csrf").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "csrf"
+			f.Type = "boolean"
+			f.Default = true
+			f.Description = "Require a CSRF token on requests changing data. Disable only if a custom client can't send it"
+			return f
+		}).Bool()
+	}
+	CSRF_ENABLE()
+	LEGACY_GET_ROUTES = func() bool {
+		return Config.Get("features.protection.legacy_get_routes").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "legacy_get_routes"
+			f.Type = "boolean"
+			f.Default = true
+			f.Description = "Deprecated: accept GET requests on the routes that move, delete or create files"
+			return f
+		}).Bool()
+	}
+	LEGACY_GET_ROUTES()
+}
+
+// CsrfVerify is called on every request, it gives a new token to the client when needed and checks the
+// one sent back on requests that aren't safe
+func CsrfVerify(res http.ResponseWriter, req *http.Request) error {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		csrfToken(res, req)
+		return nil
+	}
+	if req.URL.Query().Get("sig") != "" {
+		// signed urls aren't sent automatically by the browser, as long as the signature is valid
+		// the request can't be forged
+		if _, err := SignedUrlVerify(req); err == nil {
+			csrfToken(res, req)
+			return nil
+		}
+	}
+	return CsrfRequire(res, req)
+}
+
+// CsrfRequire checks the token whatever the method, which is what the routes changing something
+// on GET need
+func CsrfRequire(res http.ResponseWriter, req *http.Request) error {
+	if token := csrfToken(res, req); token == "" || req.Header.Get(CSRF_HEADER) != token {
+		return NewError("Invalid CSRF token, please try again", 403)
+	}
+	return nil
+}
+
+// csrfToken gives the valid token the client has, giving it a new one when it hasn't
+func csrfToken(res http.ResponseWriter, req *http.Request) string {
+	name, binding := csrfBinding(req)
+	if c, err := req.Cookie(name); err == nil && csrfTokenValid(binding, c.Value) {
+		return c.Value
+	}
+	CsrfCookieSet(res, name, binding)
+	return ""
+}
+
+// CsrfCookieSet gives the client a token bound to the value of a session cookie
+func CsrfCookieSet(res http.ResponseWriter, name string, binding string) {
+	nonce := RandomString(16)
+	http.SetCookie(res, &http.Cookie{
+		Name:     name,
+		Value:    nonce + "." + Sign(SECRET_KEY_DERIVATE_FOR_SIGNATURE, csrfPayload(nonce, binding)),
+		MaxAge:   60 * 60 * 24 * 30,
+		Path:     "/",
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func csrfBinding(req *http.Request) (string, string) {
+	name, session := COOKIE_NAME_CSRF, COOKIE_NAME_AUTH
+	if strings.HasPrefix(req.URL.Path, COOKIE_PATH_ADMIN) {
+		name, session = COOKIE_NAME_CSRF_ADMIN, COOKIE_NAME_ADMIN
+	}
+	if c, err := req.Cookie(session); err == nil {
+		return name, c.Value
+	}
+	return name, ""
+}
+
+func csrfTokenValid(binding string, token string) bool {
+	p := strings.SplitN(token, ".", 2)
+	if len(p) != 2 || p[0] == "" {
+		return false
+	}
+	return VerifySignature(SECRET_KEY_DERIVATE_FOR_SIGNATURE, csrfPayload(p[0], binding), p[1])
+}
+
+func csrfPayload(nonce string, binding string) string {
+	return "csrf\n" + nonce + "\n" + Hash(binding, 32)
+}
@@ -0,0 +1,37 @@
+package model
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCsrfForgedSignature(t *testing.T) {
+	defer secretKeySetup()()
+	for _, url := range []string{
+		"/admin/api/config?sig=x",
+		"/api/files/cat?path=/test.txt&sig=1",
+	} {
+		req := httptest.NewRequest("POST", url, nil)
+		req.AddCookie(&http.Cookie{Name: COOKIE_NAME_AUTH, Value: "session"})
+		req.AddCookie(&http.Cookie{Name: COOKIE_NAME_ADMIN, Value: "session"})
+		if err := CsrfVerify(httptest.NewRecorder(), req); err == nil {
+			t.Errorf("a forged signature mustn't skip the csrf check on %s", url)
+		}
+	}
+}
+
+func TestCsrfSignedUrl(t *testing.T) {
+	defer secretKeySetup()()
+	url, err := SignedUrlCreate(map[string]string{"type": "sftp", "username": "alice"}, "", "save", "/test.txt", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = CsrfVerify(httptest.NewRecorder(), httptest.NewRequest("POST", url, nil)); err != nil {
+		t.Errorf("a valid signed url doesn't need a csrf token, got %s", err.Error())
+	}
+	if err = CsrfVerify(httptest.NewRecorder(), httptest.NewRequest("POST", url+"x", nil)); err == nil {
+		t.Errorf("a tampered signature mustn't skip the csrf check")
+	}
+}
@@ -8,47 +8,58 @@ import (
 )
 
 func NewBackend(ctx *App, conn map[string]string) (IBackend, error) {
-	isAllowed := func() bool {
-		// by default, a hacker could use filestash to establish connections outside of what's
-		// define in the config file. We need to prevent this
-		possibilities := make([]map[string]interface{}, 0)
-		for i:=0; i< len(Config.Conn); i++ {
-			d := Config.Conn[i]
-			if d["type"] != conn["type"] {
-				continue
+	// by default, a hacker could use filestash to establish connections outside of what's
+	// define in the config file. We need to prevent this
+	allowed := ConnMatch(conn)
+	if len(allowed) == 0 {
+		return Backend.Get(BACKEND_NIL), ErrNotAllowed
+	}
+	conn, err := VaultOpen(conn, allowed)
+	if err != nil {
+		return Backend.Get(BACKEND_NIL), err
+	}
+	return Backend.Get(conn["type"]).Init(conn, ctx)
+}
+
+// ConnMatch gives the connections of the config a session could have been created from
+func ConnMatch(conn map[string]string) []map[string]interface{} {
+	possibilities := make([]map[string]interface{}, 0)
+	for i:=0; i< len(Config.Conn); i++ {
+		d := Config.Conn[i]
+		if d["type"] != conn["type"] {
+			continue
+		}
+		// sessions created through single sign on are built from a templated connection
+		ssoMatch := func(expected interface{}, actual string, prefix bool) bool {
+			tmpl, ok := expected.(string)
+			if ok == false || conn["sso"] == "" || conn["sso"] != fmt.Sprint(d["label"]) {
+				return false
 			}
-			if val, ok := d["hostname"]; ok == true {
-				if val != conn["hostname"] {
-					continue
-				}
+			return strings.Contains(tmpl, "{{") && ssoValueMatch(tmpl, actual, prefix)
+		}
+		if val, ok := d["hostname"]; ok == true {
+			if val != conn["hostname"] && ssoMatch(val, conn["hostname"], false) == false {
+				continue
 			}
-			if val, ok := d["path"]; ok == true {
-				if val == nil {
-					val = "/"
-				}
-				if configPath, ok := val.(string); ok == false {
-					continue
-				} else if strings.HasPrefix(conn["path"], configPath) == false {
-					continue
-				}
+		}
+		if val, ok := d["path"]; ok == true {
+			if val == nil {
+				val = "/"
 			}
-			if val, ok := d["url"]; ok == true {
-				if val != conn["url"] {
-					continue
-				}
+			if configPath, ok := val.(string); ok == false {
+				continue
+			} else if strings.HasPrefix(conn["path"], configPath) == false && ssoMatch(configPath, conn["path"], true) == false {
+				continue
 			}
-			possibilities = append(possibilities, Config.Conn[i])
 		}
-		if len(possibilities) > 0 {
-			return true
+		if val, ok := d["url"]; ok == true {
+			if val != conn["url"] && ssoMatch(val, conn["url"], false) == false {
+				continue
+			}
 		}
-		return false
+		possibilities = append(possibilities, Config.Conn[i])
 	}
-
-	if isAllowed() == false {
-		return Backend.Get(BACKEND_NIL), ErrNotAllowed
-	}
-	return Backend.Get(conn["type"]).Init(conn, ctx)
+	return possibilities
 }
 
 func GetHome(b IBackend, base string) (string, error) {
@@ -9,7 +9,11 @@ import (
 	"time"
 )
 
-var DB *sql.DB
+var (
+	DB *sql.DB
+	SHARE_LOG_RETENTION func() int
+	SHARE_ON_DELETE func() string
+)
 
 func init() {
 	cachePath := filepath.Join(GetCurrentDir(), DB_PATH)
@@ -34,8 +38,93 @@ func init() {
 		}
 	}
 
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ShareAccess(share VARCHAR(64), time DATETIME DEFAULT (datetime('now')), ip VARCHAR(64), user_agent VARCHAR(512), email VARCHAR(512), operation VARCHAR(32), path VARCHAR(1024), FOREIGN KEY (share) REFERENCES Share(id) ON UPDATE CASCADE ON DELETE CASCADE)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_share_access ON ShareAccess(share, time)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ShareUpload(share VARCHAR(64), path VARCHAR(1024), size INTEGER, email VARCHAR(512), time DATETIME DEFAULT (datetime('now')), FOREIGN KEY (share) REFERENCES Share(id) ON UPDATE CASCADE ON DELETE CASCADE)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_share_upload ON ShareUpload(share)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS AdminUser(username VARCHAR(64) PRIMARY KEY, password VARCHAR(128) NOT NULL, roles VARCHAR(256), totp VARCHAR(256), created DATETIME DEFAULT (datetime('now')), last_login DATETIME)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("ALTER TABLE AdminUser ADD COLUMN totp VARCHAR(256)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS AdminAudit(time DATETIME DEFAULT (datetime('now')), username VARCHAR(64), ip VARCHAR(64), method VARCHAR(8), path VARCHAR(1024), status INTEGER)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_admin_audit ON AdminAudit(time)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ApiToken(id VARCHAR(16) PRIMARY KEY, hash VARCHAR(64) UNIQUE NOT NULL, backend VARCHAR(16) NOT NULL, name VARCHAR(128), path VARCHAR(512), params JSON, auth VARCHAR(4093) NOT NULL, created DATETIME DEFAULT (datetime('now')), last_used DATETIME)"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_api_token ON ApiToken(backend)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS Session(id VARCHAR(64) PRIMARY KEY, backend VARCHAR(16), type VARCHAR(32), username VARCHAR(256), ip VARCHAR(64), user_agent VARCHAR(512), auth VARCHAR(4093) NOT NULL, created DATETIME DEFAULT (datetime('now')), last_seen DATETIME DEFAULT (datetime('now')))"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("CREATE INDEX IF NOT EXISTS idx_session ON Session(backend)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS Vault(kind VARCHAR(16) NOT NULL, name VARCHAR(64) NOT NULL, value TEXT NOT NULL, backend VARCHAR(16), created DATETIME DEFAULT (datetime('now')), last_used DATETIME, PRIMARY KEY(kind, name))"); err == nil {
+		stmt.Exec()
+		if stmt, err = DB.Prepare("ALTER TABLE Vault ADD COLUMN backend VARCHAR(16)"); err == nil {
+			stmt.Exec()
+		}
+	}
+
+	if stmt, err := DB.Prepare("CREATE TABLE IF NOT EXISTS ConfigRevision(id INTEGER PRIMARY KEY AUTOINCREMENT, time DATETIME DEFAULT (datetime('now')), username VARCHAR(64), ip VARCHAR(64), config TEXT NOT NULL)"); err == nil {
+		stmt.Exec()
+	}
+
+	SHARE_LOG_RETENTION = func() int {
+		return Config.Get("features.share.log_retention").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "log_retention"
+			f.Type = "number"
+			f.Default = 30
+			f.Description = "Number of days the access log of a shared link is kept before being deleted"
+			f.Placeholder = "Default: 30 days"
+			return f
+		}).Int()
+	}
+	SHARE_LOG_RETENTION()
+	SHARE_ON_DELETE = func() string {
+		return Config.Get("features.share.on_delete").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "on_delete"
+			f.Type = "select"
+			f.Default = "flag"
+			f.Opts = []string{"flag", "remove"}
+			f.Description = "What happens to shared links when the file or folder they point to gets deleted. Flagged links stop working until their owner save them again"
+			f.Placeholder = "Default: flag"
+			return f
+		}).String()
+	}
+	SHARE_ON_DELETE()
+
 	go func(){
-		autovacuum()
+		for {
+			autovacuum()
+		}
 	}()
 }
 
@@ -43,5 +132,9 @@ func autovacuum() {
 	if stmt, err := DB.Prepare("DELETE FROM Verification WHERE expire < datetime('now')"); err == nil {
 		stmt.Exec()
 	}
+	if stmt, err := DB.Prepare("DELETE FROM ShareAccess WHERE time < datetime('now', '-' || ? || ' days')"); err == nil {
+		stmt.Exec(SHARE_LOG_RETENTION())
+	}
+	vaultVacuum()
 	time.Sleep(6 * time.Hour)
 }
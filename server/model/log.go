@@ -0,0 +1,218 @@
+package model
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Querying the logs means going through the log files line by line, from the oldest rotated file
+ * to the current one. The most recent lines come first in the results which is what people are
+ * after when debugging an issue
+ */
+const (
+	LOG_QUERY_MAX_LIMIT  = 1000
+	LOG_QUERY_MAX_OFFSET = 100000
+)
+
+type LogQuery struct {
+	Level   string
+	From    time.Time
+	To      time.Time
+	Status  []string
+	Path    string
+	Backend string
+	Text    string
+}
+
+func (this LogQuery) Match(raw string, l LogLine) bool {
+	if this.Level != "" && LogLevel(l.Level) < LogLevel(this.Level) {
+		return false
+	} else if this.From.IsZero() == false && l.Time.Before(this.From) {
+		return false
+	} else if this.To.IsZero() == false && l.Time.After(this.To) {
+		return false
+	} else if this.Path != "" && strings.HasPrefix(logField(l, "path"), this.Path) == false {
+		return false
+	} else if this.Backend != "" && logField(l, "backend") != this.Backend {
+		return false
+	} else if this.Text != "" && strings.Contains(strings.ToLower(raw), strings.ToLower(this.Text)) == false {
+		return false
+	}
+	if len(this.Status) > 0 {
+		status := logField(l, "status")
+		if status == "" {
+			return false
+		}
+		match := false
+		for _, s := range this.Status {
+			// either an exact status or a class of status like "5xx"
+			if s == status || strings.HasSuffix(s, "xx") && len(s) == 3 && len(status) == 3 && s[0] == status[0] {
+				match = true
+				break
+			}
+		}
+		if match == false {
+			return false
+		}
+	}
+	return true
+}
+
+// LogSearch gives the lines matching the query, most recent first, along with the total number of
+// matching lines
+func LogSearch(q LogQuery, limit int, offset int) ([]LogLine, int, error) {
+	// a ring buffer is enough to keep the last matches while going through the files
+	ring := make([]LogLine, limit+offset)
+	total := 0
+	for _, path := range LogFiles() {
+		file, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, 0, err
+		}
+		if s, err := file.Stat(); err == nil && q.From.IsZero() == false && s.ModTime().Before(q.From) {
+			file.Close() // nothing got written in there since the beginning of the range
+			continue
+		}
+		// there's no stopping at the first line past the end of the range: the time of the lines
+		// isn't guaranteed to only go forward, eg: the clock got adjusted
+		err = logReadLines(file, func(raw string, l LogLine) error {
+			if q.Match(raw, l) == false {
+				return nil
+			}
+			if len(ring) > 0 {
+				ring[total%len(ring)] = l
+			}
+			total += 1
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	lines := make([]LogLine, 0, limit)
+	for i := offset; i < offset+limit && i < total; i++ {
+		lines = append(lines, ring[(total-1-i)%len(ring)])
+	}
+	return lines, total, nil
+}
+
+// LogTail follows the log file as it gets written and calls fn on every new line matching the
+// query until the context is done. Rotations are detected by checking if the file on disk is still
+// the one we have opened
+func LogTail(ctx context.Context, q LogQuery, fn func(LogLine) error) error {
+	files := LogFiles()
+	path := files[len(files)-1]
+	file, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+	}()
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	pending := ""
+	drain := func() error {
+		for {
+			chunk, err := reader.ReadString('\n')
+			pending += chunk
+			if err == io.EOF {
+				return nil // an incomplete line stays pending until the rest of it gets written
+			} else if err != nil {
+				return err
+			}
+			line := pending
+			pending = ""
+			if l, ok := LogParse(line); ok && q.Match(line, l) {
+				if err := fn(l); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if err := drain(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		current, err := os.Stat(path)
+		if err != nil {
+			continue // in between the rename and the creation of the new file
+		}
+		opened, err := file.Stat()
+		if err != nil {
+			return err
+		} else if os.SameFile(current, opened) {
+			continue
+		}
+		// rotated: what's left of the old file comes first
+		if err := drain(); err != nil {
+			return err
+		}
+		newFile, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+		if err != nil {
+			continue
+		}
+		file.Close()
+		file = newFile
+		reader = bufio.NewReader(file)
+		pending = ""
+	}
+}
+
+func logReadLines(r io.Reader, fn func(raw string, l LogLine) error) error {
+	reader := bufio.NewReader(r)
+	for {
+		raw, err := reader.ReadString('\n')
+		if raw != "" {
+			if l, ok := LogParse(raw); ok {
+				if err := fn(raw, l); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func logField(l LogLine, key string) string {
+	switch v := l.Fields[key].(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
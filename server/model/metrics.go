@@ -0,0 +1,90 @@
+package model
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"strings"
+	"time"
+)
+
+var (
+	METRICS_ENABLE func() bool
+	METRICS_TOKEN  func() string
+
+	metricsBackendDuration = NewHistogramVec(
+		"filestash_backend_operation_duration_seconds", "Time spent on the operations made against the storage backends",
+		METRICS_DEFAULT_BUCKETS, "backend", "operation",
+	)
+	metricsBackendErrors = NewCounterVec(
+		"filestash_backend_operation_errors_total", "Operations against the storage backends that returned an error",
+		"backend", "operation",
+	)
+)
+
+func init() {
+	METRICS_ENABLE = func() bool {
+		return Config.Get("features.metrics.enable").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "enable"
+			f.Type = "boolean"
+			f.Default = false
+			f.Description = "Expose metrics in the Prometheus format under /metrics, readable from the admin console or with the token"
+			return f
+		}).Bool()
+	}
+	METRICS_ENABLE()
+	METRICS_TOKEN = func() string {
+		return Config.Get("features.metrics.token").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "token"
+			f.Type = "password"
+			f.Description = "Bearer token the Prometheus scraper authenticates with. Without it, only admins can read the metrics"
+			return f
+		}).String()
+	}
+	METRICS_TOKEN()
+
+	NewGaugeFunc("filestash_search_indexers", "Number of search indexers in each phase", "phase", func() map[string]float64 {
+		values := map[string]float64{
+			"idle": 0, PHASE_EXPLORE: 0, PHASE_INDEXING: 0, PHASE_MAINTAIN: 0, PHASE_PAUSE: 0,
+		}
+		SProc.mu.RLock()
+		for i := range SProc.idx {
+			phase := SProc.idx[i].CurrentPhase
+			if phase == "" {
+				phase = "idle"
+			}
+			values[phase] += 1
+		}
+		SProc.mu.RUnlock()
+		phases := make(map[string]float64, len(values))
+		for phase, n := range values {
+			phases[strings.ToLower(strings.TrimPrefix(phase, "PHASE_"))] = n
+		}
+		return phases
+	})
+	NewGaugeFunc("filestash_search_folders_pending", "Number of folders waiting to be explored by the search indexers", "", func() map[string]float64 {
+		n := 0
+		SProc.mu.RLock()
+		for i := range SProc.idx {
+			n += SProc.idx[i].FoldersUnknown.Len()
+		}
+		SProc.mu.RUnlock()
+		return map[string]float64{"": float64(n)}
+	})
+}
+
+// BackendObserve records the time an operation on the storage took and whether it failed
+func BackendObserve(ctx *App, operation string, start time.Time, err error) {
+	backend := ctx.Session["type"]
+	if backend == "" {
+		backend = "unknown"
+	}
+	metricsBackendDuration.ObserveSince(start, backend, operation)
+	if err != nil {
+		metricsBackendErrors.Inc(backend, operation)
+	}
+}
@@ -0,0 +1,527 @@
+package model
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	OIDC_ENABLE        func() bool
+	OIDC_ISSUER        func() string
+	OIDC_CLIENT_ID     func() string
+	OIDC_CLIENT_SECRET func() string
+	OIDC_SCOPE         func() string
+	OIDC_CONNECTION    func() string
+	OIDC_GROUPS_CLAIM  func() string
+)
+
+/*
+ * Single sign on through an OpenID Connect provider. The user is sent to the identity provider using
+ * the authorization code flow with PKCE, the ID token we get back is verified against the keys
+ * published by the provider and its claims are used to fill the templates of the connection defined
+ * in the config, eg: { "type": "sftp", "username": "{{.preferred_username}}", ... }
+ */
+func init() {
+	OIDC_ENABLE = func() bool {
+		return Config.Get("auth.oidc.enable").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "enable"
+			f.Type = "enable"
+			f.Target = []string{"oidc_issuer", "oidc_client_id", "oidc_client_secret", "oidc_scope", "oidc_connection"}
+			f.Description = "Enable/Disable single sign on with an OpenID Connect provider"
+			f.Default = false
+			return f
+		}).Bool()
+	}
+	OIDC_ENABLE()
+	OIDC_ISSUER = func() string {
+		return Config.Get("auth.oidc.issuer").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "oidc_issuer"
+			f.Name = "issuer"
+			f.Type = "text"
+			f.Description = "Url of the identity provider. The configuration is discovered from /.well-known/openid-configuration"
+			f.Placeholder = "Eg: https://accounts.example.com"
+			return f
+		}).String()
+	}
+	OIDC_ISSUER()
+	OIDC_CLIENT_ID = func() string {
+		return Config.Get("auth.oidc.client_id").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "oidc_client_id"
+			f.Name = "client_id"
+			f.Type = "text"
+			return f
+		}).String()
+	}
+	OIDC_CLIENT_ID()
+	OIDC_CLIENT_SECRET = func() string {
+		return Config.Get("auth.oidc.client_secret").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "oidc_client_secret"
+			f.Name = "client_secret"
+			f.Type = "password"
+			f.Description = "Leave empty for public clients"
+			return f
+		}).String()
+	}
+	OIDC_CLIENT_SECRET()
+	OIDC_SCOPE = func() string {
+		return Config.Get("auth.oidc.scope").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "oidc_scope"
+			f.Name = "scope"
+			f.Type = "text"
+			f.Default = "openid profile email"
+			f.Placeholder = "Default: openid profile email"
+			return f
+		}).String()
+	}
+	OIDC_SCOPE()
+	OIDC_CONNECTION = func() string {
+		return Config.Get("auth.oidc.connection").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "oidc_connection"
+			f.Name = "connection"
+			f.Type = "text"
+			f.Description = "Label of the connection used to create the session. Its values can reference the claims of the ID token, eg: {{.preferred_username}}"
+			f.Placeholder = "Eg: SFTP"
+			return f
+		}).String()
+	}
+	OIDC_CONNECTION()
+	OIDC_GROUPS_CLAIM = func() string {
+		return Config.Get("auth.oidc.groups_claim").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Id = "oidc_groups_claim"
+			f.Name = "groups_claim"
+			f.Type = "text"
+			f.Default = "groups"
+			f.Description = "Claim of the ID token holding the groups of the user, used by the access control policies of the connection"
+			f.Placeholder = "Default: groups"
+			return f
+		}).String()
+	}
+	OIDC_GROUPS_CLAIM()
+}
+
+type OIDCProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+	keys                  map[string]interface{}
+	expire                time.Time
+}
+
+// State of an ongoing login, kept in an encrypted cookie until the user comes back from the provider
+type OIDCState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next,omitempty"`
+}
+
+var (
+	oidcProvider   *OIDCProvider
+	oidcProviderMu sync.Mutex
+)
+
+func OIDCGetProvider() (*OIDCProvider, error) {
+	if OIDC_ENABLE() == false {
+		return nil, NewError("Feature isn't enable, contact your administrator", 405)
+	}
+	issuer := strings.TrimSuffix(OIDC_ISSUER(), "/")
+	oidcProviderMu.Lock()
+	defer oidcProviderMu.Unlock()
+	if oidcProvider != nil && oidcProvider.Issuer == issuer && time.Now().Before(oidcProvider.expire) {
+		return oidcProvider, nil
+	}
+
+	p := &OIDCProvider{}
+	if err := oidcFetchJSON(issuer + "/.well-known/openid-configuration", p); err != nil {
+		return nil, err
+	}
+	if p.Issuer != issuer {
+		Log.Warning("oidc::discovery issuer mismatch: '%s' != '%s'", p.Issuer, issuer)
+		return nil, NewError("Invalid identity provider configuration", 502)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JwksUri == "" {
+		return nil, NewError("Invalid identity provider configuration", 502)
+	}
+	if err := p.refreshKeys(); err != nil {
+		return nil, err
+	}
+	p.expire = time.Now().Add(time.Hour)
+	oidcProvider = p
+	return p, nil
+}
+
+func NewOIDCState(next string) OIDCState {
+	return OIDCState{
+		State:    RandomString(32),
+		Nonce:    RandomString(32),
+		Verifier: RandomString(64),
+		Next:     next,
+	}
+}
+
+func (this OIDCProvider) AuthURL(state OIDCState, redirectUri string) string {
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", OIDC_CLIENT_ID())
+	q.Set("redirect_uri", redirectUri)
+	q.Set("scope", OIDC_SCOPE())
+	q.Set("state", state.State)
+	q.Set("nonce", state.Nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(this.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return this.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// Exchange the authorization code and return the verified claims of the ID token
+func (this *OIDCProvider) Exchange(state OIDCState, code string, redirectUri string) (map[string]interface{}, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectUri)
+	form.Set("client_id", OIDC_CLIENT_ID())
+	form.Set("code_verifier", state.Verifier)
+	req, err := http.NewRequest("POST", this.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if secret := OIDC_CLIENT_SECRET(); secret != "" {
+		req.SetBasicAuth(url.QueryEscape(OIDC_CLIENT_ID()), url.QueryEscape(secret))
+	}
+	res, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, ErrNotReachable
+	}
+	defer res.Body.Close()
+	var token struct {
+		IdToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return nil, NewError("Invalid response from the identity provider", 502)
+	}
+	if res.StatusCode != http.StatusOK || token.IdToken == "" {
+		Log.Debug("oidc::token status=%d error=%s", res.StatusCode, token.Error)
+		return nil, ErrAuthenticationFailed
+	}
+	return this.Verify(token.IdToken, state.Nonce)
+}
+
+func (this *OIDCProvider) Verify(idToken string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrNotValid
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+		return nil, ErrNotValid
+	} else if err = json.Unmarshal(b, &header); err != nil {
+		return nil, ErrNotValid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrNotValid
+	}
+	oidcProviderMu.Lock()
+	key, ok := this.keys[header.Kid]
+	if ok == false {
+		// the provider might have rotated its keys
+		if err = this.refreshKeys(); err == nil {
+			key, ok = this.keys[header.Kid]
+		}
+	}
+	oidcProviderMu.Unlock()
+	if err != nil {
+		return nil, err
+	} else if ok == false {
+		return nil, NewError("Unknown signing key", 401)
+	}
+	if err = jwtVerifySignature(header.Alg, key, []byte(parts[0] + "." + parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrNotValid
+	}
+	if err = json.Unmarshal(b, &claims); err != nil {
+		return nil, ErrNotValid
+	}
+	if claims["iss"] != this.Issuer {
+		return nil, NewError("Invalid issuer", 401)
+	}
+	if func() bool {
+		switch aud := claims["aud"].(type) {
+		case string:
+			return aud == OIDC_CLIENT_ID()
+		case []interface{}:
+			for i := range aud {
+				if aud[i] == OIDC_CLIENT_ID() {
+					return true
+				}
+			}
+		}
+		return false
+	}() == false {
+		return nil, NewError("Invalid audience", 401)
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok == false || now > exp + 60 {
+		return nil, NewError("Expired token", 401)
+	}
+	if iat, ok := claims["iat"].(float64); ok && iat > now + 60 {
+		return nil, NewError("Token issued in the future", 401)
+	}
+	if claims["nonce"] != nonce {
+		return nil, NewError("Invalid nonce", 401)
+	}
+	return claims, nil
+}
+
+func (this *OIDCProvider) refreshKeys() error {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oidcFetchJSON(this.JwksUri, &jwks); err != nil {
+		return err
+	}
+	keys := make(map[string]interface{})
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return NewError("No signing key available from the identity provider", 502)
+	}
+	this.keys = keys
+	return nil
+}
+
+func jwtVerifySignature(alg string, key interface{}, input []byte, signature []byte) error {
+	var hash crypto.Hash
+	if len(alg) != 5 {
+		return NewError("Unsupported signing algorithm", 401)
+	}
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return NewError("Unsupported signing algorithm", 401)
+	}
+	h := hash.New()
+	h.Write(input)
+	digest := h.Sum(nil)
+
+	errInvalid := NewError("Invalid signature", 401)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			if rsa.VerifyPKCS1v15(k, hash, digest, signature) != nil {
+				return errInvalid
+			}
+			return nil
+		} else if strings.HasPrefix(alg, "PS") {
+			if rsa.VerifyPSS(k, hash, digest, signature, nil) != nil {
+				return errInvalid
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(alg, "ES") {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2 * size {
+				return errInvalid
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(k, digest, r, s) == false {
+				return errInvalid
+			}
+			return nil
+		}
+	}
+	return NewError("Unsupported signing algorithm", 401)
+}
+
+func oidcFetchJSON(u string, v interface{}) error {
+	res, err := HTTPClient.Get(u)
+	if err != nil {
+		Log.Warning("oidc::fetch %s", err.Error())
+		return ErrNotReachable
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return NewError(fmt.Sprintf("Identity provider returned %d", res.StatusCode), 502)
+	}
+	if err = json.NewDecoder(res.Body).Decode(v); err != nil {
+		return NewError("Invalid response from the identity provider", 502)
+	}
+	return nil
+}
+
+/*
+ * Build the session of a user from the connection configured for single sign on. Every value of the
+ * connection is a template that can reference the claims of the ID token
+ */
+func OIDCSession(claims map[string]interface{}) (map[string]string, error) {
+	var conn map[string]interface{}
+	for i := range Config.Conn {
+		if fmt.Sprint(Config.Conn[i]["label"]) == OIDC_CONNECTION() {
+			conn = Config.Conn[i]
+			break
+		}
+	}
+	if conn == nil {
+		return nil, NewError("Missing connection for single sign on, please contact your administrator", 500)
+	}
+
+	session := make(map[string]string)
+	for key, value := range MapStringInterfaceToMapStringString(conn) {
+		if key == "acl" {
+			continue
+		} else if key == "label" || strings.Contains(value, "{{") == false {
+			session[key] = value
+			continue
+		}
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(value)
+		if err != nil {
+			Log.Warning("oidc::session invalid template for '%s': %s", key, err.Error())
+			return nil, NewError("Invalid connection for single sign on", 500)
+		}
+		var b bytes.Buffer
+		if err = tmpl.Execute(&b, claims); err != nil {
+			Log.Warning("oidc::session can't render '%s': %s", key, err.Error())
+			return nil, NewError("Missing claim for single sign on", 401)
+		}
+		session[key] = b.String()
+	}
+	session["sso"] = session["label"]
+	delete(session, "label")
+	session["groups"] = func() string {
+		groups := []string{}
+		switch g := claims[OIDC_GROUPS_CLAIM()].(type) {
+		case string:
+			groups = append(groups, g)
+		case []interface{}:
+			for i := range g {
+				if s, ok := g[i].(string); ok {
+					groups = append(groups, s)
+				}
+			}
+		}
+		return strings.Join(groups, ",")
+	}()
+	return session, nil
+}
+
+// isAllowed helper: templated values of a connection used for single sign on behave like wildcards
+func ssoValueMatch(expected string, actual string, prefix bool) bool {
+	if strings.Contains(actual, "..") {
+		return false
+	}
+	parts := regexp.MustCompile(`\{\{[^\}]*\}\}`).Split(expected, -1)
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	pattern := "^" + strings.Join(parts, `[^/]*`)
+	if prefix == false {
+		pattern += "$"
+	}
+	return regexp.MustCompile(pattern).MatchString(actual)
+}
@@ -0,0 +1,261 @@
+package model
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * A minimal identity provider: discovery, keys and a token endpoint checking PKCE. The login
+ * page is skipped, tests register the code the provider would have given along with the claims
+ * of the ID token
+ */
+type testIdP struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	mu    sync.Mutex
+	codes map[string]testIdPCode
+}
+
+type testIdPCode struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key, codes: make(map[string]testIdPCode)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(res http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(res).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(res http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(res).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(res http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		idp.mu.Lock()
+		c, ok := idp.codes[req.Form.Get("code")]
+		delete(idp.codes, req.Form.Get("code"))
+		idp.mu.Unlock()
+		verifier := sha256.Sum256([]byte(req.Form.Get("code_verifier")))
+		if ok == false || base64.RawURLEncoding.EncodeToString(verifier[:]) != c.challenge {
+			res.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(res).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(res).Encode(map[string]string{"id_token": idp.sign("test", idp.key, c.claims)})
+	})
+	idp.Server = httptest.NewServer(mux)
+
+	Config.Get("auth.oidc.enable").Set(true)
+	Config.Get("auth.oidc.issuer").Set(idp.URL)
+	Config.Get("auth.oidc.client_id").Set("filestash")
+	Config.Get("auth.oidc.client_secret").Set("")
+	return idp
+}
+
+// authorize does what the login page of the provider would: it gives a code for the request
+func (this *testIdP) authorize(t *testing.T, authURL string, claims map[string]interface{}) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("missing PKCE challenge in %s", authURL)
+	}
+	if claims["nonce"] == nil {
+		claims["nonce"] = q.Get("nonce")
+	}
+	code := RandomString(16)
+	this.mu.Lock()
+	this.codes[code] = testIdPCode{q.Get("code_challenge"), claims}
+	this.mu.Unlock()
+	return code
+}
+
+func (this *testIdP) sign(kid string, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (this *testIdP) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                this.URL,
+		"aud":                "filestash",
+		"sub":                "1234",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"preferred_username": "alice",
+		"groups":             []string{"staff", "ops"},
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	provider, err := OIDCGetProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewOIDCState("")
+	code := idp.authorize(t, provider.AuthURL(state, "http://localhost/callback"), idp.claims())
+	claims, err := provider.Exchange(state, code, "http://localhost/callback")
+	if err != nil {
+		t.Fatalf("login failed: %s", err.Error())
+	} else if claims["preferred_username"] != "alice" {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestOIDCLoginWrongVerifier(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	provider, err := OIDCGetProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewOIDCState("")
+	code := idp.authorize(t, provider.AuthURL(state, "http://localhost/callback"), idp.claims())
+	state.Verifier = RandomString(64)
+	if _, err = provider.Exchange(state, code, "http://localhost/callback"); err != ErrAuthenticationFailed {
+		t.Fatalf("expected the provider to refuse the code, got %v", err)
+	}
+}
+
+func TestOIDCVerify(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.Close()
+	provider, err := OIDCGetProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	for _, tc := range []struct {
+		name   string
+		update func(map[string]interface{})
+		kid    string
+		key    *rsa.PrivateKey
+		err    string
+	}{
+		{name: "valid"},
+		{name: "nonce", update: func(c map[string]interface{}) { c["nonce"] = "something else" }, err: "Invalid nonce"},
+		{name: "no nonce", update: func(c map[string]interface{}) { delete(c, "nonce") }, err: "Invalid nonce"},
+		{name: "issuer", update: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, err: "Invalid issuer"},
+		{name: "audience", update: func(c map[string]interface{}) { c["aud"] = "another_client" }, err: "Invalid audience"},
+		{name: "audience list", update: func(c map[string]interface{}) { c["aud"] = []string{"another_client", "filestash"} }},
+		{name: "expired", update: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, err: "Expired token"},
+		{name: "no expiry", update: func(c map[string]interface{}) { delete(c, "exp") }, err: "Expired token"},
+		{name: "future", update: func(c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() }, err: "Token issued in the future"},
+		{name: "signature", key: otherKey, err: "Invalid signature"},
+		{name: "unknown key", kid: "unknown", err: "Unknown signing key"},
+	} {
+		claims := idp.claims()
+		claims["nonce"] = "nonce"
+		if tc.update != nil {
+			tc.update(claims)
+		}
+		kid, key := "test", idp.key
+		if tc.kid != "" {
+			kid = tc.kid
+		}
+		if tc.key != nil {
+			key = tc.key
+		}
+		_, err := provider.Verify(idp.sign(kid, key, claims), "nonce")
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: expected the token to be valid, got %s", tc.name, err.Error())
+		} else if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%s: expected '%s', got %v", tc.name, tc.err, err)
+		}
+	}
+	if _, err := provider.Verify("not.a.token", "nonce"); err == nil {
+		t.Errorf("a malformed token mustn't be valid")
+	}
+}
+
+func TestOIDCSession(t *testing.T) {
+	conn := Config.Conn
+	defer func() {
+		Config.Conn = conn
+	}()
+	Config.Get("auth.oidc.connection").Set("sso")
+	Config.Conn = []map[string]interface{}{{
+		"label":    "sso",
+		"type":     "sftp",
+		"hostname": "sftp.example.com",
+		"username": "{{.preferred_username}}",
+		"path":     "/home/{{.preferred_username}}/",
+		"acl":      "allow user:* rw /",
+	}}
+
+	session, err := OIDCSession(map[string]interface{}{
+		"preferred_username": "alice",
+		"groups":             []interface{}{"staff", "ops"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{
+		"type":     "sftp",
+		"hostname": "sftp.example.com",
+		"username": "alice",
+		"path":     "/home/alice/",
+		"sso":      "sso",
+		"groups":   "staff,ops",
+	} {
+		if session[key] != expected {
+			t.Errorf("expected %s='%s', got '%s'", key, expected, session[key])
+		}
+	}
+	if _, ok := session["acl"]; ok {
+		t.Errorf("the acl of the connection mustn't end up in the session")
+	} else if _, ok := session["label"]; ok {
+		t.Errorf("the label is given as sso")
+	}
+	if len(ConnMatch(session)) != 1 {
+		t.Errorf("the session should match the templated connection")
+	}
+
+	if _, err = OIDCSession(map[string]interface{}{"email": "alice@example.com"}); err == nil || strings.Contains(err.Error(), "Missing claim") == false {
+		t.Errorf("expected a missing claim error, got %v", err)
+	}
+	session["path"] = "/home/alice/../../etc/"
+	if len(ConnMatch(session)) != 0 {
+		t.Errorf("a templated value mustn't match a path traversal")
+	}
+}
@@ -4,30 +4,58 @@ import (
 	. "github.com/mickael-kerjean/filestash/server/common"
 )
 
-func CanRead(ctx *App) bool {
-	if ctx.Share.Id != "" {
-		return ctx.Share.CanRead 
+func CanRead(ctx *App, path string) bool {
+	if ctx.Token.Id != "" && ctx.Token.CanRead == false {
+		return false
 	}
-	return true
+	if ctx.Share.Id != "" && ctx.Share.CanRead == false {
+		return false
+	}
+	return AclAllow(ctx, path, ACL_READ)
+}
+
+func CanEdit(ctx *App, path string) bool {
+	if ctx.Token.Id != "" && ctx.Token.CanWrite == false {
+		return false
+	}
+	if ctx.Share.Id != "" && ctx.Share.CanWrite == false {
+		return false
+	}
+	return AclAllow(ctx, path, ACL_WRITE)
 }
 
-func CanEdit(ctx *App) bool {
-	if ctx.Share.Id != "" {
-		return ctx.Share.CanWrite
+// CanEditRecursive is CanEdit for operations that also affect everything below a folder
+func CanEditRecursive(ctx *App, path string) bool {
+	if CanEdit(ctx, path) == false {
+		return false
 	}
-	return true
+	return AclAllowRecursive(ctx, path, ACL_WRITE)
 }
 
-func CanUpload(ctx *App) bool {
-	if ctx.Share.Id != "" {
-		return ctx.Share.CanUpload
+// CanEditRecursiveTo is CanEditRecursive for a folder moved somewhere else
+func CanEditRecursiveTo(ctx *App, from string, to string) bool {
+	if CanEdit(ctx, from) == false || CanEdit(ctx, to) == false {
+		return false
 	}
-	return true
+	return AclAllowRecursiveTo(ctx, from, to, ACL_WRITE)
 }
 
-func CanShare(ctx *App) bool {
-	if ctx.Share.Id != "" {
-		return ctx.Share.CanShare
+func CanUpload(ctx *App, path string) bool {
+	if ctx.Token.Id != "" && ctx.Token.CanUpload == false {
+		return false
+	}
+	if ctx.Share.Id != "" && ctx.Share.CanUpload == false {
+		return false
+	}
+	return AclAllow(ctx, path, ACL_UPLOAD)
+}
+
+func CanShare(ctx *App, path string) bool {
+	if ctx.Token.Id != "" {
+		return false
+	}
+	if ctx.Share.Id != "" && ctx.Share.CanShare == false {
+		return false
 	}
-	return true
+	return AclAllow(ctx, path, ACL_SHARE)
 }
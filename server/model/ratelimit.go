@@ -0,0 +1,344 @@
+package model
+
+import (
+	"fmt"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RATELIMIT_ATTEMPT_TIMEOUT = 5 * time.Minute
+	RATELIMIT_PENDING_WAIT    = 5 * time.Second
+)
+
+var (
+	RATELIMIT_ATTEMPTS  func() int
+	RATELIMIT_BAN_AFTER func() int
+	RATELIMIT_BAN_TIME  func() int
+)
+
+/*
+ * Protection against brute force attacks on everything that accepts a secret from the outside world:
+ * the login form, the admin console and the proofs of shared links. Failed attempts are tracked
+ * per ip and per target, after a few free attempts the client must wait an exponentially growing
+ * amount of time before trying again and is eventually banned for a while.
+ * Attempts still being processed count as failures until we know better, otherwise a burst of
+ * parallel requests would all go through before the first failure gets recorded: every Check that
+ * succeeds must be followed by a Release once the attempt is over.
+ * Once the client has given valid credentials, its attempts still being processed aren't held
+ * against it anymore until the next failure, which is what clients sending their credentials with
+ * every request, like webdav clients do, need to make parallel requests. Before that, a client held
+ * back only by its attempts being processed waits for their outcome instead of being refused
+ */
+var RateLimit = RateLimiter{
+	entries: make(map[string]*RateLimitEntry),
+}
+
+type RateLimiter struct {
+	entries   map[string]*RateLimitEntry
+	lastSweep time.Time
+	sync.Mutex
+}
+
+type RateLimitEntry struct {
+	Ip          string     `json:"ip"`
+	Target      string     `json:"target"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	RetryAfter  *time.Time `json:"retry_after,omitempty"`
+	Banned      bool       `json:"banned"`
+	InFlight    int        `json:"in_flight"`
+	LastAttempt time.Time  `json:"-"`
+	LastSuccess time.Time  `json:"-"`
+}
+
+type RateLimitError struct {
+	retry time.Duration
+}
+
+func (e RateLimitError) Error() string {
+	return fmt.Sprintf("Too many attempts, try again in %s", e.retry.Round(time.Second).String())
+}
+
+func (e RateLimitError) Status() int {
+	return 429
+}
+
+func (e RateLimitError) RetryAfter() int {
+	return int(math.Ceil(e.retry.Seconds()))
+}
+
+func init() {
+	RATELIMIT_ATTEMPTS = func() int {
+		return Config.Get("features.protection.ratelimit_attempts").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "ratelimit_attempts"
+			f.Type = "number"
+			f.Default = 3
+			f.Description = "Number of failed login attempts allowed before slowing down the client"
+			f.Placeholder = fmt.Sprintf("Default: %d", f.Default)
+			return f
+		}).Int()
+	}
+	RATELIMIT_ATTEMPTS()
+	RATELIMIT_BAN_AFTER = func() int {
+		return Config.Get("features.protection.ratelimit_ban_after").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "ratelimit_ban_after"
+			f.Type = "number"
+			f.Default = 10
+			f.Description = "Number of failed login attempts before the client gets temporarily banned"
+			f.Placeholder = fmt.Sprintf("Default: %d", f.Default)
+			return f
+		}).Int()
+	}
+	RATELIMIT_BAN_AFTER()
+	RATELIMIT_BAN_TIME = func() int {
+		return Config.Get("features.protection.ratelimit_ban_time").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "ratelimit_ban_time"
+			f.Type = "number"
+			f.Default = 15
+			f.Description = "Duration of a ban in minutes"
+			f.Placeholder = fmt.Sprintf("Default: %dmin", f.Default)
+			return f
+		}).Int()
+	}
+	RATELIMIT_BAN_TIME()
+}
+
+// Check returns an error when the client isn't allowed to make another attempt yet, otherwise the
+// attempt is reserved until Release gets called
+func (this *RateLimiter) Check(ip string, target string) error {
+	deadline := time.Now().Add(RATELIMIT_PENDING_WAIT)
+	for {
+		err, pending := this.reserve(ip, target)
+		if err == nil || pending == false || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// reserve makes an attempt, pending is true when it was refused only because of the attempts still
+// being processed
+func (this *RateLimiter) reserve(ip string, target string) (err error, pending bool) {
+	this.Lock()
+	defer this.Unlock()
+	now := time.Now()
+	key := rateLimitKey(ip, target)
+	e, ok := this.entries[key]
+	if ok && this.isExpired(e, now) {
+		delete(this.entries, key)
+		ok = false
+	}
+	if ok == false {
+		e = &RateLimitEntry{Ip: ip, Target: target}
+		this.entries[key] = e
+	} else if e.InFlight > 0 && now.Sub(e.LastAttempt) > RATELIMIT_ATTEMPT_TIMEOUT {
+		e.InFlight = 0 // attempts that were never released
+	}
+	if retry := this.retryAfter(e); retry != nil {
+		if d := retry.Sub(now); d > 0 {
+			t := this.delay(e, 0)
+			return RateLimitError{d}, e.InFlight > 0 && (t == nil || t.Before(now))
+		}
+	}
+	e.InFlight += 1
+	e.LastAttempt = now
+	return nil, false
+}
+
+// Release ends an attempt reserved with Check
+func (this *RateLimiter) Release(ip string, target string) {
+	this.Lock()
+	defer this.Unlock()
+	key := rateLimitKey(ip, target)
+	e, ok := this.entries[key]
+	if ok == false {
+		return
+	}
+	if e.InFlight > 0 {
+		e.InFlight -= 1
+	}
+	if e.InFlight == 0 && e.Failures == 0 && this.isVerified(e, time.Now()) == false {
+		delete(this.entries, key)
+	}
+}
+
+func (this *RateLimiter) Fail(ip string, target string) {
+	this.Lock()
+	defer this.Unlock()
+	now := time.Now()
+	if now.Sub(this.lastSweep) > time.Minute {
+		this.sweep(now)
+		this.lastSweep = now
+	}
+	key := rateLimitKey(ip, target)
+	e, ok := this.entries[key]
+	if ok == false {
+		e = &RateLimitEntry{Ip: ip, Target: target}
+		this.entries[key] = e
+	} else if e.Failures > 0 && now.Sub(e.LastFailure) > time.Duration(RATELIMIT_BAN_TIME())*time.Minute {
+		e.Failures = 0
+		e.Banned = false
+	}
+	e.Failures += 1
+	e.LastFailure = now
+	e.LastSuccess = time.Time{}
+	if e.Banned == false && RATELIMIT_BAN_AFTER() > 0 && e.Failures >= RATELIMIT_BAN_AFTER() {
+		e.Banned = true
+		Log.Warning("[ratelimit] ban ip=%s target=%s failures=%d", ip, target, e.Failures)
+	}
+}
+
+// Success is called once the credentials are valid, it clears the failures of the client
+func (this *RateLimiter) Success(ip string, target string) {
+	this.Lock()
+	defer this.Unlock()
+	key := rateLimitKey(ip, target)
+	e, ok := this.entries[key]
+	if ok == false {
+		e = &RateLimitEntry{Ip: ip, Target: target}
+		this.entries[key] = e
+	}
+	e.Failures = 0
+	e.Banned = false
+	e.LastFailure = time.Time{}
+	e.LastSuccess = time.Now()
+}
+
+func (this *RateLimiter) List() []RateLimitEntry {
+	this.Lock()
+	defer this.Unlock()
+	this.sweep(time.Now())
+	list := make([]RateLimitEntry, 0, len(this.entries))
+	for _, e := range this.entries {
+		if e.Failures == 0 {
+			continue
+		}
+		c := *e
+		c.RetryAfter = this.retryAfter(e)
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastFailure.After(list[j].LastFailure)
+	})
+	return list
+}
+
+// Clear removes the entries matching both the ip and the target, an empty value matches everything
+func (this *RateLimiter) Clear(ip string, target string) int {
+	this.Lock()
+	defer this.Unlock()
+	n := 0
+	for key, e := range this.entries {
+		if ip != "" && e.Ip != ip {
+			continue
+		} else if target != "" && e.Target != target {
+			continue
+		}
+		delete(this.entries, key)
+		n += 1
+	}
+	return n
+}
+
+func (this *RateLimiter) retryAfter(e *RateLimitEntry) *time.Time {
+	if this.isVerified(e, time.Now()) {
+		return this.delay(e, 0)
+	}
+	return this.delay(e, e.InFlight)
+}
+
+// delay gives when the client can try again, counting the pending attempts as failures
+func (this *RateLimiter) delay(e *RateLimitEntry, pending int) *time.Time {
+	if e.Banned {
+		t := e.LastFailure.Add(time.Duration(RATELIMIT_BAN_TIME()) * time.Minute)
+		return &t
+	}
+	extra := e.Failures + pending - RATELIMIT_ATTEMPTS()
+	if extra <= 0 {
+		return nil
+	}
+	if extra > 8 {
+		extra = 8
+	}
+	last := e.LastFailure
+	if e.LastAttempt.After(last) {
+		last = e.LastAttempt
+	}
+	t := last.Add(time.Duration(1 << uint(extra)) * time.Second)
+	return &t
+}
+
+// isVerified is true when the client has given valid credentials recently and hasn't failed since
+func (this *RateLimiter) isVerified(e *RateLimitEntry, now time.Time) bool {
+	return e.Failures == 0 && now.Sub(e.LastSuccess) < RATELIMIT_ATTEMPT_TIMEOUT
+}
+
+func (this *RateLimiter) isExpired(e *RateLimitEntry, now time.Time) bool {
+	if e.InFlight > 0 && now.Sub(e.LastAttempt) < RATELIMIT_ATTEMPT_TIMEOUT {
+		return false
+	} else if this.isVerified(e, now) {
+		return false
+	}
+	return now.Sub(e.LastFailure) > time.Duration(RATELIMIT_BAN_TIME()) * time.Minute
+}
+
+func (this *RateLimiter) sweep(now time.Time) {
+	for key, e := range this.entries {
+		if this.isExpired(e, now) {
+			delete(this.entries, key)
+		}
+	}
+}
+
+// RateLimitBackendTarget gives the target of a login on a storage backend. The server the user
+// types in can be written many ways, the key is either the connection of the config it matches or
+// the normalised name of the server. The name isn't resolved: the login would wait on a server
+// chosen by the client and the key would change with every answer of the dns
+func RateLimitBackendTarget(session map[string]string) string {
+	if conns := ConnMatch(session); len(conns) > 0 {
+		return fmt.Sprintf("backend::%s::conn::%v", session["type"], conns[0]["label"])
+	}
+	host := ""
+	for _, key := range []string{"hostname", "url", "endpoint"} {
+		if session[key] == "" {
+			continue
+		}
+		host = session[key]
+		if u, err := url.Parse(host); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		break
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return "backend::" + session["type"]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return "backend::" + session["type"] + "::" + host
+}
+
+func rateLimitKey(ip string, target string) string {
+	return ip + "::" + target
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rateLimitBurst makes n attempts at once, each taking a little while to be verified like a
+// password hash does. It gives the number of attempts which got through
+func rateLimitBurst(target string, n int, valid bool) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	passed := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := RateLimit.Check("127.0.0.1", target); err != nil {
+				return
+			}
+			defer RateLimit.Release("127.0.0.1", target)
+			mu.Lock()
+			passed += 1
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			if valid {
+				RateLimit.Success("127.0.0.1", target)
+			} else {
+				RateLimit.Fail("127.0.0.1", target)
+			}
+		}()
+	}
+	wg.Wait()
+	return passed
+}
+
+func TestRateLimitParallelSuccess(t *testing.T) {
+	target := "test::" + RandomString(8)
+	defer RateLimit.Clear("", target)
+	if passed := rateLimitBurst(target, 10, true); passed != 10 {
+		t.Errorf("valid attempts made in parallel mustn't be limited, %d/10 went through", passed)
+	}
+	if passed := rateLimitBurst(target, 10, true); passed != 10 {
+		t.Errorf("valid attempts made in parallel mustn't be limited, %d/10 went through", passed)
+	}
+}
+
+func TestRateLimitParallelFailures(t *testing.T) {
+	target := "test::" + RandomString(8)
+	defer RateLimit.Clear("", target)
+	if passed := rateLimitBurst(target, 10, false); passed > RATELIMIT_ATTEMPTS()+1 {
+		t.Errorf("a burst of invalid attempts should be limited, %d/10 went through", passed)
+	}
+}
+
+func TestRateLimitFailureAfterSuccess(t *testing.T) {
+	target := "test::" + RandomString(8)
+	defer RateLimit.Clear("", target)
+	RateLimit.Success("127.0.0.1", target)
+	for i := 0; i <= RATELIMIT_ATTEMPTS(); i++ {
+		RateLimit.Fail("127.0.0.1", target)
+	}
+	if err := RateLimit.Check("127.0.0.1", target); err == nil {
+		t.Errorf("a previous success mustn't lift the limit once the client fails again")
+	}
+}
+
+func TestRateLimitBackendTarget(t *testing.T) {
+	conn := Config.Conn
+	defer func() {
+		Config.Conn = conn
+	}()
+	Config.Conn = []map[string]interface{}{}
+	for _, hostname := range []string{"sftp.example.com", "SFTP.example.com.", " sftp.example.com:22", "sftp://sftp.example.com"} {
+		start := time.Now()
+		target := RateLimitBackendTarget(map[string]string{"type": "sftp", "hostname": hostname})
+		if target != "backend::sftp::sftp.example.com" {
+			t.Errorf("unexpected target for '%s': %s", hostname, target)
+		} else if time.Since(start) > 100*time.Millisecond {
+			t.Errorf("the target of '%s' took too long to compute", hostname)
+		}
+	}
+	if target := RateLimitBackendTarget(map[string]string{"type": "sftp", "hostname": "[::1]:22"}); target != "backend::sftp::::1" {
+		t.Errorf("unexpected target for an ip: %s", target)
+	}
+}
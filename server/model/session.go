@@ -0,0 +1,242 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"strings"
+	"time"
+)
+
+var (
+	SESSION_STORE            func() string
+	SESSION_IDLE_TIMEOUT     func() int
+	SESSION_ABSOLUTE_TIMEOUT func() int
+)
+
+/*
+ * By default, the auth cookie contains the whole session encrypted with the secret key, nothing is
+ * kept on the server. With the database store, the cookie only holds an opaque id pointing to the
+ * session stored server side, which makes it possible to revoke sessions
+ */
+const SESSION_ID_PREFIX = "s:"
+
+type UserSession struct {
+	Id        string    `json:"id"`
+	Backend   string    `json:"backend"`
+	Type      string    `json:"type"`
+	Username  string    `json:"username"`
+	Ip        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+func init() {
+	SESSION_STORE = func() string {
+		return Config.Get("auth.session.store").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "store"
+			f.Type = "select"
+			f.Default = "cookie"
+			f.Opts = []string{"cookie", "database"}
+			f.Description = "Where user sessions are kept. With 'database', sessions can be revoked and expire when idle"
+			f.Placeholder = "Default: cookie"
+			return f
+		}).String()
+	}
+	SESSION_STORE()
+	SESSION_IDLE_TIMEOUT = func() int {
+		return Config.Get("auth.session.idle_timeout").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "idle_timeout"
+			f.Type = "number"
+			f.Default = 60 * 24
+			f.Description = "With the database store, sessions without activity are closed after that many minutes"
+			f.Placeholder = fmt.Sprintf("Default: %dmin", f.Default)
+			return f
+		}).Int()
+	}
+	SESSION_IDLE_TIMEOUT()
+	SESSION_ABSOLUTE_TIMEOUT = func() int {
+		return Config.Get("auth.session.absolute_timeout").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "absolute_timeout"
+			f.Type = "number"
+			f.Default = 24 * 30
+			f.Description = "Maximum lifetime of a session in hours"
+			f.Placeholder = fmt.Sprintf("Default: %dh", f.Default)
+			return f
+		}).Int()
+	}
+	SESSION_ABSOLUTE_TIMEOUT()
+
+	go func() {
+		for {
+			sessionVacuum()
+			time.Sleep(6 * time.Hour)
+		}
+	}()
+}
+
+func SessionStoreEnabled() bool {
+	return SESSION_STORE() == "database"
+}
+
+func IsSessionId(cookie string) bool {
+	return strings.HasPrefix(cookie, SESSION_ID_PREFIX)
+}
+
+// SessionCreate stores the session and returns the value of the cookie pointing to it
+func SessionCreate(session map[string]string, ip string, userAgent string) (string, error) {
+	s, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	auth, err := EncryptString(SECRET_KEY_DERIVATE_FOR_USER, string(s))
+	if err != nil {
+		return "", err
+	}
+	id := RandomString(48)
+	username := session["username"]
+	if username == "" {
+		username = session["user"]
+	}
+	_, err = DB.Exec(
+		"INSERT INTO Session(id, backend, type, username, ip, user_agent, auth) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		sessionHash(id), GenerateID(&App{Session: session}), session["type"], username, ip, userAgent, auth,
+	)
+	if err != nil {
+		return "", err
+	}
+	return SESSION_ID_PREFIX + id, nil
+}
+
+func SessionGet(cookie string) (map[string]string, error) {
+	var session map[string]string = make(map[string]string)
+	var auth string
+	var lastSeen time.Time
+	id := sessionHash(strings.TrimPrefix(cookie, SESSION_ID_PREFIX))
+	err := DB.QueryRow(
+		"SELECT auth, last_seen FROM Session WHERE id = ? AND created > datetime('now', '-' || ? || ' hours') AND last_seen > datetime('now', '-' || ? || ' minutes')",
+		id, SESSION_ABSOLUTE_TIMEOUT(), SESSION_IDLE_TIMEOUT(),
+	).Scan(&auth, &lastSeen)
+	if err == sql.ErrNoRows {
+		return session, ErrNotAuthorized
+	} else if err != nil {
+		return session, err
+	}
+	if time.Since(lastSeen) > time.Minute {
+		go DB.Exec("UPDATE Session SET last_seen = datetime('now') WHERE id = ?", id)
+	}
+	str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_USER, auth)
+	if err != nil {
+		return session, ErrNotAuthorized
+	}
+	err = json.Unmarshal([]byte(str), &session)
+	return session, err
+}
+
+func SessionList(backend string) ([]UserSession, error) {
+	rows, err := DB.Query(
+		"SELECT id, backend, type, username, ip, user_agent, created, last_seen FROM Session WHERE (? = '' OR backend = ?) AND created > datetime('now', '-' || ? || ' hours') AND last_seen > datetime('now', '-' || ? || ' minutes') ORDER BY backend, last_seen DESC",
+		backend, backend, SESSION_ABSOLUTE_TIMEOUT(), SESSION_IDLE_TIMEOUT(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []UserSession{}
+	for rows.Next() {
+		var s UserSession
+		if err = rows.Scan(&s.Id, &s.Backend, &s.Type, &s.Username, &s.Ip, &s.UserAgent, &s.Created, &s.LastSeen); err != nil {
+			return nil, err
+		}
+		s.Id = s.Id[:16]
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+// SessionDelete revokes a session from the value of its cookie
+func SessionDelete(cookie string) error {
+	_, err := DB.Exec("DELETE FROM Session WHERE id = ?", sessionHash(strings.TrimPrefix(cookie, SESSION_ID_PREFIX)))
+	return err
+}
+
+// SessionRevoke is what the admin uses to close sessions, either a single one from the id shown
+// in the list or all the sessions of a backend
+func SessionRevoke(id string, backend string) (int64, error) {
+	if id == "" && backend == "" {
+		return 0, ErrNotValid
+	}
+	res, err := DB.Exec(
+		"DELETE FROM Session WHERE (? = '' OR substr(id, 1, 16) = ?) AND (? = '' OR backend = ?)",
+		id, id, backend, backend,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func SessionRevokeBackend(backend string) (int64, error) {
+	return SessionRevoke("", backend)
+}
+
+// SessionReencrypt re-encrypts the stored sessions with the current secret key. The backend they
+// are listed and revoked by depends on the key too and gets updated along the way
+func SessionReencrypt() (updated int, failed int, err error) {
+	rows, err := DB.Query("SELECT id, auth FROM Session")
+	if err != nil {
+		return 0, 0, err
+	}
+	auths := make(map[string]string)
+	for rows.Next() {
+		var id, auth string
+		rows.Scan(&id, &auth)
+		auths[id] = auth
+	}
+	rows.Close()
+	for id, auth := range auths {
+		str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_USER, auth)
+		if err != nil {
+			failed += 1
+			continue
+		}
+		if auth, err = EncryptString(SECRET_KEY_DERIVATE_FOR_USER, str); err != nil {
+			failed += 1
+			continue
+		}
+		session := make(map[string]string)
+		if err = json.Unmarshal([]byte(str), &session); err != nil {
+			failed += 1
+			continue
+		}
+		backend := GenerateID(&App{Session: session})
+		if _, err = DB.Exec("UPDATE Session SET auth = ?, backend = ? WHERE id = ?", auth, backend, id); err != nil {
+			failed += 1
+			continue
+		}
+		updated += 1
+	}
+	return updated, failed, nil
+}
+
+func sessionVacuum() {
+	DB.Exec(
+		"DELETE FROM Session WHERE created < datetime('now', '-' || ? || ' hours') OR last_seen < datetime('now', '-' || ? || ' minutes')",
+		SESSION_ABSOLUTE_TIMEOUT(), SESSION_IDLE_TIMEOUT(),
+	)
+}
+
+func sessionHash(id string) string {
+	return Hash("SESSION_"+id, 40)
+}
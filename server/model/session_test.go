@@ -0,0 +1,38 @@
+package model
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"testing"
+)
+
+func TestSessionAfterKeyRotation(t *testing.T) {
+	defer secretKeySetup()()
+	session := map[string]string{"type": "sftp", "hostname": "sftp.example.com", "username": "bob"}
+	cookie, err := SessionCreate(session, "127.0.0.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secretKeyRotate()
+	if _, failed, err := SessionReencrypt(); err != nil || failed != 0 {
+		t.Fatalf("re-encryption failed: %v, %d failed", err, failed)
+	}
+	secretKeyDropPrevious()
+
+	if s, err := SessionGet(cookie); err != nil || s["username"] != "bob" {
+		t.Fatalf("expected the session to survive a key rotation, got %v %+v", err, s)
+	}
+	backend := GenerateID(&App{Session: session})
+	sessions, err := SessionList(backend)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sessions) != 1 {
+		t.Fatalf("expected the session to be listed after a key rotation, got %+v", sessions)
+	}
+	if n, err := SessionRevokeBackend(backend); err != nil || n != 1 {
+		t.Fatalf("expected the session to be revoked after a key rotation, got %v %d", err, n)
+	}
+	if _, err = SessionGet(cookie); err != ErrNotAuthorized {
+		t.Errorf("the session should be gone, got %v", err)
+	}
+}
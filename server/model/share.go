@@ -5,22 +5,51 @@ import (
 	"bytes"
 	"crypto/tls"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/gomail.v2"
 	"net/http"
 	"html/template"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
-type Proof struct {
-	Id      string  `json:"id"`
-	Key     string  `json:"key"`
-	Value   string  `json:"-"`
-	Message *string `json:"message,omitempty"`
-	Error   *string `json:"error,omitempty"`
+const (
+	SHARE_PROOF_TOTP_TTL = 12 * time.Hour
+	// the proof of an email carries the address which is up to 254 characters, the cookie is
+	// capped just under what browsers are willing to store
+	SHARE_PROOF_COOKIE_MAX = 4000
+)
+
+type ShareAccess struct {
+	Time      time.Time `json:"time"`
+	Ip        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Email     string    `json:"email,omitempty"`
+	Operation string    `json:"operation"`
+	Path      string    `json:"path"`
+}
+
+type ShareInventory struct {
+	Id         string     `json:"id"`
+	Backend    string     `json:"backend"`
+	Path       string     `json:"path"`
+	CanRead    bool       `json:"can_read"`
+	CanWrite   bool       `json:"can_write"`
+	CanUpload  bool       `json:"can_upload"`
+	CanShare   bool       `json:"can_share"`
+	Expire     *int64     `json:"expire,omitempty"`
+	Proofs     []string   `json:"proofs"`
+	IpRanges   *string    `json:"ip_ranges,omitempty"`
+	Orphan     bool       `json:"orphan"`
+	Access     int        `json:"access"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+	Uploads    int        `json:"uploads"`
 }
 
 func ShareList(backend string, path string) ([]Share, error) {
@@ -75,6 +104,30 @@ func ShareUpsert(p *Share) error {
 		}
 	}
 
+	if p.Totp != nil {
+		if *p.Totp == PASSWORD_DUMMY {
+			s, err := ShareGet(p.Id)
+			if err != nil {
+				return ErrNotValid
+			}
+			p.Totp = s.Totp
+		} else {
+			if _, err := TotpCode(*p.Totp, time.Now()); err != nil {
+				return err
+			}
+			encryptedSecret, err := EncryptString(SECRET_KEY_DERIVATE_FOR_PROOF, *p.Totp)
+			if err != nil {
+				return err
+			}
+			p.Totp = NewString(encryptedSecret)
+		}
+	}
+	if p.IpRanges != nil {
+		if _, err := ParseIpRanges(*p.IpRanges); err != nil {
+			return err
+		}
+	}
+
 	stmt, err := DB.Prepare("INSERT INTO Location(backend, path) VALUES($1, $2)")
 	if err != nil {
 		return err
@@ -97,6 +150,8 @@ func ShareUpsert(p *Share) error {
 	j, _ := json.Marshal(&struct {
         Password     *string  `json:"password,omitempty"`
 		Users        *string  `json:"users,omitempty"`
+		Totp         *string  `json:"totp,omitempty"`
+		IpRanges     *string  `json:"ip_ranges,omitempty"`
 		Expire       *int64   `json:"expire,omitempty"`
 		Url          *string  `json:"url,omitempty"`
 		CanShare     bool     `json:"can_share"`
@@ -104,9 +159,16 @@ func ShareUpsert(p *Share) error {
 		CanRead      bool     `json:"can_read"`
 		CanWrite     bool     `json:"can_write"`
 		CanUpload    bool     `json:"can_upload"`
+		DropTypes    *string  `json:"drop_types,omitempty"`
+		DropMaxSize  *int64   `json:"drop_max_size,omitempty"`
+		DropMaxTotal *int64   `json:"drop_max_total,omitempty"`
+		DropFolder   bool     `json:"drop_folder"`
+		DropNotify   *string  `json:"drop_notify,omitempty"`
     }{
 		Password: p.Password,
 		Users: p.Users,
+		Totp: p.Totp,
+		IpRanges: p.IpRanges,
 		Expire: p.Expire,
 		Url: p.Url,
 		CanShare: p.CanShare,
@@ -114,11 +176,267 @@ func ShareUpsert(p *Share) error {
 		CanRead: p.CanRead,
 		CanWrite: p.CanWrite,
 		CanUpload: p.CanUpload,
+		DropTypes: p.DropTypes,
+		DropMaxSize: p.DropMaxSize,
+		DropMaxTotal: p.DropMaxTotal,
+		DropFolder: p.DropFolder,
+		DropNotify: p.DropNotify,
     })
 	_, err = stmt.Exec(p.Id, p.Backend, p.Path, j, p.Auth)
 	return err
 }
 
+func ShareInventoryList(backend string, path string) ([]ShareInventory, error) {
+	stmt, err := DB.Prepare(`
+		SELECT
+			s.id, s.related_backend, s.related_path, s.params,
+			(SELECT COUNT(*) FROM ShareAccess a WHERE a.share = s.id),
+			(SELECT MAX(a.time) FROM ShareAccess a WHERE a.share = s.id),
+			(SELECT COUNT(*) FROM ShareUpload u WHERE u.share = s.id)
+		FROM Share s
+		WHERE s.related_backend LIKE ? || '%' AND s.related_path LIKE ? || '%'
+		ORDER BY s.related_backend, s.related_path
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(backend, path)
+	if err != nil {
+		return nil, err
+	}
+	list := []ShareInventory{}
+	for rows.Next() {
+		var s Share
+		var params []byte
+		var lastAccess *string
+		var i ShareInventory
+		rows.Scan(&s.Id, &s.Backend, &s.Path, &params, &i.Access, &lastAccess, &i.Uploads)
+		json.Unmarshal(params, &s)
+		i.Id = s.Id
+		i.Backend = s.Backend
+		i.Path = s.Path
+		i.CanRead = s.CanRead
+		i.CanWrite = s.CanWrite
+		i.CanUpload = s.CanUpload
+		i.CanShare = s.CanShare
+		i.Expire = s.Expire
+		i.IpRanges = s.IpRanges
+		i.Orphan = s.Orphan
+		i.Proofs = []string{}
+		for _, p := range ShareProofGetRequired(s) {
+			i.Proofs = append(i.Proofs, p.Key)
+		}
+		if lastAccess != nil {
+			if t, err := time.Parse("2006-01-02 15:04:05", *lastAccess); err == nil {
+				i.LastAccess = &t
+			}
+		}
+		list = append(list, i)
+	}
+	rows.Close()
+	return list, nil
+}
+
+func ShareExpire(id string) error {
+	return shareParamsSet(id, "expire", time.Now().UnixNano() / 1000000)
+}
+
+/*
+ * Shared links are pointing to a location, when that location gets moved somewhere else we
+ * make the shared links follow it. Paths ending with a "/" are directories
+ */
+func ShareMove(backend string, from string, to string) error {
+	if from == "" || to == "" || from == to {
+		return nil
+	}
+	fromDir := EnforceDirectory(from)
+	toDir := EnforceDirectory(to)
+	rows, err := DB.Query(
+		"SELECT path FROM Location WHERE backend = ? AND (path = ? OR substr(path, 1, length(?)) = ?)",
+		backend, from, fromDir, fromDir,
+	)
+	if err != nil {
+		return err
+	}
+	paths := []string{}
+	for rows.Next() {
+		var path string
+		rows.Scan(&path)
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if len(paths) == 0 {
+		return nil
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, oldPath := range paths {
+		newPath := to
+		if oldPath != from || strings.HasSuffix(from, "/") {
+			newPath = toDir + strings.TrimPrefix(oldPath, fromDir)
+		}
+		if _, err = tx.Exec("INSERT OR IGNORE INTO Location(backend, path) VALUES(?, ?)", backend, newPath); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.Exec("UPDATE Share SET related_path = ? WHERE related_backend = ? AND related_path = ?", newPath, backend, oldPath); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM Location WHERE backend = ? AND path = ?", backend, oldPath); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+ * Shared links pointing to something that was deleted are either removed or flagged as orphan
+ * so that a file created later on under the same name doesn't get exposed without the owner knowing
+ */
+func ShareRemoved(backend string, path string) error {
+	if path == "" {
+		return nil
+	}
+	dir := EnforceDirectory(path)
+	if SHARE_ON_DELETE() == "remove" {
+		_, err := DB.Exec(
+			"DELETE FROM Location WHERE backend = ? AND (path = ? OR substr(path, 1, length(?)) = ?)",
+			backend, path, dir, dir,
+		)
+		return err
+	}
+	rows, err := DB.Query(
+		"SELECT id FROM Share WHERE related_backend = ? AND (related_path = ? OR substr(related_path, 1, length(?)) = ?)",
+		backend, path, dir, dir,
+	)
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err = shareParamsSet(id, "orphan", true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shareParamsSet(id string, key string, value interface{}) error {
+	var params []byte
+	stmt, err := DB.Prepare("SELECT params FROM Share WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if err = stmt.QueryRow(id).Scan(&params); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
+	}
+	var p map[string]interface{}
+	if err = json.Unmarshal(params, &p); err != nil {
+		return err
+	}
+	p[key] = value
+	if params, err = json.Marshal(p); err != nil {
+		return err
+	}
+	stmt, err = DB.Prepare("UPDATE Share SET params = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(params, id)
+	return err
+}
+
+/*
+ * After a rotation of the secret key, shared links are still encrypted with a previous key from the
+ * keyring. Re-encrypting them with the current key is what makes it possible to drop previous keys.
+ * As the backend identifier is salted with the secret key, it needs to be recalculated as well
+ */
+func ShareReencrypt() (int, int, error) {
+	type row struct {
+		id      string
+		path    string
+		auth    string
+		params  []byte
+	}
+	rows, err := DB.Query("SELECT id, related_path, auth, params FROM Share")
+	if err != nil {
+		return 0, 0, err
+	}
+	shares := []row{}
+	for rows.Next() {
+		var r row
+		rows.Scan(&r.id, &r.path, &r.auth, &r.params)
+		shares = append(shares, r)
+	}
+	rows.Close()
+
+	updated, failed := 0, 0
+	for _, r := range shares {
+		str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_USER, r.auth)
+		if err != nil {
+			Log.Warning("share::reencrypt can't decrypt '%s'", r.id)
+			failed += 1
+			continue
+		}
+		auth, err := EncryptString(SECRET_KEY_DERIVATE_FOR_USER, str)
+		if err != nil {
+			failed += 1
+			continue
+		}
+		session := make(map[string]string)
+		json.Unmarshal([]byte(str), &session)
+		backend := GenerateID(&App{ Session: session })
+
+		var params map[string]interface{}
+		json.Unmarshal(r.params, &params)
+		if totp, ok := params["totp"].(string); ok {
+			secret, err := DecryptString(SECRET_KEY_DERIVATE_FOR_PROOF, totp)
+			if err != nil {
+				failed += 1
+				continue
+			}
+			if params["totp"], err = EncryptString(SECRET_KEY_DERIVATE_FOR_PROOF, secret); err != nil {
+				failed += 1
+				continue
+			}
+		}
+		j, _ := json.Marshal(params)
+
+		tx, err := DB.Begin()
+		if err != nil {
+			return updated, failed, err
+		}
+		if _, err = tx.Exec("INSERT OR IGNORE INTO Location(backend, path) VALUES(?, ?)", backend, r.path); err == nil {
+			_, err = tx.Exec("UPDATE Share SET related_backend = ?, auth = ?, params = ? WHERE id = ?", backend, auth, j, r.id)
+		}
+		if err != nil {
+			tx.Rollback()
+			failed += 1
+			continue
+		}
+		tx.Commit()
+		updated += 1
+	}
+	_, err = DB.Exec("DELETE FROM Location WHERE NOT EXISTS (SELECT 1 FROM Share WHERE Share.related_backend = Location.backend AND Share.related_path = Location.path)")
+	return updated, failed, err
+}
+
 func ShareDelete(id string) error {
 	stmt, err := DB.Prepare("DELETE FROM Share WHERE id = ?")
 	if err != nil {
@@ -128,119 +446,373 @@ func ShareDelete(id string) error {
 	return err
 }
 
-func ShareProofVerifier(s Share, proof Proof) (Proof, error) {
-	p := proof
+func ShareAccessInsert(id string, a ShareAccess) error {
+	stmt, err := DB.Prepare("INSERT INTO ShareAccess(share, ip, user_agent, email, operation, path) VALUES(?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(id, a.Ip, a.UserAgent, a.Email, a.Operation, a.Path)
+	return err
+}
 
-	if proof.Key == "password" {
-		if s.Password == nil {
-			return p, NewError("No password required", 400)
-		}
+func ShareAccessList(id string, limit int, offset int) ([]ShareAccess, error) {
+	stmt, err := DB.Prepare("SELECT time, ip, user_agent, email, operation, path FROM ShareAccess WHERE share = ? ORDER BY time DESC LIMIT ? OFFSET ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	logs := []ShareAccess{}
+	for rows.Next() {
+		var a ShareAccess
+		rows.Scan(&a.Time, &a.Ip, &a.UserAgent, &a.Email, &a.Operation, &a.Path)
+		logs = append(logs, a)
+	}
+	rows.Close()
+	return logs, nil
+}
 
-		v, ok := ShareProofVerifierPassword(*s.Password, proof.Value);
-		if ok == false {
-			time.Sleep(1000 * time.Millisecond)
-			return p, ErrInvalidPassword
+// uploads in progress count toward the quota of a drop box until they get recorded, otherwise
+// parallel uploads would all pass the check against the same usage
+var shareDropReserved = struct {
+	sync.Mutex
+	size map[string]int64
+}{size: make(map[string]int64)}
+
+// ShareDropVerifier checks an upload against the restrictions of the link. When the link has a
+// quota, the size is reserved until ShareDropRelease gets called
+func ShareDropVerifier(s Share, filename string, size int64) error {
+	if s.DropTypes != nil {
+		allowed := false
+		mType := GetMimeType(filename)
+		ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+		for _, t := range strings.Split(*s.DropTypes, ",") {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if t == "" {
+				continue
+			} else if strings.Contains(t, "/") {
+				if t == mType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mType, strings.TrimSuffix(t, "*"))) {
+					allowed = true
+					break
+				}
+			} else if strings.TrimPrefix(t, ".") == ext {
+				allowed = true
+				break
+			}
+		}
+		if allowed == false {
+			return NewError("This type of file isn't allowed", 415)
 		}
-		p.Value = v
 	}
-
-	if proof.Key == "email" {
-		// find out if user is authorized
-		if s.Users == nil {
-			return p, NewError("Authentication not required", 400)
+	if size < 0 {
+		if s.DropMaxSize != nil || s.DropMaxTotal != nil {
+			return NewError("Missing file size", 411)
 		}
-		v, ok := ShareProofVerifierEmail(*s.Users, proof.Value)
-		if ok == false {
-			time.Sleep(1000 * time.Millisecond)
-			return p, ErrNotAuthorized
+		return nil
+	}
+	if s.DropMaxSize != nil && size > *s.DropMaxSize {
+		return NewError("File is too large", 413)
+	}
+	if s.DropMaxTotal != nil {
+		shareDropReserved.Lock()
+		defer shareDropReserved.Unlock()
+		used, err := ShareDropUsage(s.Id)
+		if err != nil {
+			return err
 		}
-		user := v
+		if used + shareDropReserved.size[s.Id] + size > *s.DropMaxTotal {
+			return NewError("Not enough space left on this shared link", 507)
+		}
+		if size > 0 {
+			shareDropReserved.size[s.Id] += size
+		}
+	}
+	return nil
+}
 
-		// prepare the verification code
-		stmt, err := DB.Prepare("INSERT INTO Verification(key, code) VALUES(?, ?)");
-		if err != nil {
-			return p, err
-		}
-		code := RandomString(4)
-		if _, err := stmt.Exec("email::" + user, code); err != nil {
-			return p, err
-		}
-
-		// Prepare message
-		var b bytes.Buffer
-		t := template.New("email")
-		t.Parse(TmplEmailVerification())
-		t.Execute(&b, struct{
-			Code     string
-			Username string
-		}{code, networkDriveUsernameEnc(user)})
-
-		p.Key = "code"
-		p.Value = ""
-		p.Message = NewString("We've sent you a message with a verification code")
-
-		// Send email
-		email := struct {
-			Hostname string `json:"server"`
-			Port     int    `json:"port"`
-			Username string `json:"username"`
-			Password string `json:"password"`
-			From     string `json:"from"`
-		}{
-			Hostname: Config.Get("email.server").String(),
-			Port: Config.Get("email.port").Int(),
-			Username: Config.Get("email.username").String(),
-			Password: Config.Get("email.password").String(),
-			From: Config.Get("email.from").String(),
-		}
-
-		m := gomail.NewMessage()
-		m.SetHeader("From", email.From)
-		m.SetHeader("To", proof.Value)
-		m.SetHeader("Subject", "Your verification code")
-		m.SetBody("text/html", b.String())
-		d := gomail.NewDialer(email.Hostname, email.Port, email.Username, email.Password)
-		d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-		if err := d.DialAndSend(m); err != nil {
-			Log.Error("Sendmail error: %v", err)
-			Log.Error("Verification code '%s'", code)
-			return p, NewError("Couldn't send email", 500)
-		}
-		return p, nil
-	}
-
-	if proof.Key == "code" {
-		// find key for given code
-		stmt, err := DB.Prepare("SELECT key FROM Verification WHERE code = ? AND expire > datetime('now')")
-		if err != nil {
-			return p, NewError("Not found", 404)
+func ShareDropRelease(s Share, size int64) {
+	if s.DropMaxTotal == nil || size <= 0 {
+		return
+	}
+	shareDropReserved.Lock()
+	defer shareDropReserved.Unlock()
+	shareDropReserved.size[s.Id] -= size
+	if shareDropReserved.size[s.Id] <= 0 {
+		delete(shareDropReserved.size, s.Id)
+	}
+}
+
+func ShareDropUsage(id string) (int64, error) {
+	var size int64
+	stmt, err := DB.Prepare("SELECT COALESCE(SUM(size), 0) FROM ShareUpload WHERE share = ?")
+	if err != nil {
+		return size, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(id).Scan(&size)
+	return size, err
+}
+
+func ShareDropRecord(s Share, path string, size int64, email string) error {
+	stmt, err := DB.Prepare("INSERT INTO ShareUpload(share, path, size, email) VALUES(?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if _, err = stmt.Exec(s.Id, path, size, email); err != nil {
+		return err
+	}
+	if s.DropNotify == nil {
+		return nil
+	}
+
+	var b bytes.Buffer
+	t := template.New("email")
+	t.Parse(TmplEmailDropNotification())
+	t.Execute(&b, struct{
+		Path  string
+		Size  int64
+		Email string
+	}{path, size, email})
+	go func() {
+		if err := sendEmail(*s.DropNotify, "New file received", b.String()); err != nil {
+			Log.Warning("share::drop notify %s", err.Error())
 		}
-		row := stmt.QueryRow(proof.Value)
-		var key string
-		if err = row.Scan(&key); err != nil {
-			if err == sql.ErrNoRows {
-				stmt.Close()
-				p.Key = "email"
-				p.Value = ""
-				return p, NewError("Not found", 404)
+	}()
+	return nil
+}
+
+func init() {
+	Hooks.Register.ShareProof(
+		"password",
+		func(s Share) []Proof {
+			if s.Password == nil {
+				return nil
 			}
-			stmt.Close()
-			return p, err
+			return []Proof{ Proof{Key: "password", Value: *s.Password} }
+		},
+		shareProofVerifierPassword,
+	)
+	Hooks.Register.ShareProof(
+		"email",
+		func(s Share) []Proof {
+			if s.Users == nil {
+				return nil
+			}
+			return []Proof{ Proof{Key: "email", Value: *s.Users} }
+		},
+		shareProofVerifierEmail,
+	)
+	Hooks.Register.ShareProof("code", nil, shareProofVerifierCode)
+	Hooks.Register.ShareProof(
+		"totp",
+		func(s Share) []Proof {
+			if s.Totp == nil {
+				return nil
+			}
+			return []Proof{ Proof{Key: "totp", Value: shareTotpProofValue(s)} }
+		},
+		shareProofVerifierTotp,
+	)
+}
+
+func ShareProofVerifier(s Share, proof Proof) (Proof, error) {
+	for _, h := range Hooks.Get.ShareProof() {
+		if h.Key == proof.Key && h.Verify != nil {
+			return h.Verify(s, proof)
 		}
-		stmt.Close()
+	}
+	return proof, nil
+}
+
+func shareProofVerifierPassword(s Share, proof Proof) (Proof, error) {
+	p := proof
+	if s.Password == nil {
+		return p, NewError("No password required", 400)
+	}
+	v, ok := ShareProofVerifierPassword(*s.Password, proof.Value);
+	if ok == false {
+		time.Sleep(1000 * time.Millisecond)
+		return p, ErrInvalidPassword
+	}
+	p.Value = v
+	return p, nil
+}
 
-		// cleanup current attempt so that it isn't used for malicious purpose
-		if stmt, err = DB.Prepare("DELETE FROM Verification WHERE code = ?"); err == nil {
-			stmt.Exec(proof.Value)
+func shareProofVerifierEmail(s Share, proof Proof) (Proof, error) {
+	p := proof
+	// find out if user is authorized
+	if s.Users == nil {
+		return p, NewError("Authentication not required", 400)
+	}
+	v, ok := ShareProofVerifierEmail(*s.Users, proof.Value)
+	if ok == false {
+		time.Sleep(1000 * time.Millisecond)
+		return p, ErrNotAuthorized
+	}
+	user := v
+
+	// prepare the verification code
+	stmt, err := DB.Prepare("INSERT INTO Verification(key, code) VALUES(?, ?)");
+	if err != nil {
+		return p, err
+	}
+	code := RandomString(4)
+	if _, err := stmt.Exec("email::" + user + "::" + proof.Value, code); err != nil {
+		return p, err
+	}
+
+	// Prepare message
+	var b bytes.Buffer
+	t := template.New("email")
+	t.Parse(TmplEmailVerification())
+	t.Execute(&b, struct{
+		Code     string
+		Username string
+	}{code, networkDriveUsernameEnc(user)})
+
+	p.Key = "code"
+	p.Value = ""
+	p.Message = NewString("We've sent you a message with a verification code")
+
+	// Send email
+	if err := sendEmail(proof.Value, "Your verification code", b.String()); err != nil {
+		Log.Error("Verification code '%s'", code)
+		return p, err
+	}
+	return p, nil
+}
+
+func shareProofVerifierCode(s Share, proof Proof) (Proof, error) {
+	p := proof
+	// find key for given code
+	stmt, err := DB.Prepare("SELECT key FROM Verification WHERE code = ? AND expire > datetime('now')")
+	if err != nil {
+		return p, NewError("Not found", 404)
+	}
+	row := stmt.QueryRow(proof.Value)
+	var key string
+	if err = row.Scan(&key); err != nil {
+		if err == sql.ErrNoRows {
 			stmt.Close()
+			p.Key = "email"
+			p.Value = ""
+			return p, NewError("Not found", 404)
 		}
-		p.Key = "email"
-		p.Value = strings.TrimPrefix(key, "email::")
+		stmt.Close()
+		return p, err
 	}
+	stmt.Close()
 
+	// cleanup current attempt so that it isn't used for malicious purpose
+	if stmt, err = DB.Prepare("DELETE FROM Verification WHERE code = ?"); err == nil {
+		stmt.Exec(proof.Value)
+		stmt.Close()
+	}
+	p.Key = "email"
+	p.Value = strings.TrimPrefix(key, "email::")
+	if i := strings.Index(p.Value, "::"); i != -1 {
+		p.Email = p.Value[i+2:]
+		p.Value = p.Value[:i]
+	}
 	return p, nil
 }
 
+func shareProofVerifierTotp(s Share, proof Proof) (Proof, error) {
+	p := proof
+	if s.Totp == nil {
+		return p, NewError("No code required", 400)
+	}
+	secret, err := DecryptString(SECRET_KEY_DERIVATE_FOR_PROOF, *s.Totp)
+	if err != nil {
+		return p, err
+	}
+	counter := TotpCounter(secret, proof.Value)
+	if counter == -1 {
+		time.Sleep(1000 * time.Millisecond)
+		return p, NewError("Invalid code", 403)
+	}
+	shareTotpUsed.Lock()
+	defer shareTotpUsed.Unlock()
+	if counter <= shareTotpUsed.counter[s.Id] {
+		return p, NewError("Code already used, wait for the next one", 403)
+	}
+	shareTotpUsed.counter[s.Id] = counter
+	p.Value = shareTotpProofValue(s)
+	// unlike the other proofs, a code is a second factor which is only remembered for a few hours
+	p.Expire = time.Now().Add(SHARE_PROOF_TOTP_TTL).UnixNano() / int64(time.Millisecond)
+	return p, nil
+}
+
+// the ciphertext of the secret changes when the shares get reencrypted with a new key. The proof
+// is made from the secret itself so that people don't have to enter a code again after that
+func shareTotpProofValue(s Share) string {
+	secret, err := DecryptString(SECRET_KEY_DERIVATE_FOR_PROOF, *s.Totp)
+	if err != nil {
+		return *s.Totp
+	}
+	return Sign(secret, "share::totp")
+}
+
+// the last time step used with the totp of each link, a code can only be used once
+var shareTotpUsed = struct {
+	sync.Mutex
+	counter map[string]int64
+}{counter: make(map[string]int64)}
+
+func ShareProofGetEmail(req *http.Request, s Share) string {
+	if s.Users == nil {
+		return ""
+	}
+	for _, p := range ShareProofGetAlreadyVerified(req) {
+		if p.Key == "email" && p.Email != "" {
+			return p.Email
+		}
+	}
+	if username, _ := ShareProofGetCredentials(req); username != "" {
+		if _, ok := ShareProofVerifierEmail(*s.Users, username); ok {
+			return username
+		}
+	}
+	return ""
+}
+
+/*
+ * When mounted as a network drive, proofs are given through basic auth with a username that looks like:
+ * "email[hash]" where hash is a signature that tells us the email has already been verified
+ */
+func ShareProofGetCredentials(req *http.Request) (string, string) {
+	decoded, err := base64.StdEncoding.DecodeString(
+		strings.TrimPrefix(req.Header.Get("Authorization"), "Basic "),
+	)
+	if err != nil {
+		return "", ""
+	}
+	s := bytes.Split(decoded, []byte(":"))
+	if len(s) < 2 {
+		return "", ""
+	}
+	p := string(bytes.Join(s[1:], []byte(":")))
+	usr := regexp.MustCompile(`^(.*)\[([0-9a-zA-Z]+)\]$`).FindStringSubmatch(string(s[0]))
+	if len(usr) != 3 {
+		return "", p
+	}
+	for _, key := range SecretKeyring(SECRET_KEY_DERIVATE_FOR_HASH) {
+		if Hash(usr[1] + key, 10) == usr[2] {
+			return usr[1], p
+		}
+	}
+	return "", p
+}
+
+func ShareProofVerifierIp(ranges string, ip string) bool {
+	return IsIpInRanges(ip, ranges)
+}
+
 func ShareProofVerifierPassword(hashed string, given string) (string, bool) {
 	if err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(given)); err != nil {
 		return "", false
@@ -278,7 +850,7 @@ func ShareProofGetAlreadyVerified(req *http.Request) []Proof {
 		return p
 	}
 	cookieValue = c.Value
-	if len(cookieValue) > 500 {
+	if len(cookieValue) > SHARE_PROOF_COOKIE_MAX {
 		return p
 	}
 	j, err := DecryptString(SECRET_KEY_DERIVATE_FOR_PROOF, cookieValue)
@@ -286,16 +858,23 @@ func ShareProofGetAlreadyVerified(req *http.Request) []Proof {
 		return p
 	}
 	_ = json.Unmarshal([]byte(j), &p)
-	return p
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	valid := p[:0]
+	for _, proof := range p {
+		if proof.Expire != 0 && proof.Expire < now {
+			continue
+		}
+		valid = append(valid, proof)
+	}
+	return valid
 }
 
 func ShareProofGetRequired(s Share) []Proof {
 	var p []Proof
-	if s.Password != nil {
-		p = append(p, Proof{Key: "password", Value: *s.Password})
-	}
-	if s.Users != nil {
-		p = append(p, Proof{Key: "email", Value: *s.Users})
+	for _, h := range Hooks.Get.ShareProof() {
+		if h.Required != nil {
+			p = append(p, h.Required(s)...)
+		}
 	}
 	return p
 }
@@ -335,6 +914,58 @@ func shareProofAreEquivalent(ref Proof,  p Proof) bool {
 	return false
 }
 
+func sendEmail(to string, subject string, body string) error {
+	email := struct {
+		Hostname string `json:"server"`
+		Port     int    `json:"port"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		From     string `json:"from"`
+	}{
+		Hostname: Config.Get("email.server").String(),
+		Port: Config.Get("email.port").Int(),
+		Username: Config.Get("email.username").String(),
+		Password: Config.Get("email.password").String(),
+		From: Config.Get("email.from").String(),
+	}
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", email.From)
+	m.SetHeader("To", to)
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/html", body)
+	d := gomail.NewDialer(email.Hostname, email.Port, email.Username, email.Password)
+	d.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	if err := d.DialAndSend(m); err != nil {
+		Log.Error("Sendmail error: %v", err)
+		return NewError("Couldn't send email", 500)
+	}
+	return nil
+}
+
+func TmplEmailDropNotification() string {
+	return `
+<!doctype html>
+<html>
+  <head>
+    <meta name="viewport" content="width=device-width" />
+    <meta http-equiv="Content-Type" content="text/html; charset=UTF-8" />
+    <title>New file received</title>
+  </head>
+  <body style="background-color:#f6f6f6;font-family:sans-serif;font-size:14px;line-height:1.4;margin:0;padding:20px;">
+    <div style="max-width:450px;margin:0 auto;background:#ffffff;border-radius:3px;padding:20px;">
+      <h2 style="font-weight:100;margin:0 0 15px 0">A new file was dropped in your shared link</h2>
+      <p style="margin:0;">File: <strong>{{.Path}}</strong> ({{.Size}} bytes)</p>
+      {{if .Email}}<p style="margin:0;">From: {{.Email}}</p>{{end}}
+    </div>
+    <div style="text-align:center;color:#999999;font-size:12px;margin-top:10px;">
+      Powered by <a href="http://github.com/mickael-kerjean/filestash" style="color:#999999;">Filestash</a>.
+    </div>
+  </body>
+</html>
+`
+}
+
 func TmplEmailVerification() string {
 	return `
 <!doctype html>
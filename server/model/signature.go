@@ -0,0 +1,136 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var SIGNED_URL_MAX_TTL func() int
+
+/*
+ * Signed urls give access to a single operation on a single path without the auth cookie. Unlike
+ * shared links, nothing is stored: the session is carried encrypted in the url and the whole thing
+ * is signed with a derivative of the secret key. With the session store, the url only references
+ * the id of the session instead of embedding the credentials
+ */
+var signedOperations = map[string]struct {
+	Route   string
+	Methods []string
+}{
+	"cat":  {"/api/files/cat", []string{"GET", "HEAD"}},
+	"save": {"/api/files/cat", []string{"POST"}},
+	"ls":   {"/api/files/ls", []string{"GET"}},
+}
+
+func init() {
+	SIGNED_URL_MAX_TTL = func() int {
+		return Config.Get("features.protection.signed_url_max_ttl").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "signed_url_max_ttl"
+			f.Type = "number"
+			f.Default = 86400
+			f.Description = "Maximum lifetime in seconds of a signed url. Signed urls are disabled when set to 0"
+			f.Placeholder = fmt.Sprintf("Default: %ds", f.Default)
+			return f
+		}).Int()
+	}
+	SIGNED_URL_MAX_TTL()
+}
+
+// SignedUrlCreate gives a url to do op on path. sessionId is the value of the auth cookie when it
+// points to a stored session, empty otherwise
+func SignedUrlCreate(session map[string]string, sessionId string, op string, path string, ttl int) (string, error) {
+	o, ok := signedOperations[op]
+	if ok == false {
+		return "", NewError("Unsupported operation", 400)
+	}
+	if SIGNED_URL_MAX_TTL() <= 0 {
+		return "", NewError("Feature isn't enable, contact your administrator", 405)
+	} else if ttl <= 0 || ttl > SIGNED_URL_MAX_TTL() {
+		return "", NewError(fmt.Sprintf("Expiry must be between 1 and %d seconds", SIGNED_URL_MAX_TTL()), 400)
+	}
+	s := sessionId
+	if IsSessionId(sessionId) == false {
+		if SessionStoreEnabled() {
+			// an url carrying its own session would outlive a logout or a revocation
+			return "", NewError("Signed urls require a stored session, login again", 401)
+		}
+		b, err := json.Marshal(session)
+		if err != nil {
+			return "", err
+		}
+		s = string(b)
+	}
+	auth, err := EncryptString(SECRET_KEY_DERIVATE_FOR_SIGNATURE, s)
+	if err != nil {
+		return "", err
+	}
+	exp := strconv.FormatInt(time.Now().Add(time.Duration(ttl) * time.Second).Unix(), 10)
+
+	q := url.Values{}
+	q.Set("path", path)
+	q.Set("exp", exp)
+	q.Set("auth", auth)
+	q.Set("sig", Sign(SECRET_KEY_DERIVATE_FOR_SIGNATURE, signedUrlPayload(op, path, exp, auth)))
+	return o.Route + "?" + q.Encode(), nil
+}
+
+func SignedUrlVerify(req *http.Request) (map[string]string, error) {
+	var session map[string]string = make(map[string]string)
+	query := req.URL.Query()
+	if SIGNED_URL_MAX_TTL() <= 0 {
+		return session, NewError("Feature isn't enable, contact your administrator", 405)
+	}
+
+	op := signedUrlOperation(req)
+	if op == "" {
+		return session, ErrNotAllowed
+	}
+	path, exp, auth := query.Get("path"), query.Get("exp"), query.Get("auth")
+	if VerifySignature(SECRET_KEY_DERIVATE_FOR_SIGNATURE, signedUrlPayload(op, path, exp, auth), query.Get("sig")) == false {
+		return session, NewError("Invalid signature", 403)
+	}
+	if t, err := strconv.ParseInt(exp, 10, 64); err != nil || time.Now().Unix() > t {
+		return session, NewError("Link has expired", 410)
+	}
+	str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_SIGNATURE, auth)
+	if err != nil {
+		return session, NewError("Invalid signature", 403)
+	}
+	if IsSessionId(str) {
+		if session, err = SessionGet(str); err != nil {
+			return make(map[string]string), ErrNotAuthorized
+		}
+		return session, nil
+	} else if SessionStoreEnabled() {
+		return session, ErrNotAuthorized
+	}
+	err = json.Unmarshal([]byte(str), &session)
+	return session, err
+}
+
+func signedUrlOperation(req *http.Request) string {
+	for op, o := range signedOperations {
+		if o.Route != req.URL.Path {
+			continue
+		}
+		for _, method := range o.Methods {
+			if method == req.Method {
+				return op
+			}
+		}
+	}
+	return ""
+}
+
+func signedUrlPayload(op string, path string, exp string, auth string) string {
+	return strings.Join([]string{op, path, exp, auth}, "\n")
+}
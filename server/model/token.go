@@ -0,0 +1,154 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	. "github.com/mickael-kerjean/filestash/server/common"
+)
+
+/*
+ * Personal access tokens are minted by a logged in user and sent as `Authorization: Bearer xxx`.
+ * A token carries the session it was created from, restricted to a path and a set of permissions.
+ * Only a hash of the token is stored, the token itself is shown once to the user
+ */
+type apiTokenParams struct {
+	CanRead   bool   `json:"can_read"`
+	CanWrite  bool   `json:"can_write"`
+	CanUpload bool   `json:"can_upload"`
+	Expire    *int64 `json:"expire,omitempty"`
+}
+
+func ApiTokenCreate(t *ApiToken) (string, error) {
+	if t.CanRead == false && t.CanWrite == false && t.CanUpload == false {
+		return "", NewError("A token needs at least one permission", 400)
+	}
+	token := RandomString(48)
+	t.Id = RandomString(16)
+	params, err := json.Marshal(apiTokenParams{t.CanRead, t.CanWrite, t.CanUpload, t.Expire})
+	if err != nil {
+		return "", err
+	}
+	_, err = DB.Exec(
+		"INSERT INTO ApiToken(id, hash, backend, name, path, params, auth) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		t.Id, apiTokenHash(token), t.Backend, t.Name, t.Path, params, t.Auth,
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func ApiTokenList(backend string) ([]ApiToken, error) {
+	rows, err := DB.Query("SELECT id, name, path, params, created, last_used FROM ApiToken WHERE backend = ? ORDER BY created DESC", backend)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []ApiToken{}
+	for rows.Next() {
+		var t ApiToken
+		if err = apiTokenScan(rows, &t); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+func ApiTokenDelete(backend string, id string) error {
+	res, err := DB.Exec("DELETE FROM ApiToken WHERE backend = ? AND id = ?", backend, id)
+	if err != nil {
+		return err
+	} else if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ApiTokenVerify returns the token matching what was sent by the client
+func ApiTokenVerify(token string) (ApiToken, error) {
+	var t ApiToken
+	var params []byte
+	var lastUsed sql.NullTime
+	err := DB.QueryRow(
+		"SELECT id, name, path, params, created, last_used, backend, auth FROM ApiToken WHERE hash = ?", apiTokenHash(token),
+	).Scan(&t.Id, &t.Name, &t.Path, &params, &t.Created, &lastUsed, &t.Backend, &t.Auth)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, ErrNotAuthorized
+		}
+		return t, err
+	}
+	if err = apiTokenParamsLoad(params, lastUsed, &t); err != nil {
+		return t, err
+	}
+	if err = t.IsValid(); err != nil {
+		return t, err
+	}
+	go DB.Exec("UPDATE ApiToken SET last_used = datetime('now') WHERE id = ?", t.Id)
+	return t, nil
+}
+
+// re-encrypt the session attached to the tokens with the current secret key. The backend the
+// tokens are listed under is computed from the secret key as well and gets updated along the way
+func ApiTokenReencrypt() (updated int, failed int, err error) {
+	rows, err := DB.Query("SELECT id, auth FROM ApiToken")
+	if err != nil {
+		return 0, 0, err
+	}
+	auths := make(map[string]string)
+	for rows.Next() {
+		var id, auth string
+		rows.Scan(&id, &auth)
+		auths[id] = auth
+	}
+	rows.Close()
+	for id, auth := range auths {
+		str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_USER, auth)
+		if err != nil {
+			failed += 1
+			continue
+		}
+		if auth, err = EncryptString(SECRET_KEY_DERIVATE_FOR_USER, str); err != nil {
+			failed += 1
+			continue
+		}
+		session := make(map[string]string)
+		if err = json.Unmarshal([]byte(str), &session); err != nil {
+			failed += 1
+			continue
+		}
+		backend := GenerateID(&App{Session: session})
+		if _, err = DB.Exec("UPDATE ApiToken SET auth = ?, backend = ? WHERE id = ?", auth, backend, id); err != nil {
+			failed += 1
+			continue
+		}
+		updated += 1
+	}
+	return updated, failed, nil
+}
+
+func apiTokenScan(rows *sql.Rows, t *ApiToken) error {
+	var params []byte
+	var lastUsed sql.NullTime
+	if err := rows.Scan(&t.Id, &t.Name, &t.Path, &params, &t.Created, &lastUsed); err != nil {
+		return err
+	}
+	return apiTokenParamsLoad(params, lastUsed, t)
+}
+
+func apiTokenParamsLoad(b []byte, lastUsed sql.NullTime, t *ApiToken) error {
+	var p apiTokenParams
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	t.CanRead, t.CanWrite, t.CanUpload, t.Expire = p.CanRead, p.CanWrite, p.CanUpload, p.Expire
+	if lastUsed.Valid {
+		t.LastUsed = &lastUsed.Time
+	}
+	return nil
+}
+
+func apiTokenHash(token string) string {
+	return Hash("TOKEN_" + token, 40)
+}
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"encoding/json"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"testing"
+)
+
+func TestApiTokenAfterKeyRotation(t *testing.T) {
+	defer secretKeySetup()()
+	session := map[string]string{"type": "sftp", "hostname": "sftp.example.com", "username": "alice"}
+	s, _ := json.Marshal(session)
+	auth, err := EncryptString(SECRET_KEY_DERIVATE_FOR_USER, string(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := ApiToken{
+		Name:    "test",
+		Backend: GenerateID(&App{Session: session}),
+		Auth:    auth,
+		Path:    "/",
+		CanRead: true,
+	}
+	if _, err = ApiTokenCreate(&token); err != nil {
+		t.Fatal(err)
+	}
+
+	secretKeyRotate()
+	if _, failed, err := ApiTokenReencrypt(); err != nil || failed != 0 {
+		t.Fatalf("re-encryption failed: %v, %d failed", err, failed)
+	}
+	secretKeyDropPrevious()
+
+	backend := GenerateID(&App{Session: session})
+	tokens, err := ApiTokenList(backend)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(tokens) != 1 || tokens[0].Id != token.Id {
+		t.Fatalf("expected the token to be listed after a key rotation, got %+v", tokens)
+	}
+	if err = ApiTokenDelete(backend, token.Id); err != nil {
+		t.Fatalf("expected the token to be revoked after a key rotation, got %s", err.Error())
+	}
+}
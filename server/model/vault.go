@@ -0,0 +1,352 @@
+package model
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var VAULT_ENABLE func() bool
+
+/*
+ * The vault keeps the secrets of a backend on the server, encrypted with a derivative of the secret
+ * key. Sessions then carry a reference like `vault://session/xxx` instead of the secret itself, which
+ * is what makes it possible to use credentials that wouldn't fit in a cookie.
+ * Session entries are bound to the backend they were created for and get removed once nothing
+ * refers to them anymore.
+ * Admins can also provision credentials for a connection under `vault://connection/name`: users
+ * only ever see the reference and it can only be used against the connection referring to it, with
+ * every other field of that connection left untouched
+ */
+const (
+	VAULT_PREFIX          = "vault://"
+	VAULT_KIND_SESSION    = "session"
+	VAULT_KIND_CONNECTION = "connection"
+)
+
+var vaultSensitiveKeys = []string{
+	"password", "passphrase", "token", "refresh", "access_token",
+	"secret_access_key", "encryption_key", "bind_password",
+}
+
+var vaultNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_\-\.]{1,64}$`)
+
+// session entries which haven't been used for that long and aren't referred to by a stored
+// session, a shared link or a token are removed. That's the lifetime of the auth cookie
+const VAULT_SESSION_RETENTION = 30
+
+type VaultEntry struct {
+	Kind     string     `json:"kind"`
+	Name     string     `json:"name"`
+	Ref      string     `json:"ref"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+func init() {
+	VAULT_ENABLE = func() bool {
+		return Config.Get("auth.vault.enable").Schema(func(f *FormElement) *FormElement {
+			if f == nil {
+				f = &FormElement{}
+			}
+			f.Name = "enable"
+			f.Type = "boolean"
+			f.Default = false
+			f.Description = "Keep passwords, keys and tokens of users on the server instead of the auth cookie"
+			return f
+		}).Bool()
+	}
+	VAULT_ENABLE()
+}
+
+func IsVaultRef(value string) bool {
+	return strings.HasPrefix(value, VAULT_PREFIX)
+}
+
+// VaultSeal moves the secrets of a session to the vault, leaving references in their place
+func VaultSeal(session map[string]string) error {
+	if VAULT_ENABLE() == false {
+		return nil
+	}
+	backend := vaultBackend(session)
+	for _, key := range vaultSensitiveKeys {
+		value := session[key]
+		if value == "" || IsVaultRef(value) {
+			continue
+		}
+		// the same secret always ends up in the same entry, login again doesn't fill up the vault
+		name := Hash(SECRET_KEY_DERIVATE_FOR_VAULT+backend+key+value, 40)
+		if err := vaultPut(VAULT_KIND_SESSION, name, value, backend); err != nil {
+			return err
+		}
+		session[key] = vaultRef(VAULT_KIND_SESSION, name)
+	}
+	return nil
+}
+
+// VaultOpen gives a copy of the connection with the references replaced by the actual secrets.
+// Provisioned credentials are only given when one of the allowed connections refers to them
+func VaultOpen(conn map[string]string, allowed []map[string]interface{}) (map[string]string, error) {
+	var params map[string]string = nil
+	for key, value := range conn {
+		if IsVaultRef(value) == false {
+			continue
+		}
+		kind, name := vaultParseRef(value)
+		backend := ""
+		if kind == VAULT_KIND_CONNECTION {
+			isAllowed := false
+			for i := range allowed {
+				if fmt.Sprint(allowed[i][key]) == value && vaultConnMatch(allowed[i], conn) {
+					isAllowed = true
+					break
+				}
+			}
+			if isAllowed == false {
+				return conn, ErrNotAllowed
+			}
+		} else if kind == VAULT_KIND_SESSION {
+			backend = vaultBackend(conn)
+		} else {
+			return conn, ErrNotValid
+		}
+		secret, err := vaultGet(kind, name, backend)
+		if err != nil {
+			return conn, err
+		}
+		if params == nil {
+			params = make(map[string]string, len(conn))
+			for k, v := range conn {
+				params[k] = v
+			}
+		}
+		params[key] = secret
+	}
+	if params == nil {
+		return conn, nil
+	}
+	return params, nil
+}
+
+func VaultList() ([]VaultEntry, error) {
+	rows, err := DB.Query("SELECT kind, name, created, last_used FROM Vault WHERE kind = ? ORDER BY name", VAULT_KIND_CONNECTION)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []VaultEntry{}
+	for rows.Next() {
+		var e VaultEntry
+		var lastUsed sql.NullTime
+		if err = rows.Scan(&e.Kind, &e.Name, &e.Created, &lastUsed); err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			e.LastUsed = &lastUsed.Time
+		}
+		e.Ref = vaultRef(e.Kind, e.Name)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// VaultProvision stores a credential for connections, to be referred to from the config
+func VaultProvision(name string, value string) (string, error) {
+	if vaultNameRegexp.MatchString(name) == false {
+		return "", NewError("Invalid name", 400)
+	} else if value == "" {
+		return "", NewError("Missing value", 400)
+	}
+	if err := vaultPut(VAULT_KIND_CONNECTION, name, value, ""); err != nil {
+		return "", err
+	}
+	return vaultRef(VAULT_KIND_CONNECTION, name), nil
+}
+
+func VaultDelete(name string) error {
+	res, err := DB.Exec("DELETE FROM Vault WHERE kind = ? AND name = ?", VAULT_KIND_CONNECTION, name)
+	if err != nil {
+		return err
+	} else if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func VaultReencrypt() (updated int, failed int, err error) {
+	rows, err := DB.Query("SELECT kind, name, value FROM Vault")
+	if err != nil {
+		return 0, 0, err
+	}
+	values := make(map[[2]string]string)
+	for rows.Next() {
+		var kind, name, value string
+		rows.Scan(&kind, &name, &value)
+		values[[2]string{kind, name}] = value
+	}
+	rows.Close()
+	for k, value := range values {
+		str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_VAULT, value)
+		if err != nil {
+			failed += 1
+			continue
+		}
+		if value, err = EncryptString(SECRET_KEY_DERIVATE_FOR_VAULT, str); err != nil {
+			failed += 1
+			continue
+		}
+		if _, err = DB.Exec("UPDATE Vault SET value = ? WHERE kind = ? AND name = ?", value, k[0], k[1]); err != nil {
+			failed += 1
+			continue
+		}
+		updated += 1
+	}
+	return updated, failed, nil
+}
+
+func vaultPut(kind string, name string, value string, backend string) error {
+	enc, err := EncryptString(SECRET_KEY_DERIVATE_FOR_VAULT, value)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec(
+		"INSERT OR REPLACE INTO Vault(kind, name, value, backend) VALUES(?, ?, ?, ?)",
+		kind, name, enc, backend,
+	)
+	return err
+}
+
+// vaultGet gives the secret of an entry. The backend of session entries must be the one they
+// were created for
+func vaultGet(kind string, name string, backend string) (string, error) {
+	var value string
+	var owner sql.NullString
+	var lastUsed sql.NullTime
+	err := DB.QueryRow("SELECT value, backend, last_used FROM Vault WHERE kind = ? AND name = ?", kind, name).Scan(&value, &owner, &lastUsed)
+	if err == sql.ErrNoRows {
+		return "", NewError("Credential not found in the vault", 401)
+	} else if err != nil {
+		return "", err
+	} else if kind == VAULT_KIND_SESSION && owner.String != backend {
+		return "", NewError("Credential not found in the vault", 401)
+	}
+	if lastUsed.Valid == false || time.Since(lastUsed.Time) > time.Hour {
+		go DB.Exec("UPDATE Vault SET last_used = datetime('now') WHERE kind = ? AND name = ?", kind, name)
+	}
+	str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_VAULT, value)
+	if err != nil {
+		return "", NewError("Credential can't be decrypted", 401)
+	}
+	return str, nil
+}
+
+// the backend an entry belongs to, computed without the secrets so that it's the same before and
+// after sealing the session. It doesn't depend on the secret key either: sessions kept in a cookie
+// must still find their credentials after a rotation of the key
+func vaultBackend(conn map[string]string) string {
+	params := make(map[string]string, len(conn))
+	for key, value := range conn {
+		params[key] = value
+	}
+	for _, key := range vaultSensitiveKeys {
+		delete(params, key)
+	}
+	return GenerateStableID(&App{Session: params})
+}
+
+// vaultConnMatch checks every field of the provisioning connection against the session. Without
+// that, the credential would be sent wherever the fields left to the user are pointing to
+func vaultConnMatch(provisioning map[string]interface{}, conn map[string]string) bool {
+	for key, expected := range provisioning {
+		if key == "label" {
+			continue
+		}
+		isSensitive := false
+		for _, k := range vaultSensitiveKeys {
+			if k == key {
+				isSensitive = true
+				break
+			}
+		}
+		if isSensitive {
+			continue
+		}
+		value := ""
+		if expected != nil {
+			value = fmt.Sprint(expected)
+		}
+		if key == "path" {
+			if EnforceDirectory(value) != EnforceDirectory(conn[key]) {
+				return false
+			}
+		} else if value != conn[key] {
+			return false
+		}
+	}
+	return true
+}
+
+func vaultVacuum() {
+	inUse := make(map[string]bool)
+	for _, query := range []string{"SELECT auth FROM Session", "SELECT auth FROM Share", "SELECT auth FROM ApiToken"} {
+		rows, err := DB.Query(query)
+		if err != nil {
+			continue
+		}
+		for rows.Next() {
+			var auth string
+			if rows.Scan(&auth) != nil {
+				continue
+			}
+			str, err := DecryptString(SECRET_KEY_DERIVATE_FOR_USER, auth)
+			if err != nil {
+				continue
+			}
+			var session map[string]string
+			if json.Unmarshal([]byte(str), &session) != nil {
+				continue
+			}
+			for _, value := range session {
+				if IsVaultRef(value) {
+					inUse[value] = true
+				}
+			}
+		}
+		rows.Close()
+	}
+
+	rows, err := DB.Query(
+		"SELECT name FROM Vault WHERE kind = ? AND COALESCE(last_used, created) < datetime('now', '-' || ? || ' days')",
+		VAULT_KIND_SESSION, VAULT_SESSION_RETENTION,
+	)
+	if err != nil {
+		return
+	}
+	unused := []string{}
+	for rows.Next() {
+		var name string
+		if rows.Scan(&name) == nil && inUse[vaultRef(VAULT_KIND_SESSION, name)] == false {
+			unused = append(unused, name)
+		}
+	}
+	rows.Close()
+	for _, name := range unused {
+		DB.Exec("DELETE FROM Vault WHERE kind = ? AND name = ?", VAULT_KIND_SESSION, name)
+	}
+}
+
+func vaultRef(kind string, name string) string {
+	return VAULT_PREFIX + kind + "/" + name
+}
+
+func vaultParseRef(ref string) (kind string, name string) {
+	ref = strings.TrimPrefix(ref, VAULT_PREFIX)
+	if i := strings.Index(ref, "/"); i > 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return "", ref
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	. "github.com/mickael-kerjean/filestash/server/common"
+	"testing"
+)
+
+// secretKeySetup starts from a fresh secret key and returns what's needed to put the previous one
+// back. secretKeyRotate does what the admin does: the previous key stays in the keyring until the
+// content is re-encrypted, secretKeyDropPrevious is the last step
+func secretKeySetup() func() {
+	previous := SECRET_KEY
+	InitSecretDerivate(RandomString(16))
+	return func() {
+		InitSecretDerivate(previous)
+	}
+}
+
+func secretKeyRotate() {
+	InitSecretDerivate(RandomString(16), SECRET_KEY)
+}
+
+func secretKeyDropPrevious() {
+	InitSecretDerivate(SECRET_KEY)
+}
+
+func TestVaultAfterKeyRotation(t *testing.T) {
+	defer secretKeySetup()()
+	Config.Get("auth.vault.enable").Set(true)
+	defer Config.Get("auth.vault.enable").Set(false)
+
+	session := map[string]string{
+		"type":     "sftp",
+		"hostname": "sftp.example.com",
+		"username": "alice",
+		"password": "hunter2",
+	}
+	if err := VaultSeal(session); err != nil {
+		t.Fatal(err)
+	} else if IsVaultRef(session["password"]) == false {
+		t.Fatalf("the password should be in the vault, got '%s'", session["password"])
+	}
+
+	secretKeyRotate()
+	if _, failed, err := VaultReencrypt(); err != nil || failed != 0 {
+		t.Fatalf("re-encryption failed: %v, %d failed", err, failed)
+	}
+	secretKeyDropPrevious()
+
+	params, err := VaultOpen(session, nil)
+	if err != nil {
+		t.Fatalf("the credential should still be there after a key rotation: %s", err.Error())
+	} else if params["password"] != "hunter2" {
+		t.Errorf("unexpected password '%s'", params["password"])
+	}
+
+	session["hostname"] = "elsewhere.example.com"
+	if _, err = VaultOpen(session, nil); err == nil {
+		t.Errorf("the credential mustn't be given to another backend")
+	}
+}
@@ -32,6 +32,7 @@ func init() {
 	os.MkdirAll(cachePath, os.ModePerm)
 
 	webdavCache = NewQuickCache(20, 10)
+	MetricsCache("webdav", &webdavCache)
 	webdavCache.OnEvict(func(filename string, _ interface{}) {
 		os.Remove(filename)
 	})
@@ -39,6 +40,7 @@ func init() {
 
 type WebdavFs struct {
 	req        *http.Request
+	app        *App
 	backend    IBackend
 	path       string
 	id         string
@@ -46,9 +48,10 @@ type WebdavFs struct {
 	webdavFile *WebdavFile
 }
 
-func NewWebdavFs(b IBackend, primaryKey string, chroot string, req *http.Request) *WebdavFs {
+func NewWebdavFs(app *App, primaryKey string, chroot string, req *http.Request) *WebdavFs {
 	return &WebdavFs{
-		backend: b,
+		app:     app,
+		backend: app.Backend,
 		id:      primaryKey,
 		chroot:  chroot,
 		req:     req,
@@ -58,6 +61,8 @@ func NewWebdavFs(b IBackend, primaryKey string, chroot string, req *http.Request
 func (this WebdavFs) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
 	if name = this.fullpath(name); name == "" {
 		return os.ErrNotExist
+	} else if CanUpload(this.app, name) == false {
+		return os.ErrPermission
 	}
 	return this.backend.Mkdir(name)
 }
@@ -81,8 +86,16 @@ func (this *WebdavFs) OpenFile(ctx context.Context, name string, flag int, perm
 	if name = this.fullpath(name); name == "" {
 		return nil, os.ErrNotExist
 	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if CanEdit(this.app, name) == false && CanUpload(this.app, name) == false {
+			return nil, os.ErrPermission
+		}
+	} else if CanRead(this.app, name) == false {
+		return nil, os.ErrPermission
+	}
 	this.webdavFile = &WebdavFile{
 		path: name,
+		app: this.app,
 		backend: this.backend,
 		cache: cachePath,
 		fwrite: fwriteFile(),
@@ -93,8 +106,16 @@ func (this *WebdavFs) OpenFile(ctx context.Context, name string, flag int, perm
 func (this WebdavFs) RemoveAll(ctx context.Context, name string) error {
 	if name = this.fullpath(name); name == "" {
 		return os.ErrNotExist
+	} else if CanEditRecursive(this.app, this.folderPath(name)) == false {
+		return os.ErrPermission
+	}
+	if err := this.backend.Rm(name); err != nil {
+		return err
 	}
-	return this.backend.Rm(name)
+	if err := ShareRemoved(this.id, name); err != nil {
+		Log.Warning("share::rm %s", err.Error())
+	}
+	return nil
 }
 
 func (this WebdavFs) Rename(ctx context.Context, oldName, newName string) error {
@@ -103,7 +124,20 @@ func (this WebdavFs) Rename(ctx context.Context, oldName, newName string) error
 	} else if newName = this.fullpath(newName); newName == "" {
 		return os.ErrNotExist
 	}
-	return this.backend.Mv(oldName, newName)
+	if folder := this.folderPath(oldName); strings.HasSuffix(folder, "/") {
+		if CanEditRecursiveTo(this.app, folder, strings.TrimSuffix(newName, "/")+"/") == false {
+			return os.ErrPermission
+		}
+	} else if CanEdit(this.app, oldName) == false || CanEdit(this.app, newName) == false {
+		return os.ErrPermission
+	}
+	if err := this.backend.Mv(oldName, newName); err != nil {
+		return err
+	}
+	if err := ShareMove(this.id, oldName, newName); err != nil {
+		Log.Warning("share::mv %s", err.Error())
+	}
+	return nil
 }
 
 func (this *WebdavFs) Stat(ctx context.Context, name string) (os.FileInfo, error) {
@@ -117,12 +151,31 @@ func (this *WebdavFs) Stat(ctx context.Context, name string) (os.FileInfo, error
 	}
 	this.webdavFile = &WebdavFile{
 		path: fullname,
+		app: this.app,
 		backend: this.backend,
 		cache: fmt.Sprintf("%stmp_%s", cachePath, Hash(this.id + name, 20)),
 	}
 	return this.webdavFile.Stat()
 }
 
+// folderPath adds the trailing slash webdav clients don't always give to folders, which is how the
+// acl know the rules below the folder need to be checked
+func (this WebdavFs) folderPath(path string) string {
+	if strings.HasSuffix(path, "/") {
+		return path
+	}
+	files, err := this.backend.Ls(filepath.Dir(path) + "/")
+	if err != nil {
+		return path
+	}
+	for i := range files {
+		if files[i].Name() == filepath.Base(path) && files[i].IsDir() {
+			return path + "/"
+		}
+	}
+	return path
+}
+
 func (this WebdavFs) fullpath(path string) string {
 	p := filepath.Join(this.chroot, path)
 	if strings.HasSuffix(path, "/") == true && strings.HasSuffix(p, "/") == false {
@@ -140,6 +193,7 @@ func (this WebdavFs) fullpath(path string) string {
  */
 type WebdavFile struct {
 	path    string
+	app     *App
 	backend IBackend
 	cache   string
 	fread   *os.File
@@ -197,12 +251,27 @@ func (this *WebdavFile) Readdir(count int) ([]os.FileInfo, error) {
 		return nil, os.ErrNotExist
 	}
 	f, err := this.backend.Ls(this.path)
-	this.files = f
-	return f, err
+	if err != nil {
+		return nil, err
+	}
+	this.files = make([]os.FileInfo, 0, len(f))
+	for i := range f {
+		name := this.path + f[i].Name()
+		if f[i].IsDir() {
+			name += "/"
+		}
+		if AclVisible(this.app, name) {
+			this.files = append(this.files, f[i])
+		}
+	}
+	return this.files, nil
 }
 
 func (this *WebdavFile) Stat() (os.FileInfo, error) {
 	this.push_to_remote_if_needed()
+	if AclVisible(this.app, this.path) == false {
+		return nil, os.ErrNotExist
+	}
 	if strings.HasSuffix(this.path, "/") {
 		_, err := this.Readdir(0)
 		if err != nil {
@@ -147,10 +147,7 @@ func StaticHandler(res http.ResponseWriter, req *http.Request) {
 }
 
 func IframeContentHandler(ctx App, res http.ResponseWriter, req *http.Request) {
-	if model.CanRead(&ctx) == false {
-		SendErrorResult(res, ErrPermissionDenied)
-		return
-	} else if oodsLocation := Config.Get("features.office.onlyoffice_server").String(); oodsLocation == "" {
+	if oodsLocation := Config.Get("features.office.onlyoffice_server").String(); oodsLocation == "" {
 		res.WriteHeader(http.StatusServiceUnavailable)
 		res.Write([]byte("<p>The Onlyoffice server hasn't been configured</p>"))
 		res.Write([]byte("<style>p {color: white; text-align: center; margin-top: 50px; font-size: 20px; opacity: 0.6; font-family: monospace; } </style>"))
@@ -176,6 +173,10 @@ func IframeContentHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 		SendErrorResult(res, err)
 		return
 	}
+	if model.CanRead(&ctx, path) == false {
+		SendErrorResult(res, ErrPermissionDenied)
+		return
+	}
 
 	userId = GenerateID(&ctx)
 	f, err := ctx.Backend.Cat(path)
@@ -188,7 +189,7 @@ func IframeContentHandler(ctx App, res http.ResponseWriter, req *http.Request) {
 
 	filename = filepath.Base(path)
 	oodsMode = func() string {
-		if model.CanEdit(&ctx) == false {
+		if model.CanEdit(&ctx, path) == false {
 			return "view"
 		}
 		return "edit"
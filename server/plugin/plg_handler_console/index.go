@@ -10,7 +10,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/kr/pty"
 	. "github.com/mickael-kerjean/filestash/server/common"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/mickael-kerjean/filestash/server/model"
 	"io"
 	"net/http"
 	"os"
@@ -30,7 +30,7 @@ var console_enable = func() bool {
 		f.Default = false
 		f.Name = "console_enable"
 		f.Type = "boolean"
-		f.Description = "Enable/Disable the interactive web console on your instance. It will be available under `/tty/` where username is 'admin' and password is your admin console"
+		f.Description = "Enable/Disable the interactive web console on your instance. It will be available under `/tty/` where username and password are the ones of an admin account with the admin role"
 		f.Placeholder = "Default: false"
 		return f
 	}).Bool()
@@ -44,7 +44,7 @@ func init() {
 		}
 		r.PathPrefix("/admin/tty/").Handler(
 			AuthBasic(
-				func() (string, string) { return "admin", Config.Get("auth.admin").String() },
+				adminAuthenticate,
 				TTYHandler("/admin/tty/"),
 			),
 		)
@@ -60,7 +60,21 @@ var notAuthorised = func(res http.ResponseWriter, req *http.Request) {
 	return
 }
 
-func AuthBasic(credentials func() (string, string), fn http.Handler) http.HandlerFunc {
+/*
+ * Same accounts as the admin console, those with a second factor append their current TOTP code
+ * to the password as basic auth has no room for it
+ */
+func adminAuthenticate(username string, password string) error {
+	user, err := model.AdminUserAuthenticateBasic(username, password)
+	if err != nil {
+		return err
+	} else if user.HasRole(ADMIN_ROLE_ADMIN) == false {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+func AuthBasic(authenticate func(string, string) error, fn http.Handler) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		if strings.HasSuffix(Config.Get("general.host").String(), "filestash.app") {
 			http.NotFoundHandler().ServeHTTP(res, req)
@@ -70,6 +84,12 @@ func AuthBasic(credentials func() (string, string), fn http.Handler) http.Handle
 			return
 		}
 
+		ip := GetClientIp(req)
+		if err := model.RateLimit.Check(ip, "admin"); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		defer model.RateLimit.Release(ip, "admin")
 		auth := req.Header.Get("Authorization")
 		if strings.HasPrefix(auth, "Basic ") == false {
 			notAuthorised(res, req)
@@ -89,19 +109,17 @@ func AuthBasic(credentials func() (string, string), fn http.Handler) http.Handle
 		}
 		username := stuffs[0]
 		password := strings.Join(stuffs[1:], ":")
-		refUsername, refPassword := credentials()
-		if refUsername != username {
-			Log.Info("[tty] username is 'admin'")
-			notAuthorised(res, req)
-			return
-		} else if len(strings.TrimSpace(password)) < 5 {
+		if len(strings.TrimSpace(password)) < 5 {
 			Log.Info("[tty] password is too short")
 			notAuthorised(res, req)
 			return
-		} else if err = bcrypt.CompareHashAndPassword([]byte(refPassword), []byte(password)); err != nil {
+		} else if err = authenticate(username, password); err != nil {
+			Log.Info("[tty] '%s' can't login: %s", username, err.Error())
+			model.RateLimit.Fail(ip, "admin")
 			notAuthorised(res, req)
 			return
 		}
+		model.RateLimit.Success(ip, "admin")
 		fn.ServeHTTP(res, req)
 		return
 	}
@@ -8,7 +8,7 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	. "github.com/mickael-kerjean/filestash/server/common"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/mickael-kerjean/filestash/server/model"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -58,7 +58,7 @@ func init() {
 			http.Redirect(res, req, SYNCTHING_URI + "/", http.StatusTemporaryRedirect)
 		})
 		r.Handle(SYNCTHING_URI + "/", AuthBasic(
-			func() (string, string) { return "admin", Config.Get("auth.admin").String() },
+			adminAuthenticate,
 			http.HandlerFunc(SyncthingProxyHandler),
 		))
 
@@ -67,7 +67,21 @@ func init() {
 	})
 }
 
-func AuthBasic(credentials func() (string, string), fn http.Handler) http.HandlerFunc {
+/*
+ * Same accounts as the admin console, those with a second factor append their current TOTP code
+ * to the password as basic auth has no room for it
+ */
+func adminAuthenticate(username string, password string) error {
+	user, err := model.AdminUserAuthenticateBasic(username, password)
+	if err != nil {
+		return err
+	} else if user.HasRole(ADMIN_ROLE_ADMIN) == false {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+func AuthBasic(authenticate func(string, string) error, fn http.Handler) http.HandlerFunc {
 	var notAuthorised = func(res http.ResponseWriter, req *http.Request) {
 		time.Sleep(1 * time.Second)
 		res.Header().Set("WWW-Authenticate", `Basic realm="User protect", charset="UTF-8"`)
@@ -77,6 +91,12 @@ func AuthBasic(credentials func() (string, string), fn http.Handler) http.Handle
 	}
 
 	return func(res http.ResponseWriter, req *http.Request) {
+		ip := GetClientIp(req)
+		if err := model.RateLimit.Check(ip, "admin"); err != nil {
+			SendErrorResult(res, err)
+			return
+		}
+		defer model.RateLimit.Release(ip, "admin")
 		auth := req.Header.Get("Authorization")
 		if strings.HasPrefix(auth, "Basic ") == false {
 			notAuthorised(res, req)
@@ -96,14 +116,12 @@ func AuthBasic(credentials func() (string, string), fn http.Handler) http.Handle
 		}
 		username := stuffs[0]
 		password := strings.Join(stuffs[1:], ":")
-		refUsername, refPassword := credentials()
-		if refUsername != username {
-			notAuthorised(res, req)
-			return
-		} else if err = bcrypt.CompareHashAndPassword([]byte(refPassword), []byte(password)); err != nil {
+		if err = authenticate(username, password); err != nil {
+			model.RateLimit.Fail(ip, "admin")
 			notAuthorised(res, req)
 			return
 		}
+		model.RateLimit.Success(ip, "admin")
 		fn.ServeHTTP(res, req)
 		return
 	}